@@ -0,0 +1,36 @@
+package pop3srv
+
+import (
+	"net"
+	"net/netip"
+)
+
+// clientIP returns canonical IP address from "host:port" (or bare host)
+// address, usable as a key for per-client tracking. IPv4-mapped IPv6
+// addresses are unmapped and IPv6 addresses are in RFC 5952 form,
+// so e.g. "[0:0:0:0:0:0:0:1]:110" and "[::1]:995" give the same address.
+func clientIP(addr string) (netip.Addr, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr // no port
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return ip.Unmap(), nil
+}
+
+// canonicalAddr returns addr with canonical IP address (see clientIP),
+// addr is returned unchanged if it isn't IP address (e.g. pipe).
+func canonicalAddr(addr string) string {
+	ip, err := clientIP(addr)
+	if err != nil {
+		return addr
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return ip.String()
+	}
+	return net.JoinHostPort(ip.String(), port)
+}
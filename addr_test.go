@@ -0,0 +1,37 @@
+package pop3srv
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientIP(t *testing.T) {
+	for _, c := range []struct {
+		addr string
+		ip   string
+		full string
+	}{
+		{addr: "192.0.2.1:110", ip: "192.0.2.1", full: "192.0.2.1:110"},
+		{addr: "192.0.2.1", ip: "192.0.2.1", full: "192.0.2.1"},
+		{addr: "[::ffff:192.0.2.1]:110", ip: "192.0.2.1", full: "192.0.2.1:110"},
+		{addr: "[::1]:110", ip: "::1", full: "[::1]:110"},
+		{addr: "[0:0:0:0:0:0:0:1]:995", ip: "::1", full: "[::1]:995"},
+		{addr: "[2001:DB8:0:0::1]:110", ip: "2001:db8::1", full: "[2001:db8::1]:110"},
+		{addr: "2001:db8::1", ip: "2001:db8::1", full: "2001:db8::1"},
+	} {
+		t.Run(c.addr, func(t *testing.T) {
+			ip, err := clientIP(c.addr)
+			require.NoError(t, err)
+			assert.Equal(t, c.ip, ip.String())
+			assert.Equal(t, c.full, canonicalAddr(c.addr))
+		})
+	}
+}
+
+func TestClientIPNotIP(t *testing.T) {
+	_, err := clientIP("pipe")
+	assert.Error(t, err)
+	assert.Equal(t, "pipe", canonicalAddr("pipe"))
+}
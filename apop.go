@@ -8,6 +8,13 @@ import (
 // ApopVerify is a helper function implements APOP
 // authentication. It can be used for implementing [Authorizer.Apop].
 func ApopVerify(timestampBanner, digest, password string) bool {
+	return ApopDigest(timestampBanner, password) == digest
+}
+
+// ApopDigest is a helper function which computes APOP digest
+// (hex encoded MD5 of timestamp banner concatenated with password).
+// It's counterpart of [ApopVerify] useful for clients and tests.
+func ApopDigest(timestampBanner, password string) string {
 	hash := md5.Sum([]byte(timestampBanner + password))
-	return hex.EncodeToString(hash[:]) == digest
+	return hex.EncodeToString(hash[:])
 }
@@ -0,0 +1,18 @@
+package pop3srv_test
+
+import (
+	"testing"
+
+	"github.com/pkierski/pop3srv"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApopDigest(t *testing.T) {
+	// example from RFC 1939
+	banner := "<1896.697170952@dbc.mtview.ca.us>"
+	digest := pop3srv.ApopDigest(banner, "tanstaaf")
+
+	assert.Equal(t, "c4c9334bac560ecc979e58001b3e22fb", digest)
+	assert.True(t, pop3srv.ApopVerify(banner, digest, "tanstaaf"))
+	assert.False(t, pop3srv.ApopVerify(banner, digest, "wrong"))
+}
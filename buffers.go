@@ -0,0 +1,35 @@
+package pop3srv
+
+import (
+	"bufio"
+	"io"
+	"sync"
+)
+
+// readersPool is pool of buffered readers reused between sessions
+// to reduce allocations under high load.
+var readersPool = sync.Pool{
+	New: func() any { return bufio.NewReader(nil) },
+}
+
+// defaultReadBufferSize is size of pooled readers (bufio's default).
+const defaultReadBufferSize = 4096
+
+// getReader returns buffered reader of given size, 0 means default size.
+// Readers of non-default size aren't pooled.
+func getReader(r io.Reader, size int) *bufio.Reader {
+	if size != 0 && size != defaultReadBufferSize {
+		return bufio.NewReaderSize(r, max(size, MinReadBufferSize))
+	}
+	br := readersPool.Get().(*bufio.Reader)
+	br.Reset(r)
+	return br
+}
+
+func putReader(br *bufio.Reader) {
+	if br.Size() != defaultReadBufferSize {
+		return
+	}
+	br.Reset(nil)
+	readersPool.Put(br)
+}
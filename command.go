@@ -1,8 +1,10 @@
 package pop3srv
 
 import (
+	"errors"
 	"strconv"
 	"strings"
+	"unicode"
 )
 
 type command struct {
@@ -12,21 +14,63 @@ type command struct {
 }
 
 const (
-	userCmd = "USER"
-	passCmd = "PASS"
-	statCmd = "STAT"
-	listCmd = "LIST"
-	retrCmd = "RETR"
-	deleCmd = "DELE"
-	noopCmd = "NOOP"
-	rsetCmd = "RSET"
-	quitCmd = "QUIT"
-	apopCmd = "APOP"
-	topCmd  = "TOP"
-	uidlCmd = "UIDL"
-	capaCmd = "CAPA"
+	userCmd   = "USER"
+	passCmd   = "PASS"
+	statCmd   = "STAT"
+	listCmd   = "LIST"
+	retrCmd   = "RETR"
+	deleCmd   = "DELE"
+	noopCmd   = "NOOP"
+	rsetCmd   = "RSET"
+	quitCmd   = "QUIT"
+	apopCmd   = "APOP"
+	topCmd    = "TOP"
+	uidlCmd   = "UIDL"
+	capaCmd   = "CAPA"
+	authCmd   = "AUTH"
+	stlsCmd   = "STLS"
+	rpopCmd   = "RPOP"
+	xloginCmd = "XLOGIN"
 )
 
+const (
+	externalMechanism = "EXTERNAL"
+	xoauth2Mechanism  = "XOAUTH2"
+)
+
+// xoauth2ErrorStatus is sent in continuation when XOAUTH2
+// authentication fails.
+const xoauth2ErrorStatus = `{"status":"401","schemes":"bearer"}`
+
+// commandSpec describes arguments accepted by the command.
+type commandSpec struct {
+	minArgs, maxArgs int
+
+	// rest makes the last argument take the rest of the line,
+	// including whitespace (e.g. user names or passwords with spaces).
+	rest bool
+}
+
+var commandSpecs = map[string]commandSpec{
+	userCmd:   {minArgs: 1, maxArgs: 1, rest: true},
+	passCmd:   {minArgs: 1, maxArgs: 1, rest: true},
+	apopCmd:   {minArgs: 2, maxArgs: 2},
+	rpopCmd:   {minArgs: 1, maxArgs: 1, rest: true},
+	xloginCmd: {minArgs: 1, maxArgs: 1, rest: true},
+	authCmd:   {minArgs: 1, maxArgs: 2},
+	stlsCmd:   {},
+	capaCmd:   {},
+	quitCmd:   {},
+	statCmd:   {},
+	noopCmd:   {},
+	rsetCmd:   {},
+	listCmd:   {maxArgs: 1},
+	uidlCmd:   {maxArgs: 1},
+	retrCmd:   {minArgs: 1, maxArgs: 1},
+	deleCmd:   {minArgs: 1, maxArgs: 1},
+	topCmd:    {minArgs: 2, maxArgs: 2},
+}
+
 func (c *command) oneNumArg() bool {
 	return len(c.args) == 1 && c.numArgs[0] != -1
 }
@@ -35,16 +79,35 @@ func (c *command) twoNumArgs() bool {
 	return len(c.args) == 2 && c.numArgs[0] != -1 && c.numArgs[1] != -1
 }
 
+// validArgs checks if number of arguments matches the command's spec.
+// Commands without spec (unknown ones) are always valid.
+func (c *command) validArgs() bool {
+	spec, found := commandSpecs[c.name]
+	return !found || (len(c.args) >= spec.minArgs && len(c.args) <= spec.maxArgs)
+}
+
 func (c *command) parse(line string) {
-	parts := strings.SplitN(line, " ", 3)
+	parts := splitFields(line, 2)
 	c.name = strings.ToUpper(parts[0])
-	c.args = parts[1:]
+	c.args = []string{}
+	if len(parts) > 1 {
+		n := 0 // no limit
+		if spec := commandSpecs[c.name]; spec.rest {
+			n = spec.maxArgs
+		}
+		c.args = splitFields(parts[1], n)
+	}
 	c.numArgs = make([]int, len(c.args))
 	for i, arg := range c.args {
 		numArg, err := strconv.Atoi(arg)
-		if err == nil {
+		if errors.Is(err, strconv.ErrRange) && numArg > 0 {
+			// too big for int, but still a number (beyond any mailbox)
+			err = nil
+		}
+		if err == nil && numArg >= 0 {
 			c.numArgs[i] = numArg
-			if i == 0 && c.numArgs[i] > 0 {
+			if i == 0 {
+				// message numbers are 1-based, 0 becomes invalid -1
 				c.numArgs[i] -= 1
 			}
 		} else {
@@ -52,3 +115,21 @@ func (c *command) parse(line string) {
 		}
 	}
 }
+
+// splitFields splits line into at most n fields separated by runs
+// of whitespace. Leading and trailing whitespace is ignored,
+// the last field contains the rest of the line.
+// If n is zero or less, there is no limit of fields.
+func splitFields(line string, n int) []string {
+	line = strings.TrimSpace(line)
+	fields := make([]string, 0, max(n, 1))
+	for n <= 0 || len(fields) < n-1 {
+		i := strings.IndexFunc(line, unicode.IsSpace)
+		if i < 0 {
+			break
+		}
+		fields = append(fields, line[:i])
+		line = strings.TrimLeftFunc(line[i:], unicode.IsSpace)
+	}
+	return append(fields, line)
+}
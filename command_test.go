@@ -0,0 +1,146 @@
+package pop3srv
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommandParse(t *testing.T) {
+	type testCase struct {
+		name    string
+		line    string
+		cmd     string
+		args    []string
+		numArgs []int
+	}
+
+	for _, c := range []testCase{
+		{
+			name:    "no arguments",
+			line:    "quit",
+			cmd:     "QUIT",
+			args:    []string{},
+			numArgs: []int{},
+		},
+		{
+			name:    "single space",
+			line:    "RETR 1",
+			cmd:     "RETR",
+			args:    []string{"1"},
+			numArgs: []int{0},
+		},
+		{
+			name:    "multiple spaces",
+			line:    "RETR   1",
+			cmd:     "RETR",
+			args:    []string{"1"},
+			numArgs: []int{0},
+		},
+		{
+			name:    "tabs",
+			line:    "TOP\t2\t\t10",
+			cmd:     "TOP",
+			args:    []string{"2", "10"},
+			numArgs: []int{1, 10},
+		},
+		{
+			name:    "leading and trailing whitespace",
+			line:    "  LIST 3 \t ",
+			cmd:     "LIST",
+			args:    []string{"3"},
+			numArgs: []int{2},
+		},
+		{
+			name:    "user name with spaces",
+			line:    "USER bob smith",
+			cmd:     "USER",
+			args:    []string{"bob smith"},
+			numArgs: []int{-1},
+		},
+		{
+			name:    "password keeps inner whitespace",
+			line:    "PASS  my \t secret ",
+			cmd:     "PASS",
+			args:    []string{"my \t secret"},
+			numArgs: []int{-1},
+		},
+		{
+			name:    "all arguments split",
+			line:    "APOP  user   digest extra",
+			cmd:     "APOP",
+			args:    []string{"user", "digest", "extra"},
+			numArgs: []int{-1, -1, -1},
+		},
+		{
+			name:    "negative number",
+			line:    "TOP 1 -5",
+			cmd:     "TOP",
+			args:    []string{"1", "-5"},
+			numArgs: []int{0, -1},
+		},
+		{
+			name:    "message number zero",
+			line:    "LIST 0",
+			cmd:     "LIST",
+			args:    []string{"0"},
+			numArgs: []int{-1},
+		},
+		{
+			name:    "zero lines",
+			line:    "TOP 1 0",
+			cmd:     "TOP",
+			args:    []string{"1", "0"},
+			numArgs: []int{0, 0},
+		},
+		{
+			name:    "number overflow",
+			line:    "RETR 99999999999999999999",
+			cmd:     "RETR",
+			args:    []string{"99999999999999999999"},
+			numArgs: []int{math.MaxInt - 1},
+		},
+		{
+			name:    "empty line",
+			line:    "",
+			cmd:     "",
+			args:    []string{},
+			numArgs: []int{},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			var cmd command
+			cmd.parse(c.line)
+			assert.Equal(t, c.cmd, cmd.name)
+			assert.Equal(t, c.args, cmd.args)
+			assert.Equal(t, c.numArgs, cmd.numArgs)
+		})
+	}
+}
+
+func TestCommandValidArgs(t *testing.T) {
+	for _, c := range []struct {
+		line  string
+		valid bool
+	}{
+		{line: "USER bob smith", valid: true},
+		{line: "USER", valid: false},
+		{line: "PASS", valid: false},
+		{line: "APOP user digest", valid: true},
+		{line: "APOP user", valid: false},
+		{line: "APOP user digest extra", valid: false},
+		{line: "RETR 1", valid: true},
+		{line: "RETR 1 2", valid: false},
+		{line: "LIST", valid: true},
+		{line: "STAT 1", valid: false},
+		{line: "TOP 1", valid: false},
+		{line: "FOOBAR a b c d", valid: true},
+	} {
+		t.Run(c.line, func(t *testing.T) {
+			var cmd command
+			cmd.parse(c.line)
+			assert.Equal(t, c.valid, cmd.validArgs())
+		})
+	}
+}
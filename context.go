@@ -0,0 +1,30 @@
+package pop3srv
+
+import (
+	"context"
+	"crypto/tls"
+)
+
+type tlsStateKey struct{}
+
+// TLSConnectionStateFromContext returns TLS connection state of the session
+// if the context was passed by [Session] to the backend and the session
+// connection is encrypted.
+func TLSConnectionStateFromContext(ctx context.Context) (tls.ConnectionState, bool) {
+	state, ok := ctx.Value(tlsStateKey{}).(tls.ConnectionState)
+	return state, ok
+}
+
+// ServerNameFromContext returns server name requested by the client
+// with SNI during TLS handshake, if the context was passed by [Session]
+// to the backend and the session connection is encrypted.
+// It's empty if the client didn't use SNI.
+func ServerNameFromContext(ctx context.Context) string {
+	state, _ := TLSConnectionStateFromContext(ctx)
+	return state.ServerName
+}
+
+// contextWithTLSState returns copy of ctx which carries TLS connection state.
+func contextWithTLSState(ctx context.Context, state tls.ConnectionState) context.Context {
+	return context.WithValue(ctx, tlsStateKey{}, state)
+}
@@ -1,7 +1,6 @@
 package pop3srv
 
 import (
-	"errors"
 	"io"
 )
 
@@ -29,7 +28,7 @@ func (EmptyMailbox) ListOne(_ int) (int, error) {
 }
 
 func (EmptyMailbox) Message(_ int) (io.ReadCloser, error) {
-	return nil, errors.New("no such message")
+	return nil, ErrNoSuchMessage
 }
 
 func (EmptyMailbox) Dele(_ int) error {
@@ -41,7 +40,7 @@ func (EmptyMailbox) Uidl() ([]string, error) {
 }
 
 func (EmptyMailbox) UidlOne(_ int) (string, error) {
-	return "", errors.New("no such message")
+	return "", ErrNoSuchMessage
 }
 
 func (EmptyMailbox) Close() error {
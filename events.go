@@ -0,0 +1,55 @@
+package pop3srv
+
+type (
+	// SessionEvent is an event of session progress sent to the channel
+	// set with [NewSessionWithEvents] or [WithSessionEvents]. It's one of
+	// [AuthenticatedEvent], [CommandHandledEvent] and [ClosedEvent].
+	//
+	// Events are intended for synchronizing tests with sessions.
+	// They're sent without blocking, events are dropped if the channel
+	// isn't ready to receive, so use buffered channel.
+	SessionEvent interface {
+		sessionEvent()
+	}
+
+	// AuthenticatedEvent is sent when the session enters
+	// the TRANSACTION state.
+	AuthenticatedEvent struct {
+		User string
+	}
+
+	// CommandHandledEvent is sent after the response
+	// for the command was sent to the client.
+	CommandHandledEvent struct {
+		Name string
+	}
+
+	// ClosedEvent is sent when the session ends,
+	// Err is the error returned by [Session.ServeContext].
+	ClosedEvent struct {
+		Err error
+	}
+)
+
+func (AuthenticatedEvent) sessionEvent()  {}
+func (CommandHandledEvent) sessionEvent() {}
+func (ClosedEvent) sessionEvent()         {}
+
+// NewSessionWithEvents creates [Session] like [NewSession]
+// which sends its progress events to events channel.
+func NewSessionWithEvents(c Conn, mboxProvider MailboxProvider, authorizer Authorizer, events chan<- SessionEvent) *Session {
+	s := NewSession(c, mboxProvider, authorizer)
+	s.events = events
+	return s
+}
+
+// emit sends the event if the events channel is set and ready to receive.
+func (s *Session) emit(event SessionEvent) {
+	if s.events == nil {
+		return
+	}
+	select {
+	case s.events <- event:
+	default:
+	}
+}
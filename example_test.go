@@ -0,0 +1,81 @@
+package pop3srv_test
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/pkierski/pop3srv"
+)
+
+func ExampleServeStrings() {
+	provider := staticProvider{pop3srv.NewStaticMailbox([][]byte{
+		[]byte("Subject: hello\r\n\r\nHello, World!\r\n"),
+	})}
+	authorizer := pop3srv.DisableApop(pop3srv.AllowAllAuthorizer{})
+
+	responses, err := pop3srv.ServeStrings(provider, authorizer, []string{
+		"USER alice",
+		"PASS secret",
+		"STAT",
+		"RETR 1",
+		"QUIT",
+	})
+	if err != nil {
+		fmt.Println("error:", err)
+	}
+	for _, line := range responses {
+		fmt.Println(strings.TrimSpace(line))
+	}
+
+	// Output:
+	// +OK POP3 server ready
+	// +OK send PASS
+	// +OK logged in
+	// +OK 1 33
+	// +OK message body #1
+	// Subject: hello
+	//
+	// Hello, World!
+	// .
+	// +OK server signing off
+}
+
+func ExampleTranscriptConn() {
+	serverConn, clientConn := net.Pipe()
+	transcript := &strings.Builder{}
+	session := pop3srv.NewSession(pop3srv.NewTranscriptConn(serverConn, transcript),
+		pop3srv.EmptyMailboxProvider{}, pop3srv.DisableApop(pop3srv.AllowAllAuthorizer{}))
+	done := make(chan error)
+	go func() { done <- session.Serve() }()
+
+	client := bufio.NewReader(clientConn)
+	client.ReadString('\n') // Banner
+	fmt.Fprint(clientConn, "QUIT\r\n")
+	client.ReadString('\n')
+	<-done
+
+	for _, line := range strings.Split(transcript.String(), "\n") {
+		fmt.Println(strings.TrimSpace(line))
+	}
+
+	// Output:
+	// S->C (23 bytes)
+	// +OK POP3 server ready
+	//
+	// C->S (6 bytes)
+	// QUIT
+	//
+	// S->C (24 bytes)
+	// +OK server signing off
+}
+
+// staticProvider provides the same mailbox for every user.
+type staticProvider struct {
+	mailbox pop3srv.Mailbox
+}
+
+func (p staticProvider) Provide(_ string) (pop3srv.Mailbox, error) {
+	return p.mailbox, nil
+}
@@ -0,0 +1,68 @@
+package pop3srv
+
+import (
+	"log"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var _ Authorizer = (*HtpasswdAuthorizer)(nil)
+
+// dummyHash is compared against for unknown users, so response
+// time doesn't reveal whether the user exists.
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+	return hash
+})
+
+// HtpasswdAuthorizer is an [Authorizer] which authenticates USER/PASS
+// against "user:bcrypt-hash" entries loaded from a htpasswd-style file.
+//
+// APOP is not supported because it requires plaintext secret,
+// see [SecretFileAuthorizer] for that case.
+//
+// The file is reloaded automatically when it changes. It can be
+// also reloaded explicitly with [HtpasswdAuthorizer.Reload].
+type HtpasswdAuthorizer struct {
+	// Logger is used for errors of automatic reload, e.g. the server's
+	// [Server.Logger]. If nil, the standard logger of log package is used.
+	Logger *log.Logger
+
+	file *userFile
+}
+
+// NewHtpasswdAuthorizer creates [HtpasswdAuthorizer] and loads entries
+// from the file at path. Only bcrypt hashes are accepted.
+func NewHtpasswdAuthorizer(path string) (*HtpasswdAuthorizer, error) {
+	file, err := newUserFile(path, func(hash string) error {
+		_, err := bcrypt.Cost([]byte(hash))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &HtpasswdAuthorizer{file: file}, nil
+}
+
+// Reload reads the file again. On error previously loaded
+// entries are kept.
+func (a *HtpasswdAuthorizer) Reload() error {
+	return a.file.reload()
+}
+
+func (a *HtpasswdAuthorizer) UserPass(user, pass string) error {
+	hash, ok := a.file.lookup(user, a.Logger)
+	if !ok {
+		_ = bcrypt.CompareHashAndPassword(dummyHash(), []byte(pass))
+		return ErrAuthFailed
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) != nil {
+		return ErrAuthFailed
+	}
+	return nil
+}
+
+func (a *HtpasswdAuthorizer) Apop(user, timestampBanner, digest string) error {
+	return ErrNotSupportedAuthMethod
+}
@@ -0,0 +1,119 @@
+package pop3srv_test
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkierski/pop3srv"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func writeHtpasswd(t *testing.T, path string, entries map[string]string) {
+	t.Helper()
+	content := "# test htpasswd file\n\n"
+	for user, pass := range entries {
+		hash, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.MinCost)
+		require.NoError(t, err)
+		content += user + ":" + string(hash) + "\n"
+	}
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+}
+
+func TestHtpasswdAuthorizer(t *testing.T) {
+	// GIVEN
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	writeHtpasswd(t, path, map[string]string{"alice": "secret"})
+
+	// WHEN
+	authorizer, err := pop3srv.NewHtpasswdAuthorizer(path)
+
+	// THEN
+	require.NoError(t, err)
+	assert.NoError(t, authorizer.UserPass("alice", "secret"))
+	assert.ErrorIs(t, authorizer.UserPass("alice", "wrong"), pop3srv.ErrAuthFailed)
+	assert.ErrorIs(t, authorizer.UserPass("bob", "secret"), pop3srv.ErrAuthFailed)
+	assert.ErrorIs(t, authorizer.Apop("alice", "<1@host>", "digest"), pop3srv.ErrNotSupportedAuthMethod)
+}
+
+func TestHtpasswdAuthorizerReload(t *testing.T) {
+	// GIVEN
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	writeHtpasswd(t, path, map[string]string{"alice": "secret"})
+	authorizer, err := pop3srv.NewHtpasswdAuthorizer(path)
+	require.NoError(t, err)
+
+	// WHEN
+	writeHtpasswd(t, path, map[string]string{"bob": "password"})
+	require.NoError(t, authorizer.Reload())
+
+	// THEN
+	assert.NoError(t, authorizer.UserPass("bob", "password"))
+	assert.ErrorIs(t, authorizer.UserPass("alice", "secret"), pop3srv.ErrAuthFailed)
+}
+
+func TestHtpasswdAuthorizerReloadOnChange(t *testing.T) {
+	// GIVEN
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	writeHtpasswd(t, path, map[string]string{"alice": "secret"})
+	authorizer, err := pop3srv.NewHtpasswdAuthorizer(path)
+	require.NoError(t, err)
+
+	// WHEN
+	writeHtpasswd(t, path, map[string]string{"alice": "changed"})
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(path, future, future))
+
+	// THEN
+	assert.NoError(t, authorizer.UserPass("alice", "changed"))
+	assert.ErrorIs(t, authorizer.UserPass("alice", "secret"), pop3srv.ErrAuthFailed)
+}
+
+func TestHtpasswdAuthorizerReloadError(t *testing.T) {
+	// GIVEN
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	writeHtpasswd(t, path, map[string]string{"alice": "secret"})
+	authorizer, err := pop3srv.NewHtpasswdAuthorizer(path)
+	require.NoError(t, err)
+	logOutput := &strings.Builder{}
+	authorizer.Logger = log.New(logOutput, "", 0)
+
+	// WHEN
+	require.NoError(t, os.WriteFile(path, []byte("alice\n"), 0o600))
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(path, future, future))
+	err = authorizer.UserPass("alice", "secret")
+
+	// THEN
+	assert.NoError(t, err) // previous entries are used
+	assert.Contains(t, logOutput.String(), "Reloading "+path+" failed, using previous entries")
+}
+
+func TestHtpasswdAuthorizerInvalidFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{name: "missing separator", content: "alice\n"},
+		{name: "not bcrypt hash", content: "alice:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "htpasswd")
+			require.NoError(t, os.WriteFile(path, []byte(tt.content), 0o600))
+
+			_, err := pop3srv.NewHtpasswdAuthorizer(path)
+
+			assert.Error(t, err)
+		})
+	}
+
+	_, err := pop3srv.NewHtpasswdAuthorizer(filepath.Join(t.TempDir(), "nonexistent"))
+	assert.Error(t, err)
+}
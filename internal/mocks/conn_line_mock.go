@@ -15,6 +15,12 @@ type ConnMock struct {
 	LinesToRead []string
 	Closed      bool
 	Err         error
+
+	// WriteErr, if set, is returned by Write once WriteErrAfter
+	// bytes have been written.
+	WriteErr      error
+	WriteErrAfter int
+	written       int
 }
 
 func (m *ConnMock) Read(p []byte) (n int, err error) {
@@ -38,7 +44,14 @@ func (m *ConnMock) Read(p []byte) (n int, err error) {
 }
 
 func (m *ConnMock) Write(p []byte) (n int, err error) {
-	return m.w.Write(p)
+	if m.WriteErr != nil && m.written+len(p) > m.WriteErrAfter {
+		n, _ = m.w.Write(p[:max(m.WriteErrAfter-m.written, 0)])
+		m.written += n
+		return n, m.WriteErr
+	}
+	n, err = m.w.Write(p)
+	m.written += n
+	return
 }
 
 func (m *ConnMock) Close() error {
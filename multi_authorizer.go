@@ -0,0 +1,41 @@
+package pop3srv
+
+import "errors"
+
+var _ Authorizer = (MultiAuthorizer)(nil)
+
+// MultiAuthorizer is an [Authorizer] which chains multiple authorizers.
+//
+// Members are tried in order and the first successful authorization wins.
+// Members returning [ErrNotSupportedAuthMethod] are skipped. If none of the
+// members succeeds, the error returned by the last member supporting the
+// method is returned. [ErrNotSupportedAuthMethod] is returned only if none
+// of the members supports the method, so USER/PASS or APOP are disabled
+// for [Session] only when all members disable them.
+type MultiAuthorizer []Authorizer
+
+func (m MultiAuthorizer) UserPass(user, pass string) error {
+	return m.try(func(a Authorizer) error {
+		return a.UserPass(user, pass)
+	})
+}
+
+func (m MultiAuthorizer) Apop(user, timestampBanner, digest string) error {
+	return m.try(func(a Authorizer) error {
+		return a.Apop(user, timestampBanner, digest)
+	})
+}
+
+func (m MultiAuthorizer) try(auth func(a Authorizer) error) error {
+	err := ErrNotSupportedAuthMethod
+	for _, a := range m {
+		memberErr := auth(a)
+		if memberErr == nil {
+			return nil
+		}
+		if !errors.Is(memberErr, ErrNotSupportedAuthMethod) {
+			err = memberErr
+		}
+	}
+	return err
+}
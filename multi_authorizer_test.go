@@ -0,0 +1,86 @@
+package pop3srv_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/pkierski/pop3srv"
+	"github.com/stretchr/testify/assert"
+)
+
+type staticAuthorizer struct {
+	userPassErr error
+	apopErr     error
+}
+
+func (a staticAuthorizer) UserPass(user, pass string) error {
+	return a.userPassErr
+}
+
+func (a staticAuthorizer) Apop(user, timestampBanner, digest string) error {
+	return a.apopErr
+}
+
+func TestMultiAuthorizer(t *testing.T) {
+	errFirst := errors.New("first")
+	errSecond := errors.New("second")
+
+	tests := []struct {
+		name    string
+		members pop3srv.MultiAuthorizer
+		wantErr error
+	}{
+		{
+			name:    "no members",
+			members: nil,
+			wantErr: pop3srv.ErrNotSupportedAuthMethod,
+		},
+		{
+			name: "first succeeds",
+			members: pop3srv.MultiAuthorizer{
+				staticAuthorizer{},
+				staticAuthorizer{userPassErr: errSecond, apopErr: errSecond},
+			},
+			wantErr: nil,
+		},
+		{
+			name: "fallback succeeds",
+			members: pop3srv.MultiAuthorizer{
+				staticAuthorizer{userPassErr: errFirst, apopErr: errFirst},
+				staticAuthorizer{},
+			},
+			wantErr: nil,
+		},
+		{
+			name: "all fail returns last error",
+			members: pop3srv.MultiAuthorizer{
+				staticAuthorizer{userPassErr: errFirst, apopErr: errFirst},
+				staticAuthorizer{userPassErr: errSecond, apopErr: errSecond},
+			},
+			wantErr: errSecond,
+		},
+		{
+			name: "not supported member is skipped",
+			members: pop3srv.MultiAuthorizer{
+				staticAuthorizer{userPassErr: errFirst, apopErr: errFirst},
+				staticAuthorizer{userPassErr: pop3srv.ErrNotSupportedAuthMethod, apopErr: pop3srv.ErrNotSupportedAuthMethod},
+			},
+			wantErr: errFirst,
+		},
+		{
+			name: "all not supported",
+			members: pop3srv.MultiAuthorizer{
+				staticAuthorizer{userPassErr: pop3srv.ErrNotSupportedAuthMethod, apopErr: pop3srv.ErrNotSupportedAuthMethod},
+				pop3srv.DisableApop(pop3srv.DisableUserPass(pop3srv.AllowAllAuthorizer{})),
+			},
+			wantErr: pop3srv.ErrNotSupportedAuthMethod,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.ErrorIs(t, tt.members.UserPass("user", "pass"), tt.wantErr)
+			assert.ErrorIs(t, tt.members.Apop("user", "<1@host>", "digest"), tt.wantErr)
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package pop3srv
+
+import (
+	"crypto/tls"
+	"log"
+	"time"
+)
+
+// ServerOption configures [Server] created with [NewServerWithOptions].
+type ServerOption func(s *Server)
+
+// NewServerWithOptions creates [Server] like [NewServer]
+// and applies opts to it.
+func NewServerWithOptions(authorizer Authorizer, mboxProvider MailboxProvider, opts ...ServerOption) *Server {
+	s := NewServer(authorizer, mboxProvider)
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// WithConnectionsLimit sets [Server.ConnectionsLimit].
+func WithConnectionsLimit(n int) ServerOption {
+	return func(s *Server) {
+		s.ConnectionsLimit = n
+	}
+}
+
+// WithConnectionTimeout sets [Server.ConnectionTimeout].
+func WithConnectionTimeout(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.ConnectionTimeout = d
+	}
+}
+
+// WithTLS sets [Server.TLSConfig] used for STLS command.
+func WithTLS(cfg *tls.Config) ServerOption {
+	return func(s *Server) {
+		s.TLSConfig = cfg
+	}
+}
+
+// WithLogger sets [Server.Logger].
+func WithLogger(l *log.Logger) ServerOption {
+	return func(s *Server) {
+		s.Logger = l
+	}
+}
+
+// WithSessionEvents makes all sessions of the server send their progress
+// events to events channel, see [SessionEvent].
+func WithSessionEvents(events chan<- SessionEvent) ServerOption {
+	return func(s *Server) {
+		s.sessionEvents = events
+	}
+}
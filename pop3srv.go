@@ -1,8 +1,10 @@
 package pop3srv
 
 import (
+	"context"
 	"errors"
 	"io"
+	"iter"
 )
 
 type (
@@ -10,10 +12,24 @@ type (
 		io.ReadWriteCloser
 	}
 
+	// MailboxProvider provides the mailbox of authenticated user.
+	//
+	// If Provide returns error the client stays in the authorization
+	// state and gets [ErrNoSuchMailbox] response (or [ErrTemporaryFailure]
+	// if the error wraps it), the error itself is only logged.
 	MailboxProvider interface {
 		Provide(user string) (Mailbox, error)
 	}
 
+	// ContextMailboxProvider is an optional interface which can be
+	// implemented by [MailboxProvider] to get session's context, e.g.
+	// to scope user lookup by domain the client connected to (see
+	// [ServerNameFromContext]). If it's implemented, ProvideContext
+	// is called instead of Provide.
+	ContextMailboxProvider interface {
+		ProvideContext(ctx context.Context, user string) (Mailbox, error)
+	}
+
 	// Mailbox represents a backend interface for a single mailbox.
 	//
 	// All msgNumber arguments are 0-based indices.
@@ -25,9 +41,14 @@ type (
 		// Stat returns the total number of messages
 		// in the mailbox and the total size of all messages.
 		//
-		// This is used for the STAT command.
-		// numberOfMessages is also used for validation of arguments
+		// numberOfMessages is used for validation of arguments
 		// for commands required message number as argument.
+		//
+		// totalSize is used by the [Session] only if [Session.DisableSizesCache]
+		// is set, otherwise the size in STAT response is computed from cached
+		// [Mailbox.List] excluding messages marked as deleted. Backends which
+		// can't cheaply sum sizes of messages may return -1, then
+		// [Mailbox.List] is used for STAT even with the cache disabled.
 		Stat() (numberOfMessages int, totalSize int, err error)
 
 		// List returns the sizes of all messages in the mailbox.
@@ -38,7 +59,9 @@ type (
 		// ListOne returns the size of a specific message
 		// identified by msgNumber.
 		//
-		// This is used for the LIST command with a message number argument.
+		// This is used for the LIST command with a message number argument
+		// only if [Session.DisableSizesCache] is set, otherwise sizes
+		// returned by List at login are used.
 		ListOne(msgNumber int) (size int, err error)
 
 		// Message returns an io.ReadCloser to access
@@ -57,6 +80,10 @@ type (
 		// Uidl returns a list of unique identifiers for
 		// all messages in the mailbox.
 		//
+		// Unique identifiers must be unique within the mailbox and
+		// persistent between sessions (RFC 1939), so they shouldn't be
+		// derived from mutable fields. See [ContentUIDL].
+		//
 		// This is used for the UIDL command without parameters.
 		Uidl() (uidls []string, err error)
 
@@ -73,11 +100,100 @@ type (
 		io.Closer
 	}
 
+	// LockableMailbox is an optional interface which can be implemented
+	// by [Mailbox] stored on shared storage to get exclusive access
+	// to the maildrop for the session duration (e.g. with dotlock file),
+	// also across processes. It complements per-user lock of the [Server].
+	LockableMailbox interface {
+		Mailbox
+
+		// Lock is called right after the mailbox is provided.
+		// If it returns error the mailbox is closed (without Unlock call)
+		// and the client gets [ErrMailboxLocked] response.
+		Lock() error
+
+		// Unlock is called after Close at the end of the session.
+		Unlock() error
+	}
+
+	// RefreshableMailbox is an optional interface which can be implemented
+	// by [Mailbox] to let long-lived sessions see new messages. By default
+	// (RFC 1939) the maildrop is a snapshot taken at login.
+	RefreshableMailbox interface {
+		Mailbox
+
+		// Refresh updates the snapshot of the mailbox, it's called
+		// on NOOP command if no message is marked as deleted.
+		// Existing messages have to keep their numbers, so only new
+		// messages can be appended. Returned values are like for
+		// [Mailbox.Stat], totalSize isn't used.
+		Refresh() (numberOfMessages int, totalSize int, err error)
+	}
+
+	// QuotaMailbox is an optional interface which can be implemented
+	// by [Mailbox] to warn the user approaching the storage quota.
+	// If at least 90% of the quota is used, the response for successful
+	// login contains informational warning, e.g.
+	// "+OK logged in, over quota (2048 of 1024 octets used)".
+	QuotaMailbox interface {
+		Mailbox
+
+		// Quota returns size of the user's storage used and its limit.
+		// Value of maxOctets equal or less than zero means no limit.
+		Quota() (usedOctets, maxOctets int64, err error)
+	}
+
+	// SeqMailbox is an optional interface which can be implemented
+	// by [Mailbox] with many messages to stream LIST and UIDL responses
+	// without materializing all entries: every line is written as it's
+	// yielded. The number of messages in the first response line is
+	// taken from [Mailbox.Stat] at login.
+	//
+	// Iterators should yield exactly as many entries as Stat reported,
+	// extra entries are ignored. Iterators can't report errors, on backend
+	// failure they should stop yielding: if there are fewer entries,
+	// the response isn't terminated and the session ends with
+	// [ErrIncompleteListing], so the client doesn't take it as complete.
+	SeqMailbox interface {
+		Mailbox
+
+		// ListSeq yields message numbers (0-based as for ListOne) and sizes.
+		// It's used instead of [Mailbox.List] for the LIST command only
+		// if [Session.DisableSizesCache] is set, otherwise sizes returned
+		// by List at login are used.
+		ListSeq() iter.Seq2[int, int]
+
+		// UidlSeq yields message numbers (0-based as for UidlOne) and
+		// unique-ids. It's used instead of [Mailbox.Uidl] for the UIDL
+		// command without parameters.
+		UidlSeq() iter.Seq2[int, string]
+	}
+
+	// BatchDeleter is an optional interface which can be implemented
+	// by [Mailbox] to delete all messages marked as deleted at once
+	// (e.g. in single transaction) instead of calling Dele for every
+	// message, which can be slow for many messages.
+	BatchDeleter interface {
+		// DeleBatch deletes messages identified by msgNumbers (sorted,
+		// 0-based as for Dele). It's called in the UPDATE state before
+		// Close, instead of Dele calls.
+		//
+		// Returned error means that none of the messages were deleted.
+		DeleBatch(msgNumbers []int) error
+	}
+
 	// Authorizer is authorization interface
 	// as merge of [UserPassAuthorizer] and [ApopAuthorizer].
 	//
 	// Implementation can indicate lack of support particular
 	// authorization method by returning [ErrNotSupportedAuthMethod].
+	//
+	// Authorization failures can be signaled with (possibly wrapped)
+	// [ErrAuthFailed] (wrong credentials, counted towards
+	// [Session.MaxAuthAttempts]), [ErrAccountDisabled] or
+	// [ErrTemporaryFailure] (e.g. backend unavailable), the latter two
+	// aren't counted as failed attempts. Other errors are counted
+	// and sent to the client as they are.
 	// All methods are called with empty parameters on creating [Session].
 	Authorizer interface {
 		UserPassAuthorizer
@@ -124,6 +240,89 @@ type (
 		// challenge in welcome message, which indicates lack of support of APOP command.
 		Apop(user, timestampBanner, digest string) error
 	}
+
+	// AuthProvider is an optional interface which can be implemented
+	// by [Authorizer] to verify USER/PASS credentials and return
+	// the user's mailbox at once, so the backend isn't queried twice.
+	// If it's implemented, PASS command calls Authenticate instead of
+	// [UserPassAuthorizer.UserPass] and [MailboxProvider.Provide].
+	// Other authorization methods still use [MailboxProvider].
+	AuthProvider interface {
+		// Authenticate authenticates a user based on the provided username
+		// and password and returns the user's mailbox.
+		//
+		// Returns an error if authentication fails due to invalid
+		// credentials or the mailbox can't be opened.
+		Authenticate(user, pass string) (Mailbox, error)
+	}
+
+	// ContextAuthProvider is like [AuthProvider] but it gets session's
+	// context, see [ContextMailboxProvider]. It's preferred over
+	// [AuthProvider] if both are implemented.
+	ContextAuthProvider interface {
+		AuthenticateContext(ctx context.Context, user, pass string) (Mailbox, error)
+	}
+
+	// ExternalAuthorizer is an optional interface which can be implemented
+	// by [Authorizer] to support SASL EXTERNAL authentication (AUTH EXTERNAL
+	// command) based on verified client certificate presented during
+	// TLS handshake.
+	//
+	// AUTH EXTERNAL is available only on TLS connection with verified
+	// client certificate.
+	ExternalAuthorizer interface {
+		// External authorizes user on the ground of client certificate.
+		//
+		// The user is the authorization identity sent by the client or,
+		// if client didn't send any, common name of client certificate's subject.
+		// TLS connection state (with peer certificates) can be obtained
+		// from ctx with [TLSConnectionStateFromContext].
+		//
+		// Returns nil if authentication is successful.
+		External(ctx context.Context, user string) error
+	}
+
+	// OAuthAuthorizer is an optional interface which can be implemented
+	// by [Authorizer] to support SASL XOAUTH2 authentication (AUTH XOAUTH2
+	// command) used by OAuth-based mail clients.
+	OAuthAuthorizer interface {
+		// OAuth authorizes user with OAuth 2.0 bearer token.
+		//
+		// Returns nil if authentication is successful.
+		OAuth(user, token string) error
+	}
+
+	// RpopAuthorizer is an optional interface which can be implemented
+	// by [Authorizer] to support obsolete RPOP command (RFC 1081).
+	//
+	// SECURITY: RPOP doesn't verify any secret. The client sends USER
+	// with the mailbox name and then RPOP with its own (client side) user
+	// name, and the server is expected to trust it the way rlogin/rsh
+	// trusts hosts. Anyone who can connect to the server can claim any
+	// user name, so RPOP should be enabled (see [Session.EnableRpop])
+	// only on listeners reachable exclusively from trusted hosts.
+	RpopAuthorizer interface {
+		// Rpop authorizes user (the mailbox name sent with USER command)
+		// on the ground of remoteUser (the user name on the client host
+		// sent with RPOP command).
+		//
+		// Returns nil if authentication is successful.
+		Rpop(user, remoteUser string) error
+	}
+
+	// TrustedAuthorizer is an optional interface which can be implemented
+	// by [Authorizer] to support XLOGIN command, which logs in the user
+	// already authenticated by trusted relay (e.g. mail proxy).
+	//
+	// XLOGIN is available only for connections from [Session.TrustedNetworks].
+	TrustedAuthorizer interface {
+		// Trust authorizes user asserted by trusted relay,
+		// e.g. checks if the account exists and is active.
+		//
+		// Returns nil if the user can be logged in.
+		Trust(user string) error
+	}
+
 	apopDisabler struct {
 		UserPassAuthorizer
 	}
@@ -139,7 +338,36 @@ var (
 	ErrInvalidCommand         = errors.New("invalid command")
 	ErrInvalidArgument        = errors.New("invalid argument")
 	ErrMessageMarkedAsDeleted = errors.New("message marked as deleted")
+	ErrNoSuchMessage          = errors.New("no such message")
+	ErrMessagesNotRemoved     = errors.New("some deleted messages not removed")
 	ErrNotSupportedAuthMethod = errors.New("not suported authorization method")
+	ErrTooManyInvalidCommands = errors.New("too many invalid commands")
+	ErrTooManyAuthAttempts    = errors.New("too many authentication attempts")
+	ErrApopChallengeExpired   = errors.New("APOP challenge expired, reconnect")
+	ErrApopAfterStls          = errors.New("APOP not available after STLS")
+	ErrTLSNotAvailable        = errors.New("TLS not available")
+	ErrTLSRequired            = errors.New("[AUTH] command available only after STARTTLS")
+	ErrCommandNotSupported    = errors.New("command not supported")
+	ErrCommandNotPermitted    = errors.New("command not permitted in this state")
+	ErrMailboxLocked          = errors.New("[IN-USE] mailbox already locked")
+	ErrAuthenticationAborted  = errors.New("authentication aborted")
+	ErrAuthFailed             = errors.New("[AUTH] authentication failed")
+	ErrAccountDisabled        = errors.New("[AUTH] account disabled")
+	ErrTemporaryFailure       = errors.New("[SYS/TEMP] temporary failure, try again later")
+	ErrMessageNotSent         = errors.New("[SYS/TEMP] message can't be sent")
+	ErrNoSuchMailbox          = errors.New("[SYS/PERM] mailbox unavailable")
+	ErrIncompleteListing      = errors.New("mailbox listing incomplete")
+	ErrAuthTimeout            = errors.New("authentication timeout")
+	ErrCommandNotAvailable    = errors.New("command not available")
+	ErrKicked                 = errors.New("disconnected by administrator")
+	ErrInternal               = errors.New("internal server error")
+	ErrCommandDisabled        = errors.New("command disabled")
+	ErrHandlerTimeout         = errors.New("command processing timed out")
+	ErrTooManyMessages        = errors.New("too many messages to list")
+
+	// ErrConnectionLost wraps errors of writing to the connection,
+	// which usually means the client has disconnected.
+	ErrConnectionLost = errors.New("connection lost")
 )
 
 var (
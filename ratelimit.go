@@ -0,0 +1,73 @@
+package pop3srv
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// rateLimitedWriter writes to w at most bytesPerSecond on average.
+// Waiting is cancelled with ctx and stops (the rest is written without
+// limit) when interrupt is closed, so it doesn't delay server shutdown.
+// Writes are split into chunks of at most bytesPerSecond.
+type rateLimitedWriter struct {
+	w              io.Writer
+	ctx            context.Context
+	interrupt      <-chan struct{}
+	bytesPerSecond int64
+	start          time.Time
+	written        int64
+}
+
+func newRateLimitedWriter(ctx context.Context, w io.Writer, bytesPerSecond int64, interrupt <-chan struct{}) *rateLimitedWriter {
+	return &rateLimitedWriter{
+		w:              w,
+		ctx:            ctx,
+		interrupt:      interrupt,
+		bytesPerSecond: bytesPerSecond,
+		start:          time.Now(),
+	}
+}
+
+func (l *rateLimitedWriter) Write(p []byte) (int, error) {
+	total := 0
+	for len(p) > 0 {
+		chunk := p
+		if l.bytesPerSecond > 0 {
+			chunk = p[:min(int64(len(p)), l.bytesPerSecond)]
+		}
+		n, err := l.w.Write(chunk)
+		total += n
+		if err != nil {
+			return total, err
+		}
+		p = p[n:]
+		l.written += int64(n)
+		if err := l.wait(); err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// wait pauses until the average rate of written bytes drops to the limit.
+func (l *rateLimitedWriter) wait() error {
+	if l.bytesPerSecond <= 0 {
+		return nil
+	}
+	due := l.start.Add(time.Duration(float64(l.written) / float64(l.bytesPerSecond) * float64(time.Second)))
+	d := time.Until(due)
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-l.interrupt:
+		l.bytesPerSecond = 0 // no more limiting
+	case <-l.ctx.Done():
+		return l.ctx.Err()
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package pop3srv
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimitedWriter(t *testing.T) {
+	// GIVEN
+	out := &bytes.Buffer{}
+	w := newRateLimitedWriter(context.Background(), out, 1000, nil)
+
+	// WHEN
+	start := time.Now()
+	n, err := w.Write(make([]byte, 300))
+
+	// THEN
+	assert.NoError(t, err)
+	assert.Equal(t, 300, n)
+	assert.Equal(t, 300, out.Len())
+	assert.GreaterOrEqual(t, time.Since(start), 300*time.Millisecond)
+}
+
+func TestRateLimitedWriterCancelled(t *testing.T) {
+	// GIVEN
+	out := &bytes.Buffer{}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	w := newRateLimitedWriter(ctx, out, 10, nil)
+
+	// WHEN
+	start := time.Now()
+	n, err := w.Write(make([]byte, 1000))
+
+	// THEN
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, 10, n) // the first chunk
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestRateLimitedWriterInterrupted(t *testing.T) {
+	// GIVEN
+	out := &bytes.Buffer{}
+	interrupt := make(chan struct{})
+	w := newRateLimitedWriter(context.Background(), out, 10, interrupt)
+	time.AfterFunc(50*time.Millisecond, func() { close(interrupt) })
+
+	// WHEN
+	start := time.Now()
+	n, err := w.Write(make([]byte, 1000))
+
+	// THEN
+	assert.NoError(t, err)
+	assert.Equal(t, 1000, n) // the rest is written without limit
+	assert.Less(t, time.Since(start), time.Second)
+}
@@ -0,0 +1,75 @@
+package pop3srv
+
+import "sync"
+
+var _ Authorizer = (*ScriptedAuthorizer)(nil)
+
+// ScriptedAuthorizer is an [Authorizer] for testing custom flows (e.g.
+// lockout or throttling). It records every UserPass and Apop call and
+// returns scripted results in order of calls.
+//
+// Calls with empty user name (made by [Session] to check supported
+// authorization methods) aren't recorded and succeed.
+type ScriptedAuthorizer struct {
+	mu       sync.Mutex
+	results  []error
+	fallback error
+	calls    []AuthCall
+}
+
+// AuthCall is a call recorded by [ScriptedAuthorizer].
+type AuthCall struct {
+	// Method is "UserPass" or "Apop".
+	Method string
+	User   string
+	// Secret is the password for UserPass or the digest for Apop.
+	Secret string
+}
+
+// NewScriptedAuthorizer creates [ScriptedAuthorizer] returning results
+// for consecutive calls of UserPass and Apop (nil means successful
+// authorization). After results are exhausted calls fail with
+// [ErrAuthFailed], see [ScriptedAuthorizer.SetFallback].
+func NewScriptedAuthorizer(results ...error) *ScriptedAuthorizer {
+	return &ScriptedAuthorizer{
+		results:  results,
+		fallback: ErrAuthFailed,
+	}
+}
+
+// SetFallback sets the result returned after scripted results are exhausted.
+func (a *ScriptedAuthorizer) SetFallback(err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.fallback = err
+}
+
+// Calls returns recorded calls in order.
+func (a *ScriptedAuthorizer) Calls() []AuthCall {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]AuthCall(nil), a.calls...)
+}
+
+func (a *ScriptedAuthorizer) UserPass(user, pass string) error {
+	return a.call(AuthCall{Method: "UserPass", User: user, Secret: pass})
+}
+
+func (a *ScriptedAuthorizer) Apop(user, timestampBanner, digest string) error {
+	return a.call(AuthCall{Method: "Apop", User: user, Secret: digest})
+}
+
+func (a *ScriptedAuthorizer) call(c AuthCall) error {
+	if c.User == "" {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.calls = append(a.calls, c)
+	if len(a.results) == 0 {
+		return a.fallback
+	}
+	err := a.results[0]
+	a.results = a.results[1:]
+	return err
+}
@@ -0,0 +1,62 @@
+package pop3srv_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/pkierski/pop3srv"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScriptedAuthorizer(t *testing.T) {
+	// GIVEN
+	errWrong := errors.New("wrong password")
+	authorizer := pop3srv.NewScriptedAuthorizer(errWrong, nil)
+
+	// WHEN
+	probeUserPass := authorizer.UserPass("", "")
+	probeApop := authorizer.Apop("", "", "")
+	first := authorizer.UserPass("alice", "bad")
+	second := authorizer.Apop("alice", "<1.2@host>", "digest")
+	third := authorizer.UserPass("alice", "good")
+	authorizer.SetFallback(nil)
+	fourth := authorizer.UserPass("bob", "any")
+
+	// THEN
+	assert.NoError(t, probeUserPass)
+	assert.NoError(t, probeApop)
+	assert.ErrorIs(t, first, errWrong)
+	assert.NoError(t, second)
+	assert.ErrorIs(t, third, pop3srv.ErrAuthFailed)
+	assert.NoError(t, fourth)
+	assert.Equal(t, []pop3srv.AuthCall{
+		{Method: "UserPass", User: "alice", Secret: "bad"},
+		{Method: "Apop", User: "alice", Secret: "digest"},
+		{Method: "UserPass", User: "alice", Secret: "good"},
+		{Method: "UserPass", User: "bob", Secret: "any"},
+	}, authorizer.Calls())
+}
+
+func TestScriptedAuthorizerInSession(t *testing.T) {
+	// GIVEN
+	authorizer := pop3srv.NewScriptedAuthorizer(errors.New("wrong password"), errors.New("wrong password"), nil)
+
+	// WHEN
+	responses, err := pop3srv.ServeStrings(pop3srv.EmptyMailboxProvider{}, authorizer, []string{
+		"USER alice",
+		"PASS first",
+		"PASS second",
+		"PASS third",
+		"QUIT",
+	})
+
+	// THEN
+	require.NoError(t, err)
+	require.Len(t, responses, 6)
+	assert.True(t, strings.HasPrefix(responses[2], "-ERR"))
+	assert.True(t, strings.HasPrefix(responses[3], "-ERR"))
+	assert.True(t, strings.HasPrefix(responses[4], "+OK logged in"))
+	assert.Len(t, authorizer.Calls(), 3)
+}
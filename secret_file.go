@@ -0,0 +1,62 @@
+package pop3srv
+
+import (
+	"crypto/subtle"
+	"log"
+)
+
+var _ Authorizer = (*SecretFileAuthorizer)(nil)
+
+// SecretFileAuthorizer is an [Authorizer] which authenticates both
+// USER/PASS and APOP against "user:secret" entries loaded from a file.
+//
+// APOP requires the server to know the plaintext secret to compute
+// the digest, so secrets are stored in the file as they are.
+// Anyone who can read the file can impersonate any user, so the file
+// must be protected accordingly. If APOP isn't needed, prefer
+// [HtpasswdAuthorizer] which stores only bcrypt hashes.
+//
+// Each method can be disabled with [DisableApop] or [DisableUserPass],
+// e.g. DisableUserPass(a) accepts APOP only.
+//
+// The file is reloaded automatically when it changes. It can be
+// also reloaded explicitly with [SecretFileAuthorizer.Reload].
+type SecretFileAuthorizer struct {
+	// Logger is used for errors of automatic reload, e.g. the server's
+	// [Server.Logger]. If nil, the standard logger of log package is used.
+	Logger *log.Logger
+
+	file *userFile
+}
+
+// NewSecretFileAuthorizer creates [SecretFileAuthorizer] and loads
+// entries from the file at path.
+func NewSecretFileAuthorizer(path string) (*SecretFileAuthorizer, error) {
+	file, err := newUserFile(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &SecretFileAuthorizer{file: file}, nil
+}
+
+// Reload reads the file again. On error previously loaded
+// entries are kept.
+func (a *SecretFileAuthorizer) Reload() error {
+	return a.file.reload()
+}
+
+func (a *SecretFileAuthorizer) UserPass(user, pass string) error {
+	secret, ok := a.file.lookup(user, a.Logger)
+	if !ok || subtle.ConstantTimeCompare([]byte(secret), []byte(pass)) != 1 {
+		return ErrAuthFailed
+	}
+	return nil
+}
+
+func (a *SecretFileAuthorizer) Apop(user, timestampBanner, digest string) error {
+	secret, ok := a.file.lookup(user, a.Logger)
+	if !ok || !ApopVerify(timestampBanner, digest, secret) {
+		return ErrAuthFailed
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package pop3srv_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkierski/pop3srv"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSecretFileAuthorizer(t *testing.T) {
+	// GIVEN
+	path := filepath.Join(t.TempDir(), "secrets")
+	require.NoError(t, os.WriteFile(path, []byte("# secrets\nalice:tanstaaf\nbob:pass:with:colons\n"), 0o600))
+	const banner = "<1896.697170952@dbc.mtview.ca.us>"
+
+	// WHEN
+	authorizer, err := pop3srv.NewSecretFileAuthorizer(path)
+
+	// THEN
+	require.NoError(t, err)
+	assert.NoError(t, authorizer.Apop("alice", banner, "c4c9334bac560ecc979e58001b3e22fb"))
+	assert.NoError(t, authorizer.Apop("bob", banner, pop3srv.ApopDigest(banner, "pass:with:colons")))
+	assert.ErrorIs(t, authorizer.Apop("alice", banner, pop3srv.ApopDigest(banner, "wrong")), pop3srv.ErrAuthFailed)
+	assert.ErrorIs(t, authorizer.Apop("carol", banner, pop3srv.ApopDigest(banner, "")), pop3srv.ErrAuthFailed)
+
+	assert.NoError(t, authorizer.UserPass("alice", "tanstaaf"))
+	assert.NoError(t, authorizer.UserPass("bob", "pass:with:colons"))
+	assert.ErrorIs(t, authorizer.UserPass("alice", "tanstaa"), pop3srv.ErrAuthFailed)
+	assert.ErrorIs(t, authorizer.UserPass("carol", ""), pop3srv.ErrAuthFailed)
+}
+
+func TestSecretFileAuthorizerDisableMethods(t *testing.T) {
+	// GIVEN
+	path := filepath.Join(t.TempDir(), "secrets")
+	require.NoError(t, os.WriteFile(path, []byte("alice:secret\n"), 0o600))
+	authorizer, err := pop3srv.NewSecretFileAuthorizer(path)
+	require.NoError(t, err)
+	const banner = "<1@host>"
+
+	// WHEN
+	apopOnly := pop3srv.DisableUserPass(authorizer)
+	userPassOnly := pop3srv.DisableApop(authorizer)
+
+	// THEN
+	assert.NoError(t, apopOnly.Apop("alice", banner, pop3srv.ApopDigest(banner, "secret")))
+	assert.ErrorIs(t, apopOnly.UserPass("alice", "secret"), pop3srv.ErrNotSupportedAuthMethod)
+	assert.NoError(t, userPassOnly.UserPass("alice", "secret"))
+	assert.ErrorIs(t, userPassOnly.Apop("alice", banner, pop3srv.ApopDigest(banner, "secret")), pop3srv.ErrNotSupportedAuthMethod)
+}
@@ -0,0 +1,59 @@
+package pop3srv
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+)
+
+// ServeStrings runs [Session] with provider and authorizer fed
+// with commands (without line terminators) and returns response lines
+// (without line terminators, multi-line responses are included
+// line by line with the terminating ".").
+//
+// It's a harness for testing [MailboxProvider] and [Authorizer]
+// implementations end-to-end without network connection.
+// The session ends after QUIT command or after the last command.
+// The returned error is the error returned by [Session.Serve],
+// except [io.EOF] after the last command which isn't reported.
+func ServeStrings(provider MailboxProvider, authorizer Authorizer, commands []string) ([]string, error) {
+	var input strings.Builder
+	for _, cmd := range commands {
+		input.WriteString(cmd)
+		input.WriteString("\r\n")
+	}
+
+	conn := &stringsConn{r: strings.NewReader(input.String())}
+	session := NewSession(conn, provider, authorizer)
+	session.Verbose = false
+	err := session.Serve()
+	if errors.Is(err, io.EOF) {
+		err = nil
+	}
+
+	output := strings.TrimSuffix(conn.w.String(), "\r\n")
+	if output == "" {
+		return nil, err
+	}
+	return strings.Split(output, "\r\n"), err
+}
+
+// stringsConn is in-memory [Conn] reading from r
+// and collecting written data in w.
+type stringsConn struct {
+	r io.Reader
+	w bytes.Buffer
+}
+
+func (c *stringsConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *stringsConn) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+func (c *stringsConn) Close() error {
+	return nil
+}
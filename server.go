@@ -2,9 +2,12 @@ package pop3srv
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
+	"io"
 	"log"
 	"net"
+	"net/netip"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -15,27 +18,181 @@ const (
 )
 
 type (
+	// ServeConfig holds per-listener settings, see [Server.ServeWithConfig].
+	ServeConfig struct {
+		// TLSConfig is the TLS configuration for connections accepted
+		// on the listener. If nil, [Server.TLSConfig] is used.
+		TLSConfig *tls.Config
+
+		// ImplicitTLS makes every accepted connection TLS connection
+		// from the start (POP3S, usually port 995) instead of offering
+		// STLS command. It requires TLS configuration.
+		ImplicitTLS bool
+	}
+
 	// Server is a POP3 server instance.
 	Server struct {
 		// ConnectionsLimit defines maximum concurrent connections.
 		ConnectionsLimit int
 
+		// WaitForConnectionSlot stops accepting new connections while
+		// ConnectionsLimit is reached, until any session finishes.
+		// Pending connections wait in the listener's backlog.
+		//
+		// By default connections over the limit are accepted, get
+		// -ERR response with [ErrTooManyConnections] (except implicit
+		// TLS listeners) and are closed.
+		WaitForConnectionSlot bool
+
 		// ConnectionTimeout is the amount of time allowed to read
 		// client command.
 		//
 		// Value equal or less than zero means infinite timeout (default).
 		ConnectionTimeout time.Duration
 
-		authorizer   Authorizer
-		mboxProvider MailboxProvider
+		// AuthTimeout is the amount of time allowed to authenticate,
+		// see [Session.AuthTimeout].
+		AuthTimeout time.Duration
+
+		// HandlerTimeout is the amount of time allowed to execute
+		// a command, see [Session.HandlerTimeout].
+		HandlerTimeout time.Duration
+
+		// DisableSizesCache disables caching of message sizes
+		// in sessions, see [Session.DisableSizesCache].
+		DisableSizesCache bool
+
+		// TimestampBannerGenerator generates APOP timestamp banners
+		// for sessions, see [Session.TimestampBannerGenerator].
+		TimestampBannerGenerator func() string
+
+		// BannerHostname is the host name used in the default APOP
+		// timestamp banners, see [Session.BannerHostname].
+		BannerHostname string
+
+		// MaxInvalidCommands is the number of consecutive unknown commands
+		// after which the session is terminated, see [Session.MaxInvalidCommands].
+		MaxInvalidCommands int
+
+		// MaxListEntries is the maximum number of entries in LIST and UIDL
+		// responses, see [Session.MaxListEntries].
+		// [NewServer] sets it to [DefaultMaxListEntries].
+		MaxListEntries int
+
+		// InvalidCommandPolicy defines when invalid commands terminate
+		// the session, see [Session.InvalidCommandPolicy].
+		InvalidCommandPolicy InvalidCommandPolicy
+
+		// MaxAuthAttempts is the number of failed authentication attempts
+		// after which the session is terminated, see [Session.MaxAuthAttempts].
+		MaxAuthAttempts int
+
+		// AuthFailDelay is the delay before response for failed authentication
+		// attempt, see [Session.AuthFailDelay].
+		AuthFailDelay time.Duration
+
+		// GreetingDelay is the delay before the greeting,
+		// see [Session.GreetingDelay].
+		GreetingDelay time.Duration
+
+		// UsernameNormalizer is applied to user names sent by clients,
+		// see [Session.UsernameNormalizer].
+		UsernameNormalizer func(user string) string
+
+		// InvalidateBannerOnApopFailure makes the APOP timestamp banner single use,
+		// see [Session.InvalidateBannerOnApopFailure].
+		InvalidateBannerOnApopFailure bool
+
+		// TLSConfig is the TLS configuration used for STLS command,
+		// see [Session.TLSConfig]. It's used as provided, so it controls
+		// TLS versions and cipher suites, see [DefaultTLSConfig].
+		// It has to provide server certificate.
+		TLSConfig *tls.Config
+
+		// RequireTLS disables authentication until the connection
+		// is encrypted, see [Session.RequireTLS].
+		RequireTLS bool
+
+		// EnableRpop enables obsolete RPOP command,
+		// see [Session.EnableRpop] and [RpopAuthorizer].
+		EnableRpop bool
+
+		// TrustedNetworks lists networks of trusted relays allowed
+		// to use XLOGIN command, see [Session.TrustedNetworks].
+		TrustedNetworks []netip.Prefix
+
+		// Verbose enables logging of protocol lines in sessions,
+		// see [Session.Verbose]. [NewServer] sets it to true.
+		// Without it new connections aren't logged (session summary
+		// is still logged) and connections closed by the client before
+		// sending anything, like health checks, aren't logged at all.
+		Verbose bool
+
+		// RetrSizeInResponse makes RETR response contain size of the message,
+		// see [Session.RetrSizeInResponse].
+		RetrSizeInResponse bool
+
+		// MaxBytesPerSecond limits the rate of sending messages by sessions,
+		// see [Session.MaxBytesPerSecond].
+		MaxBytesPerSecond int64
+
+		// Implementation is sent as IMPLEMENTATION capability,
+		// see [Session.Implementation]. [NewServer] sets it
+		// to [DefaultImplementation].
+		Implementation string
+
+		// NoopResponse is the text of response to NOOP command,
+		// see [Session.NoopResponse]. [NewServer] sets it
+		// to [DefaultNoopResponse].
+		NoopResponse string
+
+		// DisabledCommands lists commands rejected by sessions,
+		// see [Session.DisabledCommands].
+		DisabledCommands []string
+
+		// CloseLinger is the maximum time to wait for the client to close
+		// the connection after the last response, see [Session.CloseLinger].
+		CloseLinger time.Duration
+
+		// ReadBufferSize is size of buffer for reading client's commands,
+		// see [Session.ReadBufferSize].
+		ReadBufferSize int
+
+		// ConnectionGate, if set, is called for every accepted connection
+		// before the session is created. If it returns error, the client
+		// gets -ERR response with [ErrAccessDenied] (not on implicit TLS
+		// listeners, see [ServeConfig.ImplicitTLS]) and the connection
+		// is closed. It can implement IP allowlists, reverse DNS checks etc.
+		//
+		// It's called in the accept loop, so slow checks (like DNS lookups)
+		// delay accepting other connections on the listener.
+		ConnectionGate func(remote net.Addr) error
+
+		// Logger is used for server's and sessions' log messages.
+		// If nil, the standard logger of log package is used.
+		Logger *log.Logger
+
+		authorizer    Authorizer
+		mboxProvider  MailboxProvider
+		sessionEvents chan<- SessionEvent
+		// customCommands are registered with HandleCommand,
+		// shared by all sessions
+		customCommands map[SessionState]handlersMap
 
 		inShutdown     atomic.Bool
+		shutdownCh     chan struct{}
+		sessionsCtx    context.Context
+		cancelSessions context.CancelFunc
 		listeners      map[*net.Listener]struct{}
 		listenersMu    sync.Mutex
 		listenersGroup sync.WaitGroup
 		sessions       map[*Session]struct{}
+		lockedUsers    map[string]struct{}
 		sessionsMu     sync.Mutex
 		sessionsDone   chan struct{}
+		// slotFreed is closed (and cleared) when any session finishes,
+		// it wakes up all listeners waiting for free connection slot
+		slotFreed chan struct{}
 	}
 )
 
@@ -45,16 +202,33 @@ var (
 	ErrServerClosed = errors.New("server closed")
 
 	ErrTooManyConnections = errors.New("too many connections")
+
+	// ErrAccessDenied is sent to clients rejected by [Server.ConnectionGate].
+	ErrAccessDenied = errors.New("access denied")
+
+	// ErrTLSNoCertificates is returned by [Server.ServeWithConfig]
+	// if TLS configuration can't provide server certificate.
+	ErrTLSNoCertificates = errors.New("TLS config has no certificates")
 )
 
 func NewServer(authorizer Authorizer, mboxProvider MailboxProvider) *Server {
+	sessionsCtx, cancelSessions := context.WithCancel(context.Background())
 	return &Server{
-		ConnectionsLimit: DefaultConnectionsLimit,
-		authorizer:       authorizer,
-		mboxProvider:     mboxProvider,
-		listeners:        make(map[*net.Listener]struct{}),
-		sessions:         make(map[*Session]struct{}),
-		sessionsDone:     make(chan struct{}),
+		ConnectionsLimit:   DefaultConnectionsLimit,
+		MaxInvalidCommands: DefaultMaxInvalidCommands,
+		MaxListEntries:     DefaultMaxListEntries,
+		Verbose:            true,
+		Implementation:     DefaultImplementation,
+		NoopResponse:       DefaultNoopResponse,
+		authorizer:         authorizer,
+		mboxProvider:       mboxProvider,
+		listeners:          make(map[*net.Listener]struct{}),
+		sessions:           make(map[*Session]struct{}),
+		lockedUsers:        make(map[string]struct{}),
+		sessionsDone:       make(chan struct{}),
+		shutdownCh:         make(chan struct{}),
+		sessionsCtx:        sessionsCtx,
+		cancelSessions:     cancelSessions,
 	}
 }
 
@@ -62,8 +236,34 @@ func NewServer(authorizer Authorizer, mboxProvider MailboxProvider) *Server {
 //
 // Serve always returns a non-nil error and closes l.
 // After [Server.Shutdown] or [Server.Close], the returned error
-// is [ErrServerClosed].
+// is [ErrServerClosed]. Temporary accept errors (e.g. running out
+// of file descriptors) are logged and accepting is retried with
+// exponential backoff, other accept errors are returned.
 func (s *Server) Serve(l net.Listener) error {
+	return s.ServeWithConfig(l, ServeConfig{})
+}
+
+// ServeWithConfig is like [Server.Serve] but connections accepted
+// on the Listener l use settings from cfg, so one [Server] can serve
+// e.g. plaintext connections with STLS and implicit TLS connections
+// on different listeners. Sessions from all listeners are tracked
+// together for [Server.Shutdown] and [Server.Close].
+//
+// It returns [ErrTLSNoCertificates] if TLS configuration
+// doesn't provide server certificate.
+func (s *Server) ServeWithConfig(l net.Listener, cfg ServeConfig) error {
+	if cfg.TLSConfig == nil {
+		cfg.TLSConfig = s.TLSConfig
+	}
+	if cfg.ImplicitTLS && cfg.TLSConfig == nil {
+		l.Close()
+		return ErrTLSNotAvailable
+	}
+	if cfg.TLSConfig != nil && !hasCertificates(cfg.TLSConfig) {
+		l.Close()
+		return ErrTLSNoCertificates
+	}
+
 	l = &onceCloseListener{Listener: l}
 	defer l.Close()
 
@@ -73,49 +273,147 @@ func (s *Server) Serve(l net.Listener) error {
 	}
 	defer s.removeListener(&l)
 
+	var tempDelay time.Duration // how long to sleep on accept failure
 	for {
+		if s.WaitForConnectionSlot && !s.waitForSlot() {
+			return ErrServerClosed
+		}
 		conn, err := l.Accept()
 		if s.shuttingDown() {
 			return ErrServerClosed
 		}
 		if err != nil {
-			return err
+			if !isTemporary(err) {
+				return err
+			}
+			tempDelay = acceptBackoff(tempDelay)
+			s.logf("Accept error: %v; retrying in %v", err, tempDelay)
+			select {
+			case <-time.After(tempDelay):
+			case <-s.shutdownCh:
+				return ErrServerClosed
+			}
+			continue
+		}
+		tempDelay = 0
+		if s.Verbose {
+			s.logf("New connection from: %v on: %v", remoteAddr(conn), conn.LocalAddr())
+		}
+		if s.ConnectionGate != nil {
+			if err := s.ConnectionGate(conn.RemoteAddr()); err != nil {
+				s.rejectConnection(conn, cfg, ErrAccessDenied, err)
+				continue
+			}
+		}
+		rawConn := conn
+		if cfg.ImplicitTLS {
+			// handshake is done on the first write (greetings) in session's goroutine
+			conn = tls.Server(conn, cfg.TLSConfig)
 		}
-		log.Printf("New connection from: %v on: %v", conn.RemoteAddr(), conn.LocalAddr())
-		session := NewSession(conn, s.mboxProvider, s.authorizer)
-		session.ConnectionTimeout = s.ConnectionTimeout
+		session := s.newSession(conn, cfg)
 
-		if s.addSession(session) != nil {
-			session.writeResponseLine("", err)
+		if !s.addSession(session) {
+			s.rejectConnection(rawConn, cfg, ErrTooManyConnections, ErrTooManyConnections)
 			continue
 		}
 
 		go func() {
-			session.Serve()
+			if err := session.ServeContext(s.sessionsCtx); err != nil && !isDisconnect(err) {
+				s.logf("Session from: %v on: %v failed: %v", remoteAddr(conn), conn.LocalAddr(), err)
+			}
+			conn.Close()
 			s.deleteSession(session)
 			// set singnal if we in shutting down state and the last session is finished
 			if s.inShutdown.Load() && !s.hasActiveSessions() {
 				close(s.sessionsDone)
 			}
-			log.Printf("Connection from: %v on: %v closed", conn.RemoteAddr(), conn.LocalAddr())
+			if s.Verbose || !session.isProbe() {
+				s.logf("Connection from: %v on: %v closed", remoteAddr(conn), conn.LocalAddr())
+			}
 		}()
 	}
 }
 
+// rejectConnection closes the connection rejected by ConnectionGate
+// or over ConnectionsLimit, right away without CloseLinger.
+// Plaintext connection gets -ERR response first, on implicit TLS
+// connection it would require handshake in the accept loop.
+func (s *Server) rejectConnection(conn net.Conn, cfg ServeConfig, response, reason error) {
+	s.logf("Connection from: %v on: %v rejected: %v", remoteAddr(conn), conn.LocalAddr(), reason)
+	if !cfg.ImplicitTLS {
+		io.WriteString(conn, statusLine("", response))
+	}
+	conn.Close()
+}
+
+// HandleCommand registers custom command handled by all sessions
+// in the state, see [Session.HandleCommand]. It must be called
+// before [Server.Serve].
+func (s *Server) HandleCommand(state SessionState, name string, handler CommandHandler) {
+	s.customCommands = addCommand(s.customCommands, state, name, handler)
+}
+
+// newSession creates [Session] for the connection with settings
+// copied from the server and cfg.
+func (s *Server) newSession(conn net.Conn, cfg ServeConfig) *Session {
+	session := NewSession(conn, s.mboxProvider, s.authorizer)
+	session.ConnectionTimeout = s.ConnectionTimeout
+	session.AuthTimeout = s.AuthTimeout
+	session.HandlerTimeout = s.HandlerTimeout
+	session.DisableSizesCache = s.DisableSizesCache
+	session.TimestampBannerGenerator = s.TimestampBannerGenerator
+	session.BannerHostname = s.BannerHostname
+	session.MaxInvalidCommands = s.MaxInvalidCommands
+	session.MaxListEntries = s.MaxListEntries
+	session.InvalidCommandPolicy = s.InvalidCommandPolicy
+	session.MaxAuthAttempts = s.MaxAuthAttempts
+	session.AuthFailDelay = s.AuthFailDelay
+	session.GreetingDelay = s.GreetingDelay
+	session.UsernameNormalizer = s.UsernameNormalizer
+	session.InvalidateBannerOnApopFailure = s.InvalidateBannerOnApopFailure
+	session.TLSConfig = cfg.TLSConfig
+	session.RequireTLS = s.RequireTLS
+	session.EnableRpop = s.EnableRpop
+	session.TrustedNetworks = s.TrustedNetworks
+	session.Verbose = s.Verbose
+	session.RetrSizeInResponse = s.RetrSizeInResponse
+	session.MaxBytesPerSecond = s.MaxBytesPerSecond
+	session.Implementation = s.Implementation
+	session.NoopResponse = s.NoopResponse
+	session.ReadBufferSize = s.ReadBufferSize
+	session.CloseLinger = s.CloseLinger
+	session.DisabledCommands = s.DisabledCommands
+	session.customCommands = s.customCommands
+	session.events = s.sessionEvents
+	session.Logger = s.Logger
+	session.interrupt = s.shutdownCh
+	session.lockUser = s.lockUser
+	session.unlockUser = s.unlockUser
+	return session
+}
+
+// Listen listens on the TCP network address addr. If addr is blank,
+// ":pop3" is used. The returned listener reports the bound address,
+// so it's useful with OS-chosen port (e.g. "127.0.0.1:0"), and should
+// be passed to [Server.Serve] or [Server.ServeWithConfig].
+func (s *Server) Listen(addr string) (net.Listener, error) {
+	if addr == "" {
+		addr = ":pop3"
+	}
+	return net.Listen("tcp", addr)
+}
+
 // ListenAndServe listens on the TCP network address addr and then
 // calls Serve to handle requests on incoming connections.
 //
-// If srv.Addr is blank, ":pop3" is used.
+// If addr is blank, ":pop3" is used. Use [Server.Listen] and
+// [Server.Serve] if the bound address is needed.
 //
 // Serve always returns a non-nil error and closes l.
 // After [Server.Shutdown] or [Server.Close], the returned error
 // is [ErrServerClosed].
 func (s *Server) ListenAndServe(addr string) error {
-	if addr == "" {
-		addr = ":pop3"
-	}
-
-	ln, err := net.Listen("tcp", addr)
+	ln, err := s.Listen(addr)
 	if err != nil {
 		return err
 	}
@@ -140,6 +438,7 @@ func (s *Server) Shutdown(ctx context.Context) error {
 	if !s.inShutdown.CompareAndSwap(false, true) {
 		return ErrServerClosed
 	}
+	close(s.shutdownCh)
 
 	s.listenersMu.Lock()
 	lnerr := s.closeListenersLocked()
@@ -173,6 +472,7 @@ func (s *Server) Close() error {
 	if !s.inShutdown.CompareAndSwap(false, true) {
 		return ErrServerClosed
 	}
+	close(s.shutdownCh)
 
 	s.listenersMu.Lock()
 	lnerr := s.closeListenersLocked()
@@ -184,33 +484,152 @@ func (s *Server) Close() error {
 	return lnerr
 }
 
+// forceCloseAllSessions cancels context of all active sessions
+// which closes their connections.
 func (s *Server) forceCloseAllSessions() {
-	s.sessionsMu.Lock()
-	defer s.sessionsMu.Unlock()
-	for session := range s.sessions {
-		session.conn.Close()
+	s.cancelSessions()
+}
+
+func (s *Server) logf(format string, v ...any) {
+	loggerOrDefault(s.Logger).Printf(format, v...)
+}
+
+// loggerOrDefault returns l or the standard logger if l is nil.
+func loggerOrDefault(l *log.Logger) *log.Logger {
+	if l == nil {
+		return log.Default()
 	}
+	return l
+}
+
+// isDisconnect checks if the session error is a result of the client
+// disconnecting or the session being closed by the server,
+// which are expected ways of ending the session.
+func isDisconnect(err error) bool {
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, ErrConnectionLost) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, context.Canceled) ||
+		errors.Is(err, ErrKicked) ||
+		errors.Is(err, ErrAuthTimeout)
 }
 
 func (s *Server) shuttingDown() bool {
 	return s.inShutdown.Load()
 }
 
-func (s *Server) addSession(session *Session) error {
+// addSession registers the session as active. It returns false
+// if ConnectionsLimit is reached.
+func (s *Server) addSession(session *Session) bool {
 	s.sessionsMu.Lock()
 	defer s.sessionsMu.Unlock()
 	if len(s.sessions) >= s.ConnectionsLimit {
-		return ErrTooManyConnections
+		return false
 	}
 
 	s.sessions[session] = struct{}{}
-	return nil
+	return true
 }
 
 func (s *Server) deleteSession(session *Session) {
 	s.sessionsMu.Lock()
 	defer s.sessionsMu.Unlock()
 	delete(s.sessions, session)
+	if s.slotFreed != nil {
+		close(s.slotFreed)
+		s.slotFreed = nil
+	}
+}
+
+// waitForSlot blocks until number of sessions is below ConnectionsLimit.
+// It returns false if the server is shutting down.
+func (s *Server) waitForSlot() bool {
+	for {
+		s.sessionsMu.Lock()
+		if len(s.sessions) < s.ConnectionsLimit {
+			s.sessionsMu.Unlock()
+			return true
+		}
+		if s.slotFreed == nil {
+			s.slotFreed = make(chan struct{})
+		}
+		slotFreed := s.slotFreed
+		s.sessionsMu.Unlock()
+
+		select {
+		case <-slotFreed:
+		case <-s.shutdownCh:
+			return false
+		}
+	}
+}
+
+// lockUser marks user's mailbox as used by a session, so only one
+// session at a time can access it (RFC 1939). It returns false
+// if the mailbox is already locked.
+func (s *Server) lockUser(user string) bool {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	if _, locked := s.lockedUsers[user]; locked {
+		return false
+	}
+	s.lockedUsers[user] = struct{}{}
+	return true
+}
+
+func (s *Server) unlockUser(user string) {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	delete(s.lockedUsers, user)
+}
+
+// Kick disconnects all active sessions of the user (including sessions
+// where the user name was sent but not authenticated yet). Idle clients
+// receive -ERR response with [ErrKicked] before the connection is closed,
+// clients in the middle of command are disconnected without waiting
+// for the command. Messages marked as deleted aren't deleted.
+// It returns number of disconnected sessions.
+func (s *Server) Kick(user string) int {
+	var matching []*Session
+	s.sessionsMu.Lock()
+	for session := range s.sessions {
+		if session.Info().User == user {
+			matching = append(matching, session)
+		}
+	}
+	s.sessionsMu.Unlock()
+
+	// sessions are kicked without sessionsMu held,
+	// session can wait for it while handling command (lockUser)
+	kicked := 0
+	for _, session := range matching {
+		if session.kick(ErrKicked) {
+			kicked++
+		}
+	}
+	s.logf("Kicked %d session(s) of user %q", kicked, user)
+	return kicked
+}
+
+// Broadcast announces msg to all active sessions, see [Session.Announce].
+func (s *Server) Broadcast(msg string) {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	for session := range s.sessions {
+		session.Announce(msg)
+	}
+	s.logf("Broadcast to %d session(s): %s", len(s.sessions), msg)
+}
+
+// Sessions returns snapshots of all active sessions.
+func (s *Server) Sessions() []SessionInfo {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	infos := make([]SessionInfo, 0, len(s.sessions))
+	for session := range s.sessions {
+		infos = append(infos, session.Info())
+	}
+	return infos
 }
 
 func (s *Server) hasActiveSessions() bool {
@@ -261,3 +680,20 @@ func (s *Server) removeListener(ln *net.Listener) {
 	delete(s.listeners, ln)
 	s.listenersGroup.Done()
 }
+
+// isTemporary reports whether accept error err is transient
+// and accepting connections should be retried.
+func isTemporary(err error) bool {
+	var ne interface{ Temporary() bool }
+	return errors.As(err, &ne) && ne.Temporary()
+}
+
+// acceptBackoff returns next delay after accept failure, starting
+// from 5ms and doubling up to 1s, the same as [net/http.Server] does.
+func acceptBackoff(delay time.Duration) time.Duration {
+	const maxDelay = time.Second
+	if delay == 0 {
+		return 5 * time.Millisecond
+	}
+	return min(2*delay, maxDelay)
+}
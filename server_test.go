@@ -0,0 +1,609 @@
+package pop3srv_test
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkierski/pop3srv"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startTestServer starts server on random local port,
+// the server is closed when the test ends.
+func startTestServer(t *testing.T, server *pop3srv.Server) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+	return listener.Addr().String()
+}
+
+// dialTestServer connects to the server and reads the greeting.
+func dialTestServer(t *testing.T, addr string) *textproto.Conn {
+	t.Helper()
+	client, err := textproto.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+	_, err = client.ReadLine() // Banner
+	require.NoError(t, err)
+	return client
+}
+
+func sendCommand(t *testing.T, client *textproto.Conn, line string) string {
+	t.Helper()
+	require.NoError(t, client.PrintfLine("%s", line))
+	response, err := client.ReadLine()
+	require.NoError(t, err)
+	return response
+}
+
+func TestServerListen(t *testing.T) {
+	// GIVEN
+	server := pop3srv.NewServerWithOptions(pop3srv.AllowAllAuthorizer{}, pop3srv.EmptyMailboxProvider{},
+		pop3srv.WithLogger(log.New(io.Discard, "", 0)),
+	)
+	listener, err := server.Listen("127.0.0.1:0")
+	require.NoError(t, err)
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+
+	// WHEN
+	client := dialTestServer(t, listener.Addr().String())
+	response := sendCommand(t, client, "QUIT")
+
+	// THEN
+	assert.NotEqual(t, 0, listener.Addr().(*net.TCPAddr).Port)
+	assert.Equal(t, "+OK server signing off", response)
+}
+
+func TestServerSingleSessionPerUser(t *testing.T) {
+	// GIVEN
+	server := pop3srv.NewServer(pop3srv.AllowAllAuthorizer{}, pop3srv.EmptyMailboxProvider{})
+	addr := startTestServer(t, server)
+	first := dialTestServer(t, addr)
+	second := dialTestServer(t, addr)
+
+	// WHEN
+	sendCommand(t, first, "USER testuser")
+	firstPass := sendCommand(t, first, "PASS testpass")
+	sendCommand(t, second, "USER testuser")
+	secondPass := sendCommand(t, second, "PASS testpass")
+	sendCommand(t, second, "USER otheruser")
+	otherPass := sendCommand(t, second, "PASS testpass")
+	sendCommand(t, first, "QUIT")
+	third := dialTestServer(t, addr)
+	sendCommand(t, third, "USER testuser")
+	thirdPass := sendCommand(t, third, "PASS testpass")
+
+	// THEN
+	assert.Equal(t, "+OK logged in", firstPass)
+	assert.Equal(t, "-ERR [IN-USE] mailbox already locked", secondPass)
+	assert.Equal(t, "+OK logged in", otherPass)
+	assert.True(t, strings.HasPrefix(thirdPass, "+OK"), thirdPass)
+}
+
+// syncBuffer is a strings.Builder safe for concurrent use.
+type syncBuffer struct {
+	mu sync.Mutex
+	sb strings.Builder
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.sb.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.sb.String()
+}
+
+func TestNewServerWithOptions(t *testing.T) {
+	// GIVEN
+	tlsConfig := &tls.Config{}
+	logger := log.New(&syncBuffer{}, "", 0)
+
+	// WHEN
+	server := pop3srv.NewServerWithOptions(pop3srv.AllowAllAuthorizer{}, pop3srv.EmptyMailboxProvider{},
+		pop3srv.WithConnectionsLimit(5),
+		pop3srv.WithConnectionTimeout(time.Minute),
+		pop3srv.WithTLS(tlsConfig),
+		pop3srv.WithLogger(logger),
+	)
+
+	// THEN
+	assert.Equal(t, 5, server.ConnectionsLimit)
+	assert.Equal(t, time.Minute, server.ConnectionTimeout)
+	assert.Same(t, tlsConfig, server.TLSConfig)
+	assert.Same(t, logger, server.Logger)
+	assert.Equal(t, pop3srv.DefaultMaxInvalidCommands, server.MaxInvalidCommands) // defaults are kept
+}
+
+func TestServerLogger(t *testing.T) {
+	// GIVEN
+	logOutput := &syncBuffer{}
+	server := pop3srv.NewServerWithOptions(pop3srv.AllowAllAuthorizer{}, pop3srv.EmptyMailboxProvider{},
+		pop3srv.WithLogger(log.New(logOutput, "", 0)),
+	)
+	addr := startTestServer(t, server)
+
+	// WHEN
+	client := dialTestServer(t, addr)
+	sendCommand(t, client, "NOOP")
+
+	// THEN
+	assert.Contains(t, logOutput.String(), "New connection from:")
+	assert.Contains(t, logOutput.String(), "C->S: NOOP")
+}
+
+func TestServerSessions(t *testing.T) {
+	// GIVEN
+	server := pop3srv.NewServer(pop3srv.AllowAllAuthorizer{}, pop3srv.EmptyMailboxProvider{})
+	addr := startTestServer(t, server)
+	first := dialTestServer(t, addr)
+	_ = dialTestServer(t, addr)
+	sendCommand(t, first, "USER testuser")
+	sendCommand(t, first, "PASS testpass")
+
+	// WHEN
+	sessions := server.Sessions()
+
+	// THEN
+	require.Len(t, sessions, 2)
+	var loggedIn, notLoggedIn pop3srv.SessionInfo
+	for _, info := range sessions {
+		if info.User == "testuser" {
+			loggedIn = info
+		} else {
+			notLoggedIn = info
+		}
+	}
+	assert.Equal(t, pop3srv.TransactionState, loggedIn.State)
+	assert.Equal(t, "TRANSACTION", loggedIn.State.String())
+	assert.True(t, strings.HasPrefix(loggedIn.RemoteAddr, "127.0.0.1:"), loggedIn.RemoteAddr)
+	assert.Positive(t, loggedIn.BytesIn)
+	assert.Positive(t, loggedIn.BytesOut)
+	assert.WithinDuration(t, time.Now(), loggedIn.ConnectedAt, time.Minute)
+	assert.Equal(t, pop3srv.AuthorizationState, notLoggedIn.State)
+	assert.Empty(t, notLoggedIn.User)
+}
+
+func TestServerKick(t *testing.T) {
+	// GIVEN
+	server := pop3srv.NewServer(pop3srv.AllowAllAuthorizer{}, pop3srv.EmptyMailboxProvider{})
+	addr := startTestServer(t, server)
+	kicked := dialTestServer(t, addr)
+	other := dialTestServer(t, addr)
+	sendCommand(t, kicked, "USER testuser")
+	sendCommand(t, kicked, "PASS testpass")
+	sendCommand(t, other, "USER otheruser")
+
+	// WHEN
+	count := server.Kick("testuser")
+	notFound := server.Kick("nobody")
+
+	// THEN
+	assert.Equal(t, 1, count)
+	assert.Equal(t, 0, notFound)
+	response, err := kicked.ReadLine()
+	require.NoError(t, err)
+	assert.Equal(t, "-ERR disconnected by administrator", response)
+	_, err = kicked.ReadLine()
+	assert.ErrorIs(t, err, io.EOF)
+	assert.True(t, strings.HasPrefix(sendCommand(t, other, "NOOP"), "-ERR"))
+	assert.Eventually(t, func() bool { return len(server.Sessions()) == 1 }, time.Second, 10*time.Millisecond)
+}
+
+// bearerAuthorizer accepts any OAuth token.
+type bearerAuthorizer struct {
+	pop3srv.AllowAllAuthorizer
+}
+
+func (bearerAuthorizer) OAuth(user, token string) error {
+	return nil
+}
+
+func TestServerKickDuringAuth(t *testing.T) {
+	// GIVEN
+	server := pop3srv.NewServerWithOptions(bearerAuthorizer{}, pop3srv.EmptyMailboxProvider{},
+		pop3srv.WithLogger(log.New(io.Discard, "", 0)),
+	)
+	addr := startTestServer(t, server)
+	client := dialTestServer(t, addr)
+	sendCommand(t, client, "USER testuser")
+	continuation := sendCommand(t, client, "AUTH XOAUTH2") // client never responds
+
+	// WHEN
+	countCh := make(chan int, 1)
+	go func() { countCh <- server.Kick("testuser") }()
+
+	// THEN
+	require.Equal(t, "+ ", continuation)
+	select {
+	case count := <-countCh:
+		assert.Equal(t, 1, count)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Kick waits for the command")
+	}
+	_, err := client.ReadLine()
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Eventually(t, func() bool { return len(server.Sessions()) == 0 }, time.Second, 10*time.Millisecond)
+}
+
+func TestServerConnectionGate(t *testing.T) {
+	// GIVEN
+	logOutput := &syncBuffer{}
+	server := pop3srv.NewServerWithOptions(pop3srv.AllowAllAuthorizer{}, pop3srv.EmptyMailboxProvider{},
+		pop3srv.WithLogger(log.New(logOutput, "", 0)),
+	)
+	server.ConnectionGate = func(remote net.Addr) error {
+		if remote.(*net.TCPAddr).IP.Equal(net.IPv4(127, 0, 0, 1)) {
+			return errors.New("blocked address")
+		}
+		return nil
+	}
+	addr := startTestServer(t, server)
+
+	// WHEN
+	client, err := textproto.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer client.Close()
+	response, err := client.ReadLine()
+	require.NoError(t, err)
+	_, errAfter := client.ReadLine()
+
+	// THEN
+	assert.Equal(t, "-ERR access denied", response)
+	assert.ErrorIs(t, errAfter, io.EOF) // connection is closed
+	assert.Contains(t, logOutput.String(), "rejected: blocked address")
+	assert.Empty(t, server.Sessions())
+}
+
+// temporaryError is accept error which should be retried.
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "temporary accept error" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// flakyListener fails first acceptErrors calls of Accept.
+type flakyListener struct {
+	net.Listener
+	acceptErrors []error
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if len(l.acceptErrors) > 0 {
+		err := l.acceptErrors[0]
+		l.acceptErrors = l.acceptErrors[1:]
+		return nil, err
+	}
+	return l.Listener.Accept()
+}
+
+func TestServerAcceptErrors(t *testing.T) {
+	t.Run("temporary error is retried", func(t *testing.T) {
+		// GIVEN
+		logOutput := &syncBuffer{}
+		server := pop3srv.NewServerWithOptions(pop3srv.AllowAllAuthorizer{}, pop3srv.EmptyMailboxProvider{},
+			pop3srv.WithLogger(log.New(logOutput, "", 0)),
+		)
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		flaky := &flakyListener{Listener: listener, acceptErrors: []error{temporaryError{}, temporaryError{}}}
+		serveErr := make(chan error, 1)
+		go func() { serveErr <- server.Serve(flaky) }()
+
+		// WHEN
+		client := dialTestServer(t, listener.Addr().String())
+		response := sendCommand(t, client, "QUIT")
+		server.Close()
+
+		// THEN
+		assert.Equal(t, "+OK server signing off", response)
+		assert.ErrorIs(t, <-serveErr, pop3srv.ErrServerClosed)
+		assert.Equal(t, 2, strings.Count(logOutput.String(), "Accept error: temporary accept error"))
+	})
+
+	t.Run("permanent error is returned", func(t *testing.T) {
+		// GIVEN
+		server := pop3srv.NewServerWithOptions(pop3srv.AllowAllAuthorizer{}, pop3srv.EmptyMailboxProvider{},
+			pop3srv.WithLogger(log.New(io.Discard, "", 0)),
+		)
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		acceptErr := errors.New("permanent accept error")
+		flaky := &flakyListener{Listener: listener, acceptErrors: []error{acceptErr}}
+
+		// WHEN
+		err = server.Serve(flaky)
+
+		// THEN
+		assert.ErrorIs(t, err, acceptErr)
+	})
+}
+
+func TestServerDisconnectDuringGreetingDelay(t *testing.T) {
+	// GIVEN
+	server := pop3srv.NewServer(pop3srv.AllowAllAuthorizer{}, pop3srv.EmptyMailboxProvider{})
+	server.GreetingDelay = time.Hour
+	addr := startTestServer(t, server)
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return len(server.Sessions()) == 1 }, time.Second, 10*time.Millisecond)
+
+	// WHEN
+	conn.Close()
+
+	// THEN
+	assert.Eventually(t, func() bool { return len(server.Sessions()) == 0 }, time.Second, 10*time.Millisecond)
+}
+
+// trustingAuthorizer trusts every user asserted by trusted relay.
+type trustingAuthorizer struct {
+	pop3srv.AllowAllAuthorizer
+}
+
+func (trustingAuthorizer) Trust(user string) error {
+	return nil
+}
+
+func TestServerXlogin(t *testing.T) {
+	for _, c := range []struct {
+		name            string
+		trustedNetworks []netip.Prefix
+		requireTLS      bool
+		response        string
+	}{
+		{name: "trusted", trustedNetworks: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}, response: "+OK logged in"},
+		{name: "untrusted", trustedNetworks: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}, response: "-ERR command not available"},
+		{name: "no trusted networks", response: "-ERR command not available"},
+		{name: "TLS required", trustedNetworks: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}, requireTLS: true, response: "-ERR [AUTH] command available only after STARTTLS"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			// GIVEN
+			server := pop3srv.NewServer(trustingAuthorizer{}, pop3srv.EmptyMailboxProvider{})
+			server.TrustedNetworks = c.trustedNetworks
+			server.RequireTLS = c.requireTLS
+			addr := startTestServer(t, server)
+			client := dialTestServer(t, addr)
+
+			// WHEN
+			response := sendCommand(t, client, "XLOGIN testuser")
+			stat := sendCommand(t, client, "STAT")
+
+			// THEN
+			assert.Equal(t, c.response, response)
+			assert.Equal(t, strings.HasPrefix(c.response, "+OK"), strings.HasPrefix(stat, "+OK"), stat)
+		})
+	}
+}
+
+func TestServerHandleCommand(t *testing.T) {
+	// GIVEN
+	server := pop3srv.NewServerWithOptions(pop3srv.AllowAllAuthorizer{}, pop3srv.EmptyMailboxProvider{},
+		pop3srv.WithLogger(log.New(io.Discard, "", 0)),
+	)
+	server.HandleCommand(pop3srv.AuthorizationState, "xping", func(s *pop3srv.Session, _ []string) error {
+		return s.WriteResponse("pong", nil)
+	})
+	server.HandleCommand(pop3srv.TransactionState, "XECHO", func(s *pop3srv.Session, args []string) error {
+		if len(args) == 0 {
+			return s.WriteResponse("", pop3srv.ErrInvalidArgument)
+		}
+		return s.WriteMultiline("echo follows", args)
+	})
+	addr := startTestServer(t, server)
+	client := dialTestServer(t, addr)
+
+	// WHEN
+	ping := sendCommand(t, client, "XPING")
+	echoBeforeLogin := sendCommand(t, client, "XECHO a")
+	sendCommand(t, client, "USER testuser")
+	sendCommand(t, client, "PASS testpass")
+	pingAfterLogin := sendCommand(t, client, "XPING")
+	echoNoArgs := sendCommand(t, client, "XECHO")
+	echo := sendCommand(t, client, "xecho a .b")
+	echoLines, err := client.ReadDotLines()
+	require.NoError(t, err)
+
+	// THEN
+	assert.Equal(t, "+OK pong", ping)
+	assert.Equal(t, "-ERR command not permitted in this state", echoBeforeLogin)
+	assert.Equal(t, "-ERR command not permitted in this state", pingAfterLogin)
+	assert.Equal(t, "-ERR invalid argument", echoNoArgs)
+	assert.Equal(t, "+OK echo follows", echo)
+	assert.Equal(t, []string{"a", ".b"}, echoLines)
+}
+
+func TestServerImplementation(t *testing.T) {
+	// GIVEN
+	server := pop3srv.NewServer(pop3srv.AllowAllAuthorizer{}, pop3srv.EmptyMailboxProvider{})
+	server.Implementation = "pop3srv-test 1.0"
+	addr := startTestServer(t, server)
+	client := dialTestServer(t, addr)
+
+	// WHEN
+	response := sendCommand(t, client, "CAPA")
+	capa, err := client.ReadDotLines()
+	require.NoError(t, err)
+
+	// THEN
+	assert.True(t, strings.HasPrefix(response, "+OK"))
+	assert.Contains(t, capa, "IMPLEMENTATION pop3srv-test 1.0")
+}
+
+func TestServerCapaAllDisabled(t *testing.T) {
+	// GIVEN
+	server := pop3srv.NewServer(pop3srv.AllowAllAuthorizer{}, pop3srv.EmptyMailboxProvider{})
+	server.Implementation = ""
+	server.DisabledCommands = []string{"USER", "APOP", "AUTH", "STLS", "TOP", "UIDL"}
+	addr := startTestServer(t, server)
+	client := dialTestServer(t, addr)
+
+	// WHEN
+	response := sendCommand(t, client, "CAPA")
+	capa, err := client.ReadDotLines()
+	next := sendCommand(t, client, "QUIT")
+
+	// THEN
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(response, "+OK"))
+	assert.Equal(t, []string{"RESP-CODES", "AUTH-RESP-CODE"}, capa) // only capabilities which can't be disabled
+	assert.True(t, strings.HasPrefix(next, "+OK"))                  // the response was terminated
+}
+
+func TestServerConnectionsLimit(t *testing.T) {
+	// GIVEN
+	server := pop3srv.NewServer(pop3srv.AllowAllAuthorizer{}, pop3srv.EmptyMailboxProvider{})
+	server.ConnectionsLimit = 2
+	addr := startTestServer(t, server)
+	dialTestServer(t, addr)
+	dialTestServer(t, addr)
+
+	// WHEN
+	extra, err := textproto.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer extra.Close()
+	response, err := extra.ReadLine()
+	require.NoError(t, err)
+	_, errAfter := extra.ReadLine()
+
+	// THEN
+	assert.Equal(t, "-ERR "+pop3srv.ErrTooManyConnections.Error(), response)
+	assert.ErrorIs(t, errAfter, io.EOF) // connection is closed
+}
+
+func TestServerWaitForConnectionSlot(t *testing.T) {
+	// GIVEN
+	server := pop3srv.NewServer(pop3srv.AllowAllAuthorizer{}, pop3srv.EmptyMailboxProvider{})
+	server.ConnectionsLimit = 1
+	server.WaitForConnectionSlot = true
+	addr := startTestServer(t, server)
+	first := dialTestServer(t, addr)
+
+	// WHEN
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	waiting := textproto.NewConn(conn)
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, errWhileFull := waiting.ReadLine()
+	sendCommand(t, first, "QUIT")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	banner, err := waiting.ReadLine()
+
+	// THEN
+	assert.ErrorIs(t, errWhileFull, os.ErrDeadlineExceeded) // not accepted yet
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(banner, "+OK"))
+}
+
+func TestServerHealthCheckProbeNotLogged(t *testing.T) {
+	// GIVEN
+	logOutput := &syncBuffer{}
+	server := pop3srv.NewServerWithOptions(pop3srv.AllowAllAuthorizer{}, pop3srv.EmptyMailboxProvider{},
+		pop3srv.WithLogger(log.New(logOutput, "", 0)),
+	)
+	server.Verbose = false
+	addr := startTestServer(t, server)
+
+	// WHEN
+	probe := dialTestServer(t, addr) // reads the banner
+	probe.Close()
+	assert.Eventually(t, func() bool { return len(server.Sessions()) == 0 }, time.Second, 10*time.Millisecond)
+	probeLog := logOutput.String()
+
+	client := dialTestServer(t, addr)
+	sendCommand(t, client, "QUIT")
+
+	// THEN
+	assert.Empty(t, probeLog)
+	assert.Eventually(t, func() bool { return strings.Contains(logOutput.String(), "closed") }, time.Second, 10*time.Millisecond)
+	assert.Contains(t, logOutput.String(), "Session summary:")
+}
+
+func TestServerBroadcast(t *testing.T) {
+	// GIVEN
+	server := pop3srv.NewServer(pop3srv.AllowAllAuthorizer{}, pop3srv.EmptyMailboxProvider{})
+	addr := startTestServer(t, server)
+	client := dialTestServer(t, addr)
+	sendCommand(t, client, "USER testuser")
+	sendCommand(t, client, "PASS testpass")
+
+	// WHEN
+	server.Broadcast("maintenance in 5 minutes")
+	announcement := sendCommand(t, client, "NOOP")
+	response, err := client.ReadLine()
+	require.NoError(t, err)
+	next := sendCommand(t, client, "NOOP")
+
+	// THEN
+	assert.Equal(t, "+OK maintenance in 5 minutes", announcement)
+	assert.True(t, strings.HasPrefix(response, "+OK"))
+	assert.True(t, strings.HasPrefix(next, "+OK"))
+	assert.NotEqual(t, announcement, next)
+}
+
+// waitForEvent receives events until one matching match arrives.
+func waitForEvent(t *testing.T, events <-chan pop3srv.SessionEvent, match func(pop3srv.SessionEvent) bool) pop3srv.SessionEvent {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-events:
+			if match(event) {
+				return event
+			}
+		case <-timeout:
+			t.Fatal("event not received")
+			return nil
+		}
+	}
+}
+
+func TestServerSessionEvents(t *testing.T) {
+	// GIVEN
+	events := make(chan pop3srv.SessionEvent, 16)
+	server := pop3srv.NewServerWithOptions(pop3srv.AllowAllAuthorizer{}, pop3srv.EmptyMailboxProvider{},
+		pop3srv.WithSessionEvents(events),
+	)
+	addr := startTestServer(t, server)
+	client := dialTestServer(t, addr)
+
+	// WHEN
+	sendCommand(t, client, "USER testuser")
+	sendCommand(t, client, "PASS testpass")
+	authenticated := waitForEvent(t, events, func(e pop3srv.SessionEvent) bool {
+		_, ok := e.(pop3srv.AuthenticatedEvent)
+		return ok
+	})
+	handled := waitForEvent(t, events, func(e pop3srv.SessionEvent) bool {
+		_, ok := e.(pop3srv.CommandHandledEvent)
+		return ok
+	})
+	sendCommand(t, client, "QUIT")
+	closed := waitForEvent(t, events, func(e pop3srv.SessionEvent) bool {
+		_, ok := e.(pop3srv.ClosedEvent)
+		return ok
+	})
+
+	// THEN
+	assert.Equal(t, pop3srv.AuthenticatedEvent{User: "testuser"}, authenticated)
+	assert.Equal(t, pop3srv.CommandHandledEvent{Name: "PASS"}, handled)
+	assert.NoError(t, closed.(pop3srv.ClosedEvent).Err)
+}
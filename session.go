@@ -3,13 +3,24 @@ package pop3srv
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
+	"iter"
 	"log"
+	"maps"
+	"net"
+	"net/netip"
 	"net/textproto"
 	"os"
+	"runtime/debug"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -25,31 +36,358 @@ type (
 		// Value equal or less than zero means infinite timeout (default).
 		ConnectionTimeout time.Duration
 
+		// AuthTimeout is the amount of time allowed to authenticate,
+		// counted from the greeting. After it the client still
+		// in the authorization state gets -ERR response with
+		// [ErrAuthTimeout] and the connection is closed. It's usually
+		// shorter than ConnectionTimeout, so clients which never
+		// authenticate are dropped faster than idle authenticated ones.
+		//
+		// Value equal or less than zero means no limit (default).
+		AuthTimeout time.Duration
+
+		// HandlerTimeout is the amount of time allowed to execute
+		// a command, including backend calls and sending the response
+		// (e.g. slow RETR from remote storage). After the timeout
+		// the connection is closed and the session ends with
+		// [ErrHandlerTimeout] as soon as the handler returns.
+		// Context passed to backends (see [ExternalAuthorizer]) is
+		// cancelled too.
+		//
+		// Value equal or less than zero means infinite timeout (default).
+		HandlerTimeout time.Duration
+
+		// DisableSizesCache disables caching of message sizes.
+		//
+		// By default sizes of messages are fetched with [Mailbox.List]
+		// once after login and STAT and LIST commands are served from
+		// the cache. Set it to true if the [Mailbox] should be asked
+		// for live data on every command: STAT calls [Mailbox.Stat],
+		// LIST with message number calls [Mailbox.ListOne].
+		DisableSizesCache bool
+
+		// TimestampBannerGenerator generates APOP timestamp banner
+		// sent in the greeting message.
+		//
+		// The banner must be in form of RFC 822 msg-id (<...@...>),
+		// otherwise the default one is used. If nil, the default generator
+		// (<pid.microseconds@hostname>) is used.
+		TimestampBannerGenerator func() string
+
+		// BannerHostname is the host name used in the default APOP
+		// timestamp banner. If empty, [os.Hostname] is used. Characters
+		// not allowed in RFC 822 domain are replaced with hyphens.
+		// It's ignored if TimestampBannerGenerator is set.
+		BannerHostname string
+
+		// MaxInvalidCommands is the number of consecutive unknown commands
+		// after which the session is terminated. The counter is reset
+		// by every valid command.
+		//
+		// Value equal or less than zero means no limit.
+		// [NewSession] sets it to [DefaultMaxInvalidCommands].
+		MaxInvalidCommands int
+
+		// MaxListEntries is the maximum number of entries in LIST and UIDL
+		// responses, it protects the session from a backend returning
+		// absurdly long lists. Longer lists are rejected with [ErrTooManyMessages].
+		//
+		// Value equal or less than zero means no limit.
+		// [NewSession] sets it to [DefaultMaxListEntries].
+		MaxListEntries int
+
+		// InvalidCommandPolicy defines when invalid commands terminate
+		// the session. Default is [InvalidCommandsLimited].
+		InvalidCommandPolicy InvalidCommandPolicy
+
+		// MaxAuthAttempts is the number of failed authentication attempts
+		// (PASS or APOP) after which the session is terminated.
+		//
+		// Value equal or less than zero means no limit (default).
+		MaxAuthAttempts int
+
+		// AuthFailDelay is the delay inserted before every -ERR response
+		// for failed authentication attempt to slow down brute-force attacks.
+		// The delay is interrupted when [Server] is shutting down.
+		//
+		// Value equal or less than zero means no delay (default).
+		AuthFailDelay time.Duration
+
+		// GreetingDelay is the delay before the greeting is sent (tarpitting):
+		// well-behaved clients wait for it, while some abusive ones
+		// disconnect early. If the connection supports read deadlines
+		// (like [net.Conn]) the session ends as soon as the client
+		// disconnects during the delay. The delay is interrupted when
+		// [Server] is shutting down.
+		//
+		// Value equal or less than zero means no delay (default).
+		GreetingDelay time.Duration
+
+		// UsernameNormalizer, if set, is applied to user names sent by
+		// the client (USER, APOP, AUTH) before they're passed to [Authorizer]
+		// and [MailboxProvider], e.g. to lowercase them. The normalized
+		// name is reported in [SessionInfo], events and logs.
+		UsernameNormalizer func(user string) string
+
+		// InvalidateBannerOnApopFailure makes the APOP timestamp banner
+		// single use: after failed APOP attempt all subsequent APOP commands
+		// in the session are rejected.
+		//
+		// The banner is the only challenge of APOP and it's fixed for the whole
+		// session, so every APOP attempt in the session is computed against
+		// the same value. Invalidating the banner prevents online guessing
+		// and replaying captured digests within one connection, the client
+		// has to reconnect to get a fresh challenge.
+		// A second APOP after successful login is always rejected.
+		InvalidateBannerOnApopFailure bool
+
+		// TLSConfig is the TLS configuration used for STLS command.
+		// STLS is available (and advertised in CAPA response) only if
+		// it's set and the connection is a [net.Conn] not encrypted yet.
+		TLSConfig *tls.Config
+
+		// RequireTLS disables authentication commands (USER, PASS, APOP,
+		// AUTH, RPOP and XLOGIN) until the connection is encrypted with STLS or
+		// the session is served over implicit TLS connection.
+		// APOP is never available after STLS, because its challenge
+		// was sent in the plaintext greeting.
+		RequireTLS bool
+
+		// EnableRpop enables obsolete RPOP command if [Authorizer]
+		// implements [RpopAuthorizer]. Otherwise RPOP is rejected
+		// with [ErrCommandNotSupported] (default).
+		//
+		// RPOP trusts the client host, see [RpopAuthorizer] for
+		// security implications.
+		EnableRpop bool
+
+		// TrustedNetworks lists networks of trusted relays (e.g. mail proxy
+		// authenticating users upstream) allowed to log in the user with
+		// XLOGIN command without credentials, if [Authorizer] implements
+		// [TrustedAuthorizer]. XLOGIN from other addresses (or connections
+		// without IP address) is rejected with [ErrCommandNotAvailable].
+		//
+		// Empty list disables XLOGIN (default).
+		TrustedNetworks []netip.Prefix
+
+		// Verbose enables logging of every protocol line sent and received.
+		// Without it connections closed by the client before sending
+		// anything (e.g. health checks of load balancers) aren't logged.
+		// [NewSession] sets it to true.
+		Verbose bool
+
+		// RetrSizeInResponse makes RETR response contain size
+		// of the message ("+OK 1234 octets"), taken from the cached
+		// message sizes. Text after +OK is informational for clients
+		// following RFC 1939 but some clients use it to show progress.
+		RetrSizeInResponse bool
+
+		// MaxBytesPerSecond limits the average rate of sending RETR and TOP
+		// responses, so one client can't saturate the uplink. Waiting
+		// is interrupted when the session is cancelled, and the limit
+		// is lifted when [Server] is shutting down.
+		//
+		// Value equal or less than zero means no limit (default).
+		MaxBytesPerSecond int64
+
+		// ContinueOnRetrError makes errors during sending of the message
+		// for RETR command (reading the message or writing it to the
+		// connection) not end the session, if none of the response has
+		// been sent yet: the client gets -ERR response with
+		// [ErrMessageNotSent] and the session continues. It's intended
+		// for [Conn] implementations where failed write doesn't mean
+		// broken connection (e.g. framed transports). Errors after part
+		// of the response has been sent still end the session.
+		//
+		// Default is false: any error ends the session.
+		ContinueOnRetrError bool
+
+		// Implementation is sent as IMPLEMENTATION capability in CAPA
+		// response (RFC 2449) if it's non-empty.
+		// [NewSession] sets it to [DefaultImplementation].
+		Implementation string
+
+		// NoopResponse is the text of +OK response to NOOP command,
+		// e.g. for monitoring keyed on specific text. If it's empty,
+		// bare "+OK" is sent. [NewSession] sets it to [DefaultNoopResponse].
+		NoopResponse string
+
+		// DisabledCommands lists commands (case insensitive) which
+		// are rejected with [ErrCommandDisabled] and omitted from CAPA
+		// response, e.g. TOP or UIDL.
+		DisabledCommands []string
+
+		// CloseLinger is the maximum time to wait for the client to close
+		// its side of the connection after the last response (e.g. to QUIT)
+		// was sent, so the response isn't lost by connection reset.
+		// It works only for connections supporting half-close (TCP, TLS).
+		//
+		// Zero means the connection is closed immediately (default).
+		CloseLinger time.Duration
+
+		// ReadBufferSize is size of buffer for reading client's commands,
+		// larger buffer reduces syscalls for many pipelined commands on
+		// high-latency links. Zero means default size (4096 bytes),
+		// sizes below [MinReadBufferSize] are raised to it.
+		ReadBufferSize int
+
+		// Logger is used for session's log messages. If nil,
+		// the standard logger of log package is used.
+		Logger *log.Logger
+
 		conn            Conn
 		authorizer      Authorizer
 		mboxProvider    MailboxProvider
 		timestampBanner string
 		apopEnabled     bool
+		// bannerExposed is set after STLS, the timestamp banner
+		// was sent in plaintext and can't be used for APOP
+		bannerExposed   bool
 		userPassEnabled bool
 
-		r *bufio.Reader
+		r     *bufio.Reader
+		w     *bufio.Writer
+		stats sessionStats
+		// skipLF is set after line terminated by CR,
+		// LF following it is a part of CRLF terminator
+		skipLF bool
+		// readAbandoned is set when read timed out on connection without
+		// read deadline, the read goroutine may still use the reader,
+		// so it can't be returned to the pool
+		readAbandoned bool
 
-		state    sessionState
+		state    SessionState
 		user     string
 		mailbox  Mailbox
 		toDelete map[int]struct{}
 		msgCount int
+
+		ctx             context.Context
+		invalidCommands int
+		authAttempts    int
+
+		// interrupt is closed when the session should stop waiting
+		// (e.g. server shutdown), nil means never.
+		interrupt <-chan struct{}
+
+		// sizes caches message sizes fetched from the mailbox
+		// after login, it's invalidated by RSET.
+		sizes       []int
+		sizesCached bool
+
+		// lockUser and unlockUser provide exclusive access to user's
+		// mailbox across sessions (set by [Server]), nil means no locking.
+		lockUser   func(user string) bool
+		unlockUser func(user string)
+		lockedUser string
+
+		// info is a snapshot of the session state for other goroutines,
+		// it's updated by the session goroutine after every command.
+		// infoMu also guards modifications of toDelete.
+		info   SessionInfo
+		infoMu sync.Mutex
+
+		events chan<- SessionEvent
+
+		// customCommands are registered with HandleCommand, they're
+		// added to dispatch (overriding standard commands)
+		customCommands map[SessionState]handlersMap
+		// dispatch is a copy of starteDispatch without disabled commands
+		// and with custom commands
+		dispatch map[SessionState]handlersMap
+		disabled map[string]struct{}
+
+		// mu is held while a command is handled and its response
+		// is sent, so kick can't interleave with the session goroutine.
+		mu     sync.Mutex
+		done   atomic.Bool
+		kicked atomic.Bool
+		// baseConn is the connection passed to NewSession, it isn't
+		// replaced by STLS, so kick can close it from other goroutine
+		baseConn Conn
+
+		// authDeadline is the end of AuthTimeout, zero if it's not set
+		authDeadline time.Time
+
+		// announcements are queued by Announce and sent
+		// before the response to the next command
+		announcements  []string
+		announcementMu sync.Mutex
+	}
+
+	// SessionState is the state of POP3 session (RFC 1939).
+	SessionState int
+
+	// SessionInfo is a snapshot of [Session] state,
+	// see [Session.Info] and [Server.Sessions].
+	SessionInfo struct {
+		// User is the user name sent by the client,
+		// it may be not authenticated yet.
+		User string
+
+		// RemoteAddr is the remote address of the connection
+		// or "unknown" if it's not available.
+		RemoteAddr string
+
+		State       SessionState
+		ConnectedAt time.Time
+		BytesIn     int64
+		BytesOut    int64
 	}
 
-	sessionState int
+	// CommandHandler handles custom command registered with
+	// [Session.HandleCommand] or [Server.HandleCommand]. args are
+	// the command's arguments separated by whitespace. The handler
+	// responds with [Session.WriteResponse] or [Session.WriteMultiline],
+	// returned error terminates the session.
+	CommandHandler func(s *Session, args []string) error
+
+	// InvalidCommandPolicy defines how [Session] reacts
+	// to unknown commands.
+	InvalidCommandPolicy int
+)
+
+const (
+	// InvalidCommandsLimited terminates the session after
+	// [Session.MaxInvalidCommands] consecutive invalid commands.
+	InvalidCommandsLimited InvalidCommandPolicy = iota
+
+	// InvalidCommandsLenient never terminates the session
+	// because of invalid commands.
+	InvalidCommandsLenient
+
+	// InvalidCommandsStrict terminates the session on the first invalid
+	// command before authentication. After authentication it behaves
+	// like [InvalidCommandsLimited].
+	InvalidCommandsStrict
 )
 
 const (
-	authorizationState sessionState = iota
-	transactionState
-	updateState
+	DefaultMaxInvalidCommands = 10
+	DefaultMaxListEntries     = 100000
+	DefaultImplementation     = "pop3srv"
+	DefaultNoopResponse       = "noop"
+	MinReadBufferSize         = 512
 )
 
+const (
+	AuthorizationState SessionState = iota
+	TransactionState
+	UpdateState
+)
+
+func (st SessionState) String() string {
+	switch st {
+	case AuthorizationState:
+		return "AUTHORIZATION"
+	case TransactionState:
+		return "TRANSACTION"
+	case UpdateState:
+		return "UPDATE"
+	}
+	return fmt.Sprintf("SessionState(%d)", int(st))
+}
+
 // #region Exported methods
 
 // NewSession creates new [Session] with [MailboxProvider] and [Authorizer].
@@ -58,73 +396,380 @@ const (
 // But it can be constructed with any [Conn] type (at this moment alias for
 // [io.ReadWriteCloser] but it can change in the future).
 //
-// After construction greetings message (with APOP banner) is sent
-// to the connection. Error is the error returned by Write operation on
-// the connection.
+// Nothing is sent to the connection on construction, so the session
+// can be configured first. Greetings message (with APOP banner) is sent
+// by [Session.Serve], which returns the error of writing it.
 func NewSession(c Conn, mboxProvider MailboxProvider, authorizer Authorizer) *Session {
 	s := &Session{
-		conn:         c,
-		authorizer:   authorizer,
-		mboxProvider: mboxProvider,
-		r:            bufio.NewReader(c),
-		state:        authorizationState,
-		toDelete:     make(map[int]struct{}),
+		MaxInvalidCommands: DefaultMaxInvalidCommands,
+		MaxListEntries:     DefaultMaxListEntries,
+		Verbose:            true,
+		Implementation:     DefaultImplementation,
+		NoopResponse:       DefaultNoopResponse,
+		conn:               c,
+		baseConn:           c,
+		authorizer:         authorizer,
+		mboxProvider:       mboxProvider,
+		state:              AuthorizationState,
+		toDelete:           make(map[int]struct{}),
+		ctx:                context.Background(),
 	}
+	s.stats.bytesIn.r = c
+	s.stats.bytesOut.w = c
+	s.w = bufio.NewWriter(&s.stats.bytesOut)
 	return s
 }
 
 func (s *Session) setupCapabilities() {
-	s.apopEnabled = s.authorizer.Apop("", "", "") != ErrNotSupportedAuthMethod
-	s.userPassEnabled = s.authorizer.UserPass("", "") != ErrNotSupportedAuthMethod
+	s.setupDispatch()
+	s.apopEnabled = s.commandEnabled(apopCmd) && s.authorizer.Apop("", "", "") != ErrNotSupportedAuthMethod
+	s.userPassEnabled = s.commandEnabled(userCmd) && s.authorizer.UserPass("", "") != ErrNotSupportedAuthMethod
 
 	if s.apopEnabled {
-		s.timestampBanner = generateTimestampBanner()
+		s.timestampBanner = s.generateTimestampBanner()
 	}
 }
 
 // Serve is the main loop which read commands and write reponses.
+// It starts with sending greetings message (after [Session.GreetingDelay]).
 //
 // It returns non-nil error if there is any error on reading or writing
 // data with connection. [MailboxProvider] and [Authorizer] errors are
 // reported as -ERR response.
 func (s *Session) Serve() error {
-	s.setupCapabilities()
-	greetings := fmt.Sprintf("+OK POP3 server ready %s\r\n", s.timestampBanner)
-	if err := s.writeLine(greetings); err != nil {
+	return s.ServeContext(context.Background())
+}
+
+// ServeContext is like [Session.Serve] but it also returns when ctx
+// is cancelled. Cancellation closes the connection to abort pending read
+// and the context's error is returned.
+//
+// Messages marked as deleted are deleted only if the client issued QUIT
+// command. If the session ends in any other way (client disconnected,
+// session was aborted or cancelled) the mailbox is closed without
+// deleting any message.
+func (s *Session) ServeContext(ctx context.Context) error {
+	s.ctx = ctx
+	conn := s.conn // STLS replaces s.conn, closing underlying connection is enough
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	s.r = getReader(&s.stats.bytesIn, s.ReadBufferSize)
+	defer func() {
+		if !s.readAbandoned {
+			putReader(s.r)
+		}
+	}()
+
+	s.stats.start = time.Now()
+	s.updateInfo()
+	err := s.serve()
+
+	s.mu.Lock()
+	s.done.Store(true)
+	if errFlush := s.w.Flush(); err == nil {
+		err = errFlush
+	}
+	if s.kicked.Load() {
+		err = ErrKicked
+	}
+	s.mu.Unlock()
+
+	if s.state != UpdateState {
+		// no QUIT was issued (client disconnected, session was aborted
+		// or cancelled), messages marked as deleted are kept (RFC 1939);
+		// mailbox errors can't be reported to the client anymore
+		if errRelease := s.releaseMailbox(); errors.Is(errRelease, ErrInternal) {
+			err = errRelease
+		}
+	}
+	s.unlockMailbox()
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	s.logAccess(err)
+	s.emit(ClosedEvent{Err: err})
+	return err
+}
+
+func (s *Session) serve() error {
+	if err := s.waitGreetingDelay(); err != nil {
+		return err
+	}
+	err := s.locked(func() error {
+		s.setupCapabilities()
+		return s.writeResponseLine(strings.TrimSpace("POP3 server ready "+s.timestampBanner), nil)
+	})
+	if err != nil {
 		return err
 	}
+	if s.AuthTimeout > 0 {
+		s.authDeadline = time.Now().Add(s.AuthTimeout)
+	}
+
+	for s.state != UpdateState {
+		cmd, err := s.readCommand()
+		if err != nil {
+			if s.authTimedOut() {
+				return s.locked(func() error { return s.abort(ErrAuthTimeout) })
+			}
+			return err
+		}
 
-	for s.state != updateState {
-		cmd, err := timeoutCall(s.readCommand, 10000*time.Second)
+		err = s.locked(func() error {
+			if err := s.writeAnnouncements(); err != nil {
+				return err
+			}
+			return s.withHandlerTimeout(func() error {
+				return s.handleState(s.dispatch[s.state], cmd)
+			})
+		})
 		if err != nil {
 			return err
 		}
+		s.emit(CommandHandledEvent{Name: cmd.name})
+	}
+	return nil
+}
+
+// withHandlerTimeout runs fn bounded by HandlerTimeout. Running handler
+// can't be interrupted, on timeout the connection is closed, so the client
+// isn't kept waiting and handler's writes fail.
+func (s *Session) withHandlerTimeout(fn func() error) error {
+	if s.HandlerTimeout <= 0 {
+		return fn()
+	}
+	ctx := s.ctx
+	defer func() { s.ctx = ctx }()
+	var cancel context.CancelFunc
+	s.ctx, cancel = context.WithTimeout(ctx, s.HandlerTimeout)
+	defer cancel()
+
+	var timedOut atomic.Bool
+	conn := s.conn
+	timer := time.AfterFunc(s.HandlerTimeout, func() {
+		timedOut.Store(true)
+		conn.Close()
+	})
+	err := fn()
+	timer.Stop()
+	if timedOut.Load() {
+		s.logf("Handling command of %q timed out after %v", s.user, s.HandlerTimeout)
+		return ErrHandlerTimeout
+	}
+	return err
+}
+
+// locked runs fn with the session lock held and sends buffered
+// responses, then publishes session state for [Session.Info].
+//
+// Panic in fn (e.g. in [Mailbox] or [Authorizer]) is recovered and
+// logged, the client gets [ErrInternal] response and the connection
+// is closed, so the session ends without deleting messages.
+func (s *Session) locked(fn func() error) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer func() {
+		if r := recover(); r != nil {
+			s.logf("Panic in session of %q: %v\n%s", s.user, r, debug.Stack())
+			s.w.Reset(&s.stats.bytesOut) // drop partially written response
+			err = s.abort(ErrInternal)
+			s.updateInfo()
+		}
+	}()
+	err = fn()
+	if errFlush := s.w.Flush(); err == nil {
+		err = errFlush
+	}
+	if errors.Is(err, ErrConnectionLost) {
+		// the rest of the response (e.g. the rest of LIST with terminating
+		// dot) can't be sent, it's dropped instead of being stuck in the buffer
+		s.w.Reset(&s.stats.bytesOut)
+	}
+	s.updateInfo()
+	return err
+}
+
+// recoverPanic logs panic raised by the backend outside of [Session.locked]
+// (e.g. closing the mailbox after the session ended) and sets *err
+// to [ErrInternal]. It has to be deferred.
+func (s *Session) recoverPanic(err *error) {
+	if r := recover(); r != nil {
+		s.logf("Panic in session of %q: %v\n%s", s.user, r, debug.Stack())
+		*err = ErrInternal
+	}
+}
+
+// kick closes the connection, so the session goroutine ends with
+// [ErrKicked]. Idle session waiting for command gets reason as -ERR
+// response first. It never waits for the command being handled (e.g.
+// waiting for SASL continuation or rate limited RETR), such session
+// is disconnected without response. It returns false if the session
+// has already finished or was kicked.
+func (s *Session) kick(reason error) bool {
+	if s.done.Load() || !s.kicked.CompareAndSwap(false, true) {
+		return false
+	}
+	if s.mu.TryLock() {
+		if !s.done.Load() {
+			s.writeResponseLine("", reason)
+			s.w.Flush()
+		}
+		s.mu.Unlock()
+	}
+	s.baseConn.Close()
+	return true
+}
+
+// Announce queues msg (e.g. maintenance warning) to be sent to the client
+// as informational +OK line before the response to the next command.
+// POP3 has no unsolicited responses, so it's the only point where the client
+// reads from the connection; clients which don't expect extra status line
+// may treat it as response to the command. CR and LF in msg are replaced
+// with spaces. It's safe to call Announce from other goroutines.
+func (s *Session) Announce(msg string) {
+	msg = strings.NewReplacer("\r", " ", "\n", " ").Replace(msg)
+	s.announcementMu.Lock()
+	defer s.announcementMu.Unlock()
+	s.announcements = append(s.announcements, msg)
+}
+
+// writeAnnouncements sends messages queued by Announce.
+func (s *Session) writeAnnouncements() error {
+	s.announcementMu.Lock()
+	announcements := s.announcements
+	s.announcements = nil
+	s.announcementMu.Unlock()
 
-		if err = s.handleState(starteDispatch[s.state], cmd); err != nil {
+	for _, msg := range announcements {
+		if err := s.writeResponseLine(msg, nil); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-// Close closes the session: it deletes messages marked as deleted from
-// mailbox (if the mailbox was created as a result of successful authorization),
-// then sent farewell status line (+OK or -ERR depending on messages' deletion result)
+// Close closes the session: in the UPDATE state (entered with QUIT command)
+// it deletes messages marked as deleted from the mailbox, then closes
+// the mailbox (if the mailbox was created as a result of successful authorization),
+// sends farewell status line (+OK or -ERR depending on messages' deletion result)
 // and finally closes the connection.
+//
+// Close called in any other state doesn't delete messages. The mailbox
+// is closed once, even if Close is called before the session ends
+// (e.g. from [CommandHandler]).
+//
+// Deletion isn't atomic: all messages are attempted to be deleted even
+// if some [Mailbox.Dele] calls fail, then the response is -ERR with
+// [ErrMessagesNotRemoved] listing numbers of messages which weren't removed.
 func (s *Session) Close() error {
-	defer s.conn.Close()
+	defer s.closeConn()
+	return s.writeResponseLine("server signing off", s.releaseMailbox())
+}
 
-	var err error
-	if s.mailbox != nil {
-		for msg := range s.toDelete {
-			if err = s.mailbox.Dele(msg); err != nil {
-				break
-			}
+// releaseMailbox deletes messages marked as deleted in the UPDATE state,
+// closes the mailbox and releases the per-user lock. Panic in the mailbox
+// is recovered and reported as [ErrInternal], like in command handlers.
+func (s *Session) releaseMailbox() (err error) {
+	if s.mailbox == nil {
+		return nil
+	}
+	defer s.unlockMailbox()
+	defer s.recoverPanic(&err)
+	defer func() { s.mailbox = nil }() // Close may be called again on disconnect
+
+	if s.state == UpdateState {
+		err = s.deleteMessages()
+	}
+	if errClose := s.closeMailbox(); err == nil {
+		err = errClose
+	}
+	return err
+}
+
+// isProbe reports if the client hasn't sent anything, like load
+// balancers probing the port by reading the banner and disconnecting.
+func (s *Session) isProbe() bool {
+	return s.BytesIn() == 0
+}
+
+// Info returns snapshot of the session state. The state is updated
+// after every command. It's safe to call it concurrently with [Session.Serve].
+func (s *Session) Info() SessionInfo {
+	s.infoMu.Lock()
+	info := s.info
+	s.infoMu.Unlock()
+	info.BytesIn = s.BytesIn()
+	info.BytesOut = s.BytesOut()
+	return info
+}
+
+// PendingDeletions returns sorted (1-based) numbers of messages marked
+// as deleted, which will be removed from the mailbox on QUIT. Every
+// message can be marked once, so there are at most as many pending
+// deletions as messages in the mailbox. It's safe to call it concurrently
+// with [Session.Serve] and from [CommandHandler].
+func (s *Session) PendingDeletions() []int {
+	s.infoMu.Lock()
+	defer s.infoMu.Unlock()
+	msgs := slices.Sorted(maps.Keys(s.toDelete))
+	for i := range msgs {
+		msgs[i]++
+	}
+	return msgs
+}
+
+// BytesIn returns number of bytes received from the client so far.
+// It's safe to call it concurrently with [Session.Serve].
+func (s *Session) BytesIn() int64 {
+	return s.stats.bytesIn.n.Load()
+}
+
+// BytesOut returns number of bytes sent to the client so far,
+// including message contents sent for RETR and TOP commands.
+// It's safe to call it concurrently with [Session.Serve].
+func (s *Session) BytesOut() int64 {
+	return s.stats.bytesOut.n.Load()
+}
+
+// HandleCommand registers custom command name (case insensitive) handled
+// in the state ([AuthorizationState] or [TransactionState]), e.g.
+// for protocol experiments. The handler overrides standard command with
+// the same name, [Session.DisabledCommands] applies to custom commands too.
+// It must be called before [Session.Serve].
+func (s *Session) HandleCommand(state SessionState, name string, handler CommandHandler) {
+	s.customCommands = addCommand(s.customCommands, state, name, handler)
+}
+
+// WriteResponse sends status line: -ERR with err if it's not nil,
+// otherwise +OK with text. It's intended for [CommandHandler].
+func (s *Session) WriteResponse(text string, err error) error {
+	return s.writeResponseLine(text, err)
+}
+
+// WriteMultiline sends +OK with text followed by multi-line response:
+// lines (without line terminators) are dot-stuffed and terminated with "."
+// (RFC 1939). It's intended for [CommandHandler].
+func (s *Session) WriteMultiline(text string, lines []string) error {
+	if err := s.writeResponseLine(text, nil); err != nil {
+		return err
+	}
+	for _, line := range lines {
+		if strings.HasPrefix(line, ".") {
+			line = "." + line
+		}
+		if err := s.writeLine(line + "\r\n"); err != nil {
+			return err
 		}
-		err = s.mailbox.Close()
 	}
+	return s.writeLine(".\r\n")
+}
 
-	return s.writeResponseLine("server signing off", err)
+// Mailbox returns the mailbox of authenticated user or nil in
+// [AuthorizationState]. It's intended for [CommandHandler], messages
+// marked as deleted in the session are still present in the mailbox.
+func (s *Session) Mailbox() Mailbox {
+	return s.mailbox
 }
 
 // #endregion
@@ -137,230 +782,631 @@ type (
 
 var (
 	authorizationStateDispatch = handlersMap{
-		userCmd: (*Session).handleUser,
-		passCmd: (*Session).handlePass,
-		quitCmd: (*Session).handleQuit,
-		apopCmd: (*Session).handleApop,
-		capaCmd: (*Session).handleCapa,
+		userCmd:   (*Session).handleUser,
+		passCmd:   (*Session).handlePass,
+		quitCmd:   (*Session).handleQuit,
+		apopCmd:   (*Session).handleApop,
+		capaCmd:   (*Session).handleCapa,
+		authCmd:   (*Session).handleAuth,
+		stlsCmd:   (*Session).handleStls,
+		rpopCmd:   (*Session).handleRpop,
+		xloginCmd: (*Session).handleXlogin,
 	}
 	transactionStateDispatch = handlersMap{
 		quitCmd: (*Session).handleQuit,
 		capaCmd: (*Session).handleCapa,
 		statCmd: (*Session).handleStat,
 		listCmd: (*Session).handleList,
-		retrCmd: (*Session).handleRetr,
+		retrCmd: rateLimited((*Session).handleRetr),
 		deleCmd: (*Session).handleDele,
 		rsetCmd: (*Session).handleRset,
 		noopCmd: (*Session).handleNoop,
-		topCmd:  (*Session).handleTop,
+		topCmd:  rateLimited((*Session).handleTop),
 		uidlCmd: (*Session).handleUidl,
 	}
 
-	starteDispatch = map[sessionState]handlersMap{
-		authorizationState: authorizationStateDispatch,
-		transactionState:   transactionStateDispatch,
+	starteDispatch = map[SessionState]handlersMap{
+		AuthorizationState: authorizationStateDispatch,
+		TransactionState:   transactionStateDispatch,
 	}
 )
 
+// addCommand returns copy of commands with custom command added,
+// so commands shared by sessions of [Server] aren't modified.
+func addCommand(commands map[SessionState]handlersMap, state SessionState, name string, handler CommandHandler) map[SessionState]handlersMap {
+	commands = maps.Clone(commands)
+	if commands == nil {
+		commands = make(map[SessionState]handlersMap)
+	}
+	handlers := maps.Clone(commands[state])
+	if handlers == nil {
+		handlers = make(handlersMap)
+	}
+	handlers[strings.ToUpper(name)] = func(s *Session, cmd command) error {
+		return handler(s, cmd.args)
+	}
+	commands[state] = handlers
+	return commands
+}
+
+// rateLimited makes handler send its response at most
+// [Session.MaxBytesPerSecond], if it's set.
+func rateLimited(handler handlerMethod) handlerMethod {
+	return func(s *Session, cmd command) error {
+		if s.MaxBytesPerSecond <= 0 {
+			return handler(s, cmd)
+		}
+		if err := s.w.Flush(); err != nil {
+			return err
+		}
+		s.w.Reset(newRateLimitedWriter(s.ctx, &s.stats.bytesOut, s.MaxBytesPerSecond, s.interrupt))
+		err := handler(s, cmd)
+		if errFlush := s.w.Flush(); err == nil {
+			err = errFlush
+		}
+		s.w.Reset(&s.stats.bytesOut)
+		return err
+	}
+}
+
 func (s *Session) handleState(dispatcher handlersMap, cmd command) error {
 	handler, found := dispatcher[cmd.name]
 	if found {
+		s.invalidCommands = 0
+		if !cmd.validArgs() {
+			return s.writeResponseLine("", ErrInvalidArgument)
+		}
 		return handler(s, cmd)
 	}
+
+	if !s.commandEnabled(cmd.name) {
+		return s.writeResponseLine("", ErrCommandDisabled)
+	}
+	if s.isKnownCommand(cmd.name) {
+		return s.writeResponseLine("", ErrCommandNotPermitted)
+	}
+
+	s.invalidCommands++
+	if s.tooManyInvalidCommands() {
+		return s.abort(ErrTooManyInvalidCommands)
+	}
 	return s.writeResponseLine("", ErrInvalidCommand)
 }
 
+// setupDispatch prepares session's dispatch maps. Shared starteDispatch
+// is used unless some commands are disabled or custom ones are added.
+func (s *Session) setupDispatch() {
+	s.dispatch = starteDispatch
+	if len(s.DisabledCommands) == 0 && len(s.customCommands) == 0 {
+		return
+	}
+	s.disabled = make(map[string]struct{}, len(s.DisabledCommands))
+	for _, name := range s.DisabledCommands {
+		s.disabled[strings.ToUpper(name)] = struct{}{}
+	}
+	s.dispatch = make(map[SessionState]handlersMap, len(starteDispatch))
+	for state, handlers := range starteDispatch {
+		s.dispatch[state] = maps.Clone(handlers)
+		maps.Copy(s.dispatch[state], s.customCommands[state])
+		maps.DeleteFunc(s.dispatch[state], func(name string, _ handlerMethod) bool {
+			return !s.commandEnabled(name)
+		})
+	}
+}
+
+// commandEnabled checks if the command isn't disabled
+// with [Session.DisabledCommands].
+func (s *Session) commandEnabled(name string) bool {
+	_, disabled := s.disabled[name]
+	return !disabled
+}
+
+// tooManyInvalidCommands checks if the session has to be terminated
+// according to [Session.InvalidCommandPolicy].
+func (s *Session) tooManyInvalidCommands() bool {
+	switch s.InvalidCommandPolicy {
+	case InvalidCommandsLenient:
+		return false
+	case InvalidCommandsStrict:
+		if s.state == AuthorizationState {
+			return true
+		}
+	}
+	return s.MaxInvalidCommands > 0 && s.invalidCommands > s.MaxInvalidCommands
+}
+
+// isKnownCommand checks if the command is handled in any session state.
+func (s *Session) isKnownCommand(name string) bool {
+	for _, dispatcher := range s.dispatch {
+		if _, found := dispatcher[name]; found {
+			return true
+		}
+	}
+	return false
+}
+
 // #endregion
 
 // #region Command handlers
 func (s *Session) handleUser(cmd command) error {
-	if s.user != "" {
-		return s.writeResponseLine("", ErrUserAlreadySpecified)
+	if s.tlsRequired() {
+		return s.writeResponseLine("", ErrTLSRequired)
 	}
-	s.user = cmd.args[0]
+	if !s.userPassEnabled {
+		return s.writeResponseLine("", ErrNotSupportedAuthMethod)
+	}
+	// USER can be re-issued before successful PASS (RFC 1939)
+	// so the last one wins. It's not available after authentication.
+	s.user = s.normalizeUser(cmd.args[0])
 	return s.writeResponseLine("send PASS", nil)
 }
 
 func (s *Session) handlePass(cmd command) error {
+	if s.tlsRequired() {
+		return s.writeResponseLine("", ErrTLSRequired)
+	}
 	if s.user == "" {
 		return s.writeResponseLine("", ErrUserNotSpecified)
 	}
+	if authProvider, ok := s.authorizer.(ContextAuthProvider); ok {
+		mailbox, err := authProvider.AuthenticateContext(s.backendContext(), s.user, cmd.args[0])
+		if err != nil {
+			return s.authFailed(err)
+		}
+		return s.loginResponse(s.loginWithMailbox(s.user, mailbox))
+	}
+	if authProvider, ok := s.authorizer.(AuthProvider); ok {
+		mailbox, err := authProvider.Authenticate(s.user, cmd.args[0])
+		if err != nil {
+			return s.authFailed(err)
+		}
+		return s.loginResponse(s.loginWithMailbox(s.user, mailbox))
+	}
 	err := s.authorizer.UserPass(s.user, cmd.args[0])
 	if err != nil {
-		return s.writeResponseLine("", err)
+		return s.authFailed(err)
 	}
-	mailbox, err := s.mboxProvider.Provide(s.user)
-	if err == nil {
-		s.mailbox = mailbox
-		s.state = transactionState // if user and password are correct
-		s.msgCount, _, err = s.mailbox.Stat()
+	return s.loginResponse(s.login(s.user))
+}
+
+func (s *Session) handleRpop(cmd command) error {
+	rpopAuthorizer, ok := s.authorizer.(RpopAuthorizer)
+	if !s.EnableRpop || !ok {
+		return s.writeResponseLine("", ErrCommandNotSupported)
+	}
+	if s.tlsRequired() {
+		return s.writeResponseLine("", ErrTLSRequired)
+	}
+	if s.user == "" {
+		return s.writeResponseLine("", ErrUserNotSpecified)
+	}
+	if err := rpopAuthorizer.Rpop(s.user, cmd.args[0]); err != nil {
+		return s.authFailed(err)
+	}
+	return s.loginResponse(s.login(s.user))
+}
+
+// handleXlogin logs in the user asserted by trusted relay.
+func (s *Session) handleXlogin(cmd command) error {
+	trustedAuthorizer, ok := s.authorizer.(TrustedAuthorizer)
+	if !ok || !s.fromTrustedNetwork() {
+		return s.writeResponseLine("", ErrCommandNotAvailable)
+	}
+	if s.tlsRequired() {
+		return s.writeResponseLine("", ErrTLSRequired)
+	}
+	user := s.normalizeUser(cmd.args[0])
+	if err := trustedAuthorizer.Trust(user); err != nil {
+		return s.authFailed(err)
 	}
-	return s.writeResponseLine("logged in", err)
+	s.user = user
+	return s.loginResponse(s.login(user))
 }
 
+// handleApop authenticates the user with APOP. It's rejected after STLS,
+// the challenge from greeting was exposed, SASL should be used instead.
 func (s *Session) handleApop(cmd command) error {
-	if len(cmd.args) != 2 {
-		return s.writeLine("-ERR invalid arguments\r\n")
+	if s.tlsRequired() {
+		return s.writeResponseLine("", ErrTLSRequired)
 	}
-	user := cmd.args[0]
+	if s.bannerExposed {
+		return s.writeResponseLine("", ErrApopAfterStls)
+	}
+	if !s.apopEnabled {
+		return s.writeResponseLine("", ErrNotSupportedAuthMethod)
+	}
+	if s.timestampBanner == "" {
+		return s.writeResponseLine("", ErrApopChallengeExpired)
+	}
+	user := s.normalizeUser(cmd.args[0])
 	err := s.authorizer.Apop(user, s.timestampBanner, cmd.args[1])
 	if err != nil {
-		return s.writeResponseLine("", err)
-	}
-	mailbox, err := s.mboxProvider.Provide(user)
-	if err == nil {
-		s.mailbox = mailbox
-		s.state = transactionState // if user and password are correct
-		s.msgCount, _, err = s.mailbox.Stat()
+		if s.InvalidateBannerOnApopFailure {
+			s.timestampBanner = ""
+		}
+		return s.authFailed(err)
 	}
-
-	return s.writeResponseLine("logged in", err)
+	s.user = user
+	return s.loginResponse(s.login(user))
 }
 
+// handleCapa sends capabilities (RFC 2449), the list is terminated
+// with "." even if all optional capabilities are disabled.
 func (s *Session) handleCapa(_ command) error {
 	err := s.writeResponseLine("Capability list follows", nil)
 	if err != nil {
 		return err
 	}
-	if s.userPassEnabled {
-		if err := s.writeLine("USER\r\n"); err != nil {
+	if s.stlsEnabled() {
+		if err := s.writeLine("STLS\r\n"); err != nil {
 			return err
 		}
 	}
-	return s.writeLine("TOP\r\nUIDL\r\n.\r\n")
-}
-
-func (s *Session) handleQuit(_ command) error {
-	s.state = updateState
-	return s.Close()
-}
-
-func (s *Session) handleUidl(cmd command) error {
-	if cmd.oneNumArg() {
-		n := cmd.numArgs[0]
-		if s.isMarkedAsDeleted(n) {
-			return s.writeResponseLine("", ErrMessageMarkedAsDeleted)
-		}
-		if n > s.msgCount {
-			return s.writeResponseLine("", ErrInvalidArgument)
+	if s.userPassEnabled && !s.tlsRequired() {
+		if err := s.writeLine("USER\r\n"); err != nil {
+			return err
 		}
-		uidl, err := s.mailbox.UidlOne(n)
-		return s.writeResponseLine(fmt.Sprintf("%d %s", n+1, uidl), err)
 	}
-
-	uidlList, err := s.mailbox.Uidl()
-	if errSend := s.writeResponseLine(fmt.Sprintf("%d messages in mailbox", len(uidlList)), err); errSend != nil {
-		return errSend
+	if mechanisms := s.saslMechanisms(); len(mechanisms) > 0 {
+		if err := s.writeLine("SASL " + strings.Join(mechanisms, " ") + "\r\n"); err != nil {
+			return err
+		}
 	}
-
-	for i, uidl := range uidlList {
-		if errSend := s.writeLine(fmt.Sprintf("%d %s\r\n", i+1, uidl)); errSend != nil {
-			return errSend
+	for _, name := range []string{topCmd, uidlCmd} {
+		if !s.commandEnabled(name) {
+			continue
+		}
+		if err := s.writeLine(name + "\r\n"); err != nil {
+			return err
 		}
 	}
-	return s.writeLine(".\r\n")
+	// extended response codes, e.g. [IN-USE] or [SYS/TEMP] (RFC 2449)
+	if err := s.writeLine("RESP-CODES\r\n"); err != nil {
+		return err
+	}
+	// [AUTH] response code of failed authentication (RFC 3206)
+	if err := s.writeLine("AUTH-RESP-CODE\r\n"); err != nil {
+		return err
+	}
+	if s.Implementation != "" {
+		if err := s.writeLine("IMPLEMENTATION " + s.Implementation + "\r\n"); err != nil {
+			return err
+		}
+	}
+	return s.writeLine(".\r\n")
 }
 
-func (s *Session) handleTop(cmd command) error {
-	if !cmd.twoNumArgs() {
-		return s.writeLine("-ERR invalid arguments\r\n")
+func (s *Session) handleAuth(cmd command) error {
+	if s.tlsRequired() {
+		return s.writeResponseLine("", ErrTLSRequired)
 	}
-	n, nLines := cmd.numArgs[0], cmd.numArgs[1]
+	mechanism := strings.ToUpper(cmd.args[0])
+	if !slices.Contains(s.saslMechanisms(), mechanism) {
+		return s.writeResponseLine("", ErrNotSupportedAuthMethod)
+	}
+
+	var response string
+	if len(cmd.args) > 1 {
+		response = cmd.args[1]
+	} else {
+		var err error
+		if response, err = s.readContinuation(""); errors.Is(err, ErrAuthenticationAborted) {
+			return s.writeResponseLine("", err)
+		} else if err != nil {
+			return err
+		}
+	}
+
+	decoded, err := decodeSaslResponse(response)
+	if err != nil {
+		return s.writeResponseLine("", err)
+	}
+
+	switch mechanism {
+	case xoauth2Mechanism:
+		return s.authXoauth2(decoded)
+	default:
+		return s.authExternal(decoded)
+	}
+}
 
-	if n > s.msgCount {
+// authExternal completes AUTH EXTERNAL with authorization identity
+// sent by the client (empty means identity from client certificate).
+func (s *Session) authExternal(user string) error {
+	tlsState, _ := s.tlsConnectionState()
+	if user == "" {
+		user = tlsState.PeerCertificates[0].Subject.CommonName
+	}
+	user = s.normalizeUser(user)
+
+	if err := s.authorizer.(ExternalAuthorizer).External(s.backendContext(), user); err != nil {
+		return s.authFailed(err)
+	}
+	s.user = user
+	return s.loginResponse(s.login(user))
+}
+
+// authXoauth2 completes AUTH XOAUTH2 with decoded client response.
+//
+// On failure the error status is sent as continuation and the client
+// is expected to respond with empty line before the final -ERR.
+func (s *Session) authXoauth2(response string) error {
+	user, token, ok := parseXoauth2Response(response)
+	if !ok {
 		return s.writeResponseLine("", ErrInvalidArgument)
 	}
-	if s.isMarkedAsDeleted(n) {
-		return s.writeResponseLine("", ErrMessageMarkedAsDeleted)
+	user = s.normalizeUser(user)
+	if err := s.authorizer.(OAuthAuthorizer).OAuth(user, token); err != nil {
+		if _, errRead := s.readContinuation(xoauth2ErrorStatus); errRead != nil && !errors.Is(errRead, ErrAuthenticationAborted) {
+			return errRead
+		}
+		return s.authFailed(err)
 	}
+	s.user = user
+	return s.loginResponse(s.login(user))
+}
 
-	r, err := s.mailbox.Message(n)
-	if errSend := s.writeResponseLine("message body", err); errSend != nil {
+func (s *Session) handleStls(_ command) error {
+	if !s.stlsEnabled() {
+		return s.writeResponseLine("", ErrTLSNotAvailable)
+	}
+	if err := s.writeResponseLine("begin TLS negotiation", nil); err != nil {
+		return err
+	}
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+
+	conn := s.conn.(net.Conn)
+	if s.ConnectionTimeout > 0 {
+		// deadline set for reading STLS command applies to handshake
+		conn.SetReadDeadline(time.Now().Add(s.ConnectionTimeout))
+	}
+	tlsConn := tls.Server(conn, s.TLSConfig)
+	if err := tlsConn.HandshakeContext(s.ctx); err != nil {
+		return err
+	}
+
+	// any plaintext data buffered after STLS command is discarded (RFC 2595)
+	s.conn = tlsConn
+	s.stats.bytesIn.r = tlsConn
+	s.stats.bytesOut.w = tlsConn
+	s.r.Reset(&s.stats.bytesIn)
+	s.w.Reset(&s.stats.bytesOut)
+	s.skipLF = false
+	s.bannerExposed = true
+	return nil
+}
+
+func (s *Session) handleQuit(_ command) error {
+	s.state = UpdateState
+	return s.Close()
+}
+
+// handleUidl sends unique-ids of messages. Messages marked as deleted are
+// skipped, the rest keep their original numbers (RFC 1939).
+func (s *Session) handleUidl(cmd command) error {
+	if len(cmd.args) > 0 && !cmd.oneNumArg() {
+		return s.writeResponseLine("", ErrInvalidArgument)
+	}
+	if cmd.oneNumArg() {
+		n := cmd.numArgs[0]
+		if err := s.checkMessage(n); err != nil {
+			return s.writeResponseLine("", err)
+		}
+		uidl, err := s.mailbox.UidlOne(n)
+		return s.writeResponseLine(fmt.Sprintf("%d %s", n+1, uidl), err)
+	}
+	if seqMailbox, ok := s.mailbox.(SeqMailbox); ok {
+		return writeSeqListing(s, seqMailbox.UidlSeq())
+	}
+
+	uidlList, err := s.mailbox.Uidl()
+	if err == nil {
+		err = s.checkListLength(len(uidlList))
+	}
+	if errSend := s.writeResponseLine(fmt.Sprintf("%d messages in mailbox", len(uidlList)-len(s.toDelete)), err); errSend != nil {
 		return errSend
 	}
 	if err != nil {
 		return nil
 	}
 
-	if errSend := copyHeadersAndBody(s.conn, r, nLines); errSend != nil {
+	for i, uidl := range uidlList {
+		if s.isMarkedAsDeleted(i) {
+			continue
+		}
+		if errSend := s.writeLine(fmt.Sprintf("%d %s\r\n", i+1, uidl)); errSend != nil {
+			return errSend
+		}
+	}
+	return s.writeLine(".\r\n")
+}
+
+func (s *Session) handleTop(cmd command) error {
+	if !cmd.twoNumArgs() {
+		return s.writeResponseLine("", ErrInvalidArgument)
+	}
+	n, nLines := cmd.numArgs[0], cmd.numArgs[1]
+	if err := s.checkMessage(n); err != nil {
+		return s.writeResponseLine("", err)
+	}
+
+	r, err := s.mailbox.Message(n)
+	if errSend := s.writeResponseLine("message body", err); errSend != nil {
 		return errSend
 	}
+	if err != nil {
+		return nil
+	}
+
+	errCopy := copyHeadersAndBody(s.w, r, nLines)
 	r.Close()
+	if errCopy != nil {
+		return errCopy
+	}
 
 	return s.writeLine(".\r\n")
 }
 
+// handleNoop responds with [Session.NoopResponse]. Like any other
+// command, NOOP restarts [Session.ConnectionTimeout], so clients
+// can use it to keep idle session alive.
 func (s *Session) handleNoop(_ command) error {
-	return s.writeResponseLine("noop", nil)
+	return s.writeResponseLine(s.NoopResponse, s.refreshMailbox())
 }
 
 func (s *Session) handleRset(_ command) error {
-	clear(s.toDelete)
+	s.resetTransaction()
 	return s.writeResponseLine("maildrop has been reset", nil)
 }
 
 func (s *Session) handleDele(cmd command) error {
-	if !cmd.oneNumArg() || cmd.numArgs[0] > s.msgCount {
-		return s.writeLine("-ERR invalid arguments\r\n")
+	if !cmd.oneNumArg() {
+		return s.writeResponseLine("", ErrInvalidArgument)
 	}
 
 	n := cmd.numArgs[0]
-	if s.isMarkedAsDeleted(n) {
-		return s.writeResponseLine("", ErrMessageMarkedAsDeleted)
+	if err := s.checkMessage(n); err != nil {
+		return s.writeResponseLine("", err)
 	}
 
+	s.infoMu.Lock()
 	s.toDelete[n] = struct{}{}
+	s.infoMu.Unlock()
 	return s.writeResponseLine("message deleted", nil)
 }
 
 func (s *Session) handleRetr(cmd command) error {
-	if !cmd.oneNumArg() || cmd.numArgs[0] > s.msgCount {
-		return s.writeLine("-ERR invalid arguments\r\n")
+	if !cmd.oneNumArg() {
+		return s.writeResponseLine("", ErrInvalidArgument)
 	}
 
 	n := cmd.numArgs[0]
-	if s.isMarkedAsDeleted(n) {
-		return s.writeResponseLine("", ErrMessageMarkedAsDeleted)
+	if err := s.checkMessage(n); err != nil {
+		return s.writeResponseLine("", err)
 	}
 
+	okResponse := fmt.Sprintf("message body #%v", n+1)
+	if s.RetrSizeInResponse {
+		if size, errSize := s.messageSize(n); errSize == nil {
+			okResponse = fmt.Sprintf("%d octets", size)
+		}
+	}
+
+	if s.ContinueOnRetrError {
+		// pending output (e.g. announcements) is sent,
+		// so it isn't dropped with failed response
+		if err := s.w.Flush(); err != nil {
+			return err
+		}
+	}
+	bytesOut := s.BytesOut()
+
 	r, err := s.mailbox.Message(n)
-	if errSend := s.writeResponseLine(fmt.Sprintf("message body #%v", n+1), err); errSend != nil {
+	if errSend := s.writeResponseLine(okResponse, err); errSend != nil {
 		return errSend
 	}
 	if err != nil {
 		return nil
 	}
 
-	dotWriter := textproto.NewWriter(bufio.NewWriter(s.conn)).DotWriter()
+	// DotWriter converts line endings to CRLF, dot-stuffs lines and on Close
+	// completes the last line (if message doesn't end with newline) before
+	// the terminating dot line
+	dotWriter := textproto.NewWriter(s.w).DotWriter()
 	_, errCopy := io.Copy(dotWriter, r)
 	errCloseR := r.Close()
-	errCloseW := dotWriter.Close()
-	return errors.Join(errCopy, errCloseR, errCloseW)
+	var errCloseW error
+	if errCopy == nil {
+		// on error the terminating dot line isn't sent, so the truncated
+		// message isn't taken as complete (like in TOP), the session ends
+		// or, with ContinueOnRetrError, the response can be replaced
+		errCloseW = dotWriter.Close()
+	}
+	err = errors.Join(errCopy, errCloseR, errCloseW)
+	if err == nil {
+		s.stats.retrieved++
+		return nil
+	}
+	if s.ContinueOnRetrError && s.BytesOut() == bytesOut {
+		// nothing has been sent, the response can be replaced
+		s.logf("Sending message %d to %q failed: %v", n+1, s.user, err)
+		s.w.Reset(&s.stats.bytesOut)
+		return s.writeResponseLine("", ErrMessageNotSent)
+	}
+	return err
 }
 
+// handleStat sends number and total size of messages not marked
+// as deleted. With DisableSizesCache live data of [Mailbox.Stat] are
+// used, sizes of messages marked as deleted are subtracted.
 func (s *Session) handleStat(_ command) error {
-	n, size, err := s.mailbox.Stat()
-	return s.writeResponseLine(fmt.Sprintf("%d %d", n, size), err)
+	if s.DisableSizesCache {
+		n, size, err := s.mailbox.Stat()
+		if err != nil {
+			return s.writeResponseLine("", err)
+		}
+		if size >= 0 {
+			for msg := range s.toDelete {
+				msgSize, err := s.mailbox.ListOne(msg)
+				if err != nil {
+					return s.writeResponseLine("", err)
+				}
+				size -= msgSize
+			}
+			return s.writeResponseLine(fmt.Sprintf("%d %d", n-len(s.toDelete), size), nil)
+		}
+		// the backend can't sum sizes, they're computed from List
+	}
+
+	sizes, err := s.messageSizes()
+	if err != nil {
+		return s.writeResponseLine("", err)
+	}
+
+	n, size := 0, 0
+	for i, msgSize := range sizes {
+		if !s.isMarkedAsDeleted(i) {
+			n++
+			size += msgSize
+		}
+	}
+	return s.writeResponseLine(fmt.Sprintf("%d %d", n, size), nil)
 }
 
+// handleList sends sizes of messages. Messages marked as deleted are
+// skipped, the rest keep their original numbers (RFC 1939).
 func (s *Session) handleList(cmd command) error {
+	if len(cmd.args) > 0 && !cmd.oneNumArg() {
+		return s.writeResponseLine("", ErrInvalidArgument)
+	}
 	if cmd.oneNumArg() {
 		n := cmd.numArgs[0]
-		if s.isMarkedAsDeleted(n) {
-			return s.writeResponseLine("", ErrMessageMarkedAsDeleted)
+		if err := s.checkMessage(n); err != nil {
+			return s.writeResponseLine("", err)
 		}
-		if n > s.msgCount {
-			return s.writeResponseLine("", ErrInvalidArgument)
-		}
-		size, err := s.mailbox.ListOne(n)
+		size, err := s.messageSize(n)
 		return s.writeResponseLine(fmt.Sprintf("%d %d", n+1, size), err)
 	}
+	if seqMailbox, ok := s.mailbox.(SeqMailbox); ok && s.DisableSizesCache {
+		return writeSeqListing(s, seqMailbox.ListSeq())
+	}
 
-	list, err := s.mailbox.List()
-	if errSend := s.writeResponseLine(fmt.Sprintf("%d messages in mailbox", len(list)), err); errSend != nil {
+	list, err := s.messageSizes()
+	if err == nil {
+		err = s.checkListLength(len(list))
+	}
+	if errSend := s.writeResponseLine(fmt.Sprintf("%d messages in mailbox", len(list)-len(s.toDelete)), err); errSend != nil {
 		return errSend
 	}
+	if err != nil {
+		return nil
+	}
 	for i, size := range list {
+		if s.isMarkedAsDeleted(i) {
+			continue
+		}
 		if errSend := s.writeLine(fmt.Sprintf("%d %d\r\n", i+1, size)); errSend != nil {
 			return errSend
 		}
@@ -368,42 +1414,752 @@ func (s *Session) handleList(cmd command) error {
 	return s.writeLine(".\r\n")
 }
 
+// writeSeqListing sends multi-line LIST or UIDL response with entries
+// yielded by seq (see [SeqMailbox]) as they come. Messages marked
+// as deleted are skipped. At most msgCount entries are taken (it's
+// within MaxListEntries, checked upfront), if seq yields fewer,
+// the listing isn't terminated and [ErrIncompleteListing] is returned.
+func writeSeqListing[V any](s *Session, seq iter.Seq2[int, V]) error {
+	err := s.checkListLength(s.msgCount)
+	if errSend := s.writeResponseLine(fmt.Sprintf("%d messages in mailbox", s.msgCount-len(s.toDelete)), err); errSend != nil || err != nil {
+		return errSend
+	}
+	yielded := 0
+	for i, v := range seq {
+		if yielded == s.msgCount {
+			s.logf("Mailbox of %q yielded more than %d entries, the rest is ignored", s.user, s.msgCount)
+			break
+		}
+		yielded++
+		if s.isMarkedAsDeleted(i) {
+			continue
+		}
+		if errSend := s.writeLine(fmt.Sprintf("%d %v\r\n", i+1, v)); errSend != nil {
+			return errSend
+		}
+	}
+	if yielded < s.msgCount {
+		s.logf("Mailbox of %q yielded %d of %d entries", s.user, yielded, s.msgCount)
+		// without terminating line the client can't take it as complete
+		return ErrIncompleteListing
+	}
+	return s.writeLine(".\r\n")
+}
+
 // #endregion
 
 // #region Helpers
-func generateTimestampBanner() string {
-	hostName, err := os.Hostname()
-	if err != nil {
-		hostName = "localhost"
+func (s *Session) generateTimestampBanner() string {
+	if s.TimestampBannerGenerator != nil {
+		banner := s.TimestampBannerGenerator()
+		if isValidTimestampBanner(banner) {
+			return banner
+		}
+		s.logf("Invalid timestamp banner %q, using default one", banner)
+	}
+	return generateTimestampBanner(s.BannerHostname)
+}
+
+// isValidTimestampBanner checks if the banner has form of msg-id: <...@...>.
+func isValidTimestampBanner(banner string) bool {
+	inner, ok := strings.CutPrefix(banner, "<")
+	if !ok {
+		return false
+	}
+	inner, ok = strings.CutSuffix(inner, ">")
+	if !ok || strings.ContainsAny(inner, "<> \t\r\n") {
+		return false
 	}
-	return fmt.Sprintf("<%d.%d@%s>", os.Getpid(), time.Now().UnixMicro(), hostName)
+	local, domain, found := strings.Cut(inner, "@")
+	return found && local != "" && domain != ""
 }
 
+func generateTimestampBanner(hostName string) string {
+	if hostName == "" {
+		var err error
+		if hostName, err = os.Hostname(); err != nil {
+			hostName = "localhost"
+		}
+	}
+	return fmt.Sprintf("<%d.%d@%s>", os.Getpid(), time.Now().UnixMicro(), sanitizeHostname(hostName))
+}
+
+// sanitizeHostname replaces characters not allowed in RFC 822 msg-id
+// domain (only letters, digits, dots and hyphens are kept) with hyphens,
+// so strict APOP clients accept the banner.
+func sanitizeHostname(hostName string) string {
+	hostName = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-':
+			return r
+		default:
+			return '-'
+		}
+	}, hostName)
+	if strings.Trim(hostName, ".-") == "" {
+		return "localhost"
+	}
+	return hostName
+}
+
+// readCommand reads and parses client's command. Lines sent by the client
+// aren't dot-stuffed (RFC 1939 dot-stuffing applies only to server's
+// multi-line responses), so a bare "." is an unknown command.
+// Blank lines (sent by some clients as keepalive) are ignored without
+// response, so responses of pipelined commands stay in order.
 func (s *Session) readCommand() (cmd command, err error) {
-	line, err := s.r.ReadString('\n')
-	if err != nil {
-		return
+	line := ""
+	for strings.TrimSpace(line) == "" {
+		line, err = s.readLine()
+		if err != nil {
+			return
+		}
 	}
-	line = strings.TrimRight(line, "\r\n")
-	log.Printf("S->C: %v", line)
 	cmd.parse(line)
 	return
 }
 
+// readLine reads one line from the client without line terminator
+// within ConnectionTimeout. Read deadline is used if the connection
+// supports it, otherwise pending read is abandoned after the timeout.
+// Buffered responses have to be sent by the caller before.
+func (s *Session) readLine() (string, error) {
+	timeout := s.readTimeout()
+	if conn, ok := s.conn.(interface{ SetReadDeadline(t time.Time) error }); ok {
+		var deadline time.Time
+		if timeout > 0 {
+			deadline = time.Now().Add(timeout)
+		}
+		if err := conn.SetReadDeadline(deadline); err != nil {
+			return "", err
+		}
+		return s.readLineNoTimeout()
+	}
+	line, err := timeoutCall(s.readLineNoTimeout, timeout)
+	if errors.Is(err, context.DeadlineExceeded) {
+		s.readAbandoned = true
+	}
+	return line, err
+}
+
+// readTimeout returns ConnectionTimeout, shortened to the time left
+// to AuthTimeout in the authorization state.
+func (s *Session) readTimeout() time.Duration {
+	if s.authDeadline.IsZero() || s.state != AuthorizationState {
+		return s.ConnectionTimeout
+	}
+	left := max(time.Until(s.authDeadline), time.Nanosecond)
+	if s.ConnectionTimeout > 0 {
+		return min(left, s.ConnectionTimeout)
+	}
+	return left
+}
+
+// authTimedOut reports if AuthTimeout elapsed in the authorization state.
+func (s *Session) authTimedOut() bool {
+	return !s.authDeadline.IsZero() && s.state == AuthorizationState && !time.Now().Before(s.authDeadline)
+}
+
+// readLineNoTimeout reads one line from the client without line terminator.
+//
+// Lines terminated with CRLF, bare LF or lone CR are accepted.
+// After lone CR it doesn't wait for the next byte, so the client
+// expecting response isn't blocked; LF arriving later is skipped.
+func (s *Session) readLineNoTimeout() (string, error) {
+	var buf []byte
+	for {
+		b, err := s.r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if s.skipLF {
+			s.skipLF = false
+			if b == '\n' {
+				continue
+			}
+		}
+		if b == '\n' {
+			break
+		}
+		if b == '\r' {
+			// consume LF of CRLF if it's already here
+			if s.r.Buffered() > 0 {
+				if next, _ := s.r.Peek(1); next[0] == '\n' {
+					s.r.ReadByte()
+				}
+			} else {
+				s.skipLF = true
+			}
+			break
+		}
+		buf = append(buf, b)
+	}
+	line := string(buf)
+	if s.Verbose {
+		s.logf("C->S: %v", line)
+	}
+	return line, nil
+}
+
+// readContinuation sends SASL continuation with base64 encoded challenge
+// and reads client's response line (still base64 encoded) with the same
+// timeout as commands. It returns [ErrAuthenticationAborted] if the client
+// cancelled the authentication with "*" (RFC 5034). The response is
+// a single line, so it isn't dot-unstuffed either; "." isn't valid base64.
+func (s *Session) readContinuation(challenge string) (string, error) {
+	if err := s.writeLine("+ " + base64.StdEncoding.EncodeToString([]byte(challenge)) + "\r\n"); err != nil {
+		return "", err
+	}
+	if err := s.w.Flush(); err != nil {
+		return "", err
+	}
+	line, err := s.readLine()
+	if err != nil {
+		return "", err
+	}
+	if line == "*" {
+		return "", ErrAuthenticationAborted
+	}
+	return line, nil
+}
+
 func (s *Session) writeLine(line string) error {
-	log.Printf("C->S: %v", line)
-	_, err := s.conn.Write([]byte(line))
+	if s.Verbose {
+		s.logf("S->C: %v", line)
+	}
+	_, err := s.w.WriteString(line)
 	return err
 }
 
+// writeResponseLine sends status line: -ERR with err if it's not nil,
+// otherwise +OK with okResponse.
 func (s *Session) writeResponseLine(okResponse string, err error) error {
-	var line string
+	return s.writeLine(statusLine(okResponse, err))
+}
+
+// statusLine formats status line (RFC 1939): status indicator,
+// optionally followed by space and text, terminated with CRLF.
+// All status lines sent by [Session] and [Server] are formatted here.
+func statusLine(okResponse string, err error) string {
+	status, text := "+OK", okResponse
+	if err != nil {
+		status, text = "-ERR", err.Error()
+	}
+	if text == "" {
+		return status + "\r\n"
+	}
+	return status + " " + text + "\r\n"
+}
+
+// backendContext returns context passed to backends, it carries
+// TLS connection state if the connection is encrypted.
+func (s *Session) backendContext() context.Context {
+	if tlsState, ok := s.tlsConnectionState(); ok {
+		return contextWithTLSState(s.ctx, tlsState)
+	}
+	return s.ctx
+}
+
+// tlsConnectionState returns TLS connection state if the session
+// connection is a TLS connection.
+func (s *Session) tlsConnectionState() (tls.ConnectionState, bool) {
+	if tlsConn, ok := s.conn.(interface {
+		ConnectionState() tls.ConnectionState
+	}); ok {
+		return tlsConn.ConnectionState(), true
+	}
+	return tls.ConnectionState{}, false
+}
+
+// stlsEnabled checks if STLS command is available: TLS is configured
+// and the connection isn't encrypted yet.
+func (s *Session) stlsEnabled() bool {
+	if _, ok := s.conn.(net.Conn); !ok || s.TLSConfig == nil || !s.commandEnabled(stlsCmd) {
+		return false
+	}
+	_, isTLS := s.tlsConnectionState()
+	return !isTLS
+}
+
+// tlsRequired checks if authentication commands have to be rejected
+// because the connection isn't encrypted yet.
+func (s *Session) tlsRequired() bool {
+	_, isTLS := s.tlsConnectionState()
+	return s.RequireTLS && !isTLS
+}
+
+// externalEnabled checks if AUTH EXTERNAL is available: authorizer
+// supports it and the client presented verified certificate.
+func (s *Session) externalEnabled() bool {
+	if _, ok := s.authorizer.(ExternalAuthorizer); !ok {
+		return false
+	}
+	tlsState, ok := s.tlsConnectionState()
+	return ok && len(tlsState.VerifiedChains) > 0 && len(tlsState.PeerCertificates) > 0
+}
+
+// saslMechanisms returns SASL mechanisms available for AUTH command.
+func (s *Session) saslMechanisms() []string {
+	if !s.commandEnabled(authCmd) {
+		return nil
+	}
+	var mechanisms []string
+	if s.externalEnabled() {
+		mechanisms = append(mechanisms, externalMechanism)
+	}
+	if _, ok := s.authorizer.(OAuthAuthorizer); ok {
+		mechanisms = append(mechanisms, xoauth2Mechanism)
+	}
+	return mechanisms
+}
+
+// parseXoauth2Response parses XOAUTH2 client response:
+// "user=" user "\x01auth=Bearer " token "\x01\x01".
+func parseXoauth2Response(response string) (user, token string, ok bool) {
+	rest, ok := strings.CutSuffix(response, "\x01\x01")
+	if !ok {
+		return "", "", false
+	}
+	for _, field := range strings.Split(rest, "\x01") {
+		key, value, _ := strings.Cut(field, "=")
+		switch key {
+		case "user":
+			user = value
+		case "auth":
+			scheme, credentials, _ := strings.Cut(value, " ")
+			if strings.EqualFold(scheme, "Bearer") {
+				token = credentials
+			}
+		}
+	}
+	return user, token, user != "" && token != ""
+}
+
+// decodeSaslResponse decodes base64 encoded SASL client response,
+// "=" stands for empty response (RFC 5034).
+func decodeSaslResponse(response string) (string, error) {
+	if response == "=" {
+		return "", nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(response)
+	if err != nil {
+		return "", ErrInvalidArgument
+	}
+	return string(decoded), nil
+}
+
+// fromTrustedNetwork reports if the client's address
+// belongs to any of TrustedNetworks.
+func (s *Session) fromTrustedNetwork() bool {
+	ip, err := clientIP(remoteAddr(s.conn))
+	if err != nil {
+		return false
+	}
+	for _, network := range s.TrustedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// loginResponse responds to login attempt with result err. Successful
+// login response warns if the user is close to quota, see [QuotaMailbox].
+func (s *Session) loginResponse(err error) error {
+	if err != nil {
+		return s.writeResponseLine("", err)
+	}
+	return s.writeResponseLine("logged in"+s.quotaWarning(), nil)
+}
+
+// quotaWarning returns warning appended to login response if the mailbox
+// is [QuotaMailbox] and at least 90% of the quota is used.
+func (s *Session) quotaWarning() string {
+	quotaMailbox, ok := s.mailbox.(QuotaMailbox)
+	if !ok {
+		return ""
+	}
+	used, limit, err := quotaMailbox.Quota()
+	if err != nil {
+		s.logf("Getting quota of %q failed: %v", s.user, err)
+		return ""
+	}
+	if limit <= 0 || used*10 < limit*9 {
+		return ""
+	}
+	if used >= limit {
+		return fmt.Sprintf(", over quota (%d of %d octets used)", used, limit)
+	}
+	return fmt.Sprintf(", %d%% of quota used (%d of %d octets)", used*100/limit, used, limit)
+}
+
+// normalizeUser applies UsernameNormalizer to user name.
+func (s *Session) normalizeUser(user string) string {
+	if s.UsernameNormalizer == nil {
+		return user
+	}
+	return s.UsernameNormalizer(user)
+}
+
+// login opens the mailbox for already authorized user
+// and switches the session to the transaction state.
+func (s *Session) login(user string) error {
+	if !s.lockMailbox(user) {
+		return ErrMailboxLocked
+	}
+	var mailbox Mailbox
+	var err error
+	if provider, ok := s.mboxProvider.(ContextMailboxProvider); ok {
+		mailbox, err = provider.ProvideContext(s.backendContext(), user)
+	} else {
+		mailbox, err = s.mboxProvider.Provide(user)
+	}
+	if err != nil {
+		s.unlockMailbox()
+		s.logf("Providing mailbox of %q failed: %v", user, err)
+		if errors.Is(err, ErrTemporaryFailure) {
+			return ErrTemporaryFailure
+		}
+		return ErrNoSuchMailbox
+	}
+	return s.openMailbox(user, mailbox)
+}
+
+// loginWithMailbox is like login, but for the mailbox already
+// returned by [AuthProvider].
+func (s *Session) loginWithMailbox(user string, mailbox Mailbox) error {
+	if !s.lockMailbox(user) {
+		mailbox.Close()
+		return ErrMailboxLocked
+	}
+	return s.openMailbox(user, mailbox)
+}
+
+// openMailbox locks the mailbox if it's [LockableMailbox] and enters
+// the transaction state. The per-user lock has to be acquired before,
+// it's released if the mailbox can't be opened.
+func (s *Session) openMailbox(user string, mailbox Mailbox) error {
+	var err error
+	if lockable, ok := mailbox.(LockableMailbox); ok {
+		if err := lockable.Lock(); err != nil {
+			s.logf("Locking mailbox of user %q failed: %v", user, err)
+			mailbox.Close()
+			s.unlockMailbox()
+			return ErrMailboxLocked
+		}
+	}
+	s.mailbox = mailbox
+	if s.msgCount, _, err = s.mailbox.Stat(); err == nil && !s.DisableSizesCache {
+		_, err = s.messageSizes()
+	}
+	if err != nil {
+		// stay in the authorization state, the client isn't logged in
+		s.closeMailbox()
+		s.mailbox = nil
+		s.msgCount = 0
+		s.invalidateSizes()
+		s.unlockMailbox()
+		return err
+	}
+	s.state = TransactionState
+	s.emit(AuthenticatedEvent{User: user})
+	return nil
+}
+
+// refreshMailbox updates the snapshot of [RefreshableMailbox]. It's kept
+// if any message is marked as deleted, as refresh could renumber them.
+func (s *Session) refreshMailbox() error {
+	refreshable, ok := s.mailbox.(RefreshableMailbox)
+	if !ok || len(s.toDelete) > 0 {
+		return nil
+	}
+	msgCount, _, err := refreshable.Refresh()
+	if err != nil {
+		return err
+	}
+	s.msgCount = msgCount
+	s.invalidateSizes()
+	return nil
+}
+
+// closeMailbox closes the mailbox and, if it's [LockableMailbox],
+// unlocks it after that, so changes made on Close are still done
+// with the lock held.
+func (s *Session) closeMailbox() error {
+	err := s.mailbox.Close()
+	if lockable, ok := s.mailbox.(LockableMailbox); ok {
+		if errUnlock := lockable.Unlock(); err == nil {
+			err = errUnlock
+		}
+	}
+	return err
+}
+
+// lockMailbox acquires exclusive access to user's mailbox,
+// it returns false if the mailbox is locked by another session.
+func (s *Session) lockMailbox(user string) bool {
+	if s.lockUser == nil {
+		return true
+	}
+	if !s.lockUser(user) {
+		return false
+	}
+	s.lockedUser = user
+	return true
+}
+
+// unlockMailbox releases the lock acquired with lockMailbox, if any.
+func (s *Session) unlockMailbox() {
+	if s.lockedUser == "" {
+		return
+	}
+	s.unlockUser(s.lockedUser)
+	s.lockedUser = ""
+}
+
+// messageSizes returns sizes of all messages in the mailbox.
+// Sizes are fetched from the mailbox once and cached until RSET
+// unless the cache is disabled.
+func (s *Session) messageSizes() ([]int, error) {
+	if s.DisableSizesCache {
+		return s.mailbox.List()
+	}
+	if !s.sizesCached {
+		sizes, err := s.mailbox.List()
+		if err != nil {
+			return nil, err
+		}
+		s.sizes = sizes
+		s.sizesCached = true
+	}
+	return s.sizes, nil
+}
+
+// messageSize returns size of the message msg, from the cache if possible.
+func (s *Session) messageSize(msg int) (int, error) {
+	if s.DisableSizesCache {
+		return s.mailbox.ListOne(msg)
+	}
+	sizes, err := s.messageSizes()
 	if err != nil {
-		line = fmt.Sprintf("-ERR %s\r\n", err)
+		return 0, err
+	}
+	if msg >= len(sizes) {
+		return 0, ErrInvalidArgument
+	}
+	return sizes[msg], nil
+}
+
+func (s *Session) invalidateSizes() {
+	s.sizes = nil
+	s.sizesCached = false
+}
+
+// resetTransaction restores all session-local transaction state
+// (messages marked as deleted and values derived from them)
+// to the condition just after login.
+func (s *Session) resetTransaction() {
+	s.infoMu.Lock()
+	clear(s.toDelete)
+	s.infoMu.Unlock()
+	s.invalidateSizes()
+}
+
+// authFailed responds to failed authentication attempt after
+// [Session.AuthFailDelay] and terminates the session if there
+// were too many failed attempts.
+//
+// [ErrTemporaryFailure], [ErrAccountDisabled] and [ErrNotSupportedAuthMethod]
+// returned by authorizer aren't counted as failed attempts and aren't
+// delayed, the client hasn't sent wrong credentials. Errors wrapping
+// [ErrAuthFailed], [ErrAccountDisabled] and [ErrTemporaryFailure] are
+// responded with the sentinel error only, so the details (e.g. backend
+// error) aren't revealed to the client.
+func (s *Session) authFailed(err error) error {
+	switch {
+	case errors.Is(err, ErrTemporaryFailure):
+		s.logf("Authentication of %q failed temporarily: %v", s.user, err)
+		return s.writeResponseLine("", ErrTemporaryFailure)
+	case errors.Is(err, ErrAccountDisabled):
+		return s.writeResponseLine("", ErrAccountDisabled)
+	case errors.Is(err, ErrNotSupportedAuthMethod):
+		return s.writeResponseLine("", ErrNotSupportedAuthMethod)
+	case errors.Is(err, ErrAuthFailed):
+		err = ErrAuthFailed
+	}
+	s.authAttempts++
+	s.sleep(s.AuthFailDelay)
+	if s.MaxAuthAttempts > 0 && s.authAttempts >= s.MaxAuthAttempts {
+		return s.abort(ErrTooManyAuthAttempts)
+	}
+	return s.writeResponseLine("", err)
+}
+
+// sleep pauses the session for duration d or until it's interrupted.
+func (s *Session) sleep(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-s.interrupt:
+	case <-s.ctx.Done():
+	}
+}
+
+// waitGreetingDelay waits GreetingDelay before the greeting. If the
+// connection supports read deadlines, it peeks the connection meanwhile
+// (data sent by the client stays buffered), so the client's disconnect
+// ends the wait with error.
+func (s *Session) waitGreetingDelay() error {
+	if s.GreetingDelay <= 0 {
+		return nil
+	}
+	conn, ok := s.conn.(interface{ SetReadDeadline(t time.Time) error })
+	if !ok {
+		s.sleep(s.GreetingDelay)
+		return nil
+	}
+
+	deadline := time.Now().Add(s.GreetingDelay)
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return err
+	}
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-s.interrupt:
+			conn.SetReadDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+	_, err := s.r.Peek(1)
+	close(stop)
+	<-stopped
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// the client has sent data before the greeting, wait the rest of the delay
+	s.sleep(time.Until(deadline))
+	return nil
+}
+
+// logAccess writes summary line of the session to the log.
+func (s *Session) logAccess(err error) {
+	if s.isProbe() && !s.Verbose {
+		return
+	}
+	reason := "quit"
+	if s.state != UpdateState && err != nil {
+		reason = err.Error()
+	}
+	s.logf("Session summary: remote=%s user=%q authenticated=%t retrieved=%d bytes_received=%d bytes_sent=%d duration=%v reason=%q",
+		remoteAddr(s.conn), s.user, s.state != AuthorizationState, s.stats.retrieved, s.BytesIn(), s.BytesOut(),
+		time.Since(s.stats.start).Round(time.Millisecond), reason)
+}
+
+// updateInfo publishes current session state for [Session.Info].
+func (s *Session) updateInfo() {
+	s.infoMu.Lock()
+	defer s.infoMu.Unlock()
+	s.info = SessionInfo{
+		User:        s.user,
+		RemoteAddr:  remoteAddr(s.conn),
+		State:       s.state,
+		ConnectedAt: s.stats.start,
+	}
+}
+
+func (s *Session) logf(format string, v ...any) {
+	loggerOrDefault(s.Logger).Printf(format, v...)
+}
+
+// abort sends reason as -ERR response and closes the connection
+// without entering the UPDATE state. It returns reason.
+func (s *Session) abort(reason error) error {
+	s.writeResponseLine("", reason)
+	s.closeConn()
+	return reason
+}
+
+// closeConn sends buffered responses and closes the connection.
+// With CloseLinger set and connection supporting half-close (TCP, TLS)
+// the write side is shut down first and client's data is read and
+// discarded until the client closes its side or CloseLinger elapses.
+// Closing the socket with unread data makes the kernel reset
+// the connection, which can discard the last response on the way.
+func (s *Session) closeConn() error {
+	s.w.Flush()
+	if s.CloseLinger > 0 {
+		conn, ok := s.conn.(interface {
+			CloseWrite() error
+			SetReadDeadline(t time.Time) error
+		})
+		if ok && conn.CloseWrite() == nil {
+			conn.SetReadDeadline(time.Now().Add(s.CloseLinger))
+			io.Copy(io.Discard, s.conn)
+		}
+	}
+	return s.conn.Close()
+}
+
+// deleteMessages deletes messages marked as deleted from the mailbox.
+// It continues after failed deletion and returns error listing
+// (1-based) numbers of all messages which weren't removed.
+//
+// [BatchDeleter] is preferred if the mailbox implements it,
+// failed batch means none of the messages were removed.
+func (s *Session) deleteMessages() error {
+	var failed []string
+	msgs := slices.Sorted(maps.Keys(s.toDelete))
+	if deleter, ok := s.mailbox.(BatchDeleter); ok && len(msgs) > 0 {
+		if err := deleter.DeleBatch(msgs); err != nil {
+			s.logf("Deleting %d messages of %q failed: %v", len(msgs), s.user, err)
+			for _, msg := range msgs {
+				failed = append(failed, strconv.Itoa(msg+1))
+			}
+		}
 	} else {
-		line = fmt.Sprintf("+OK %s\r\n", okResponse)
+		for _, msg := range msgs {
+			if err := s.mailbox.Dele(msg); err != nil {
+				s.logf("Deleting message %d of %q failed: %v", msg+1, s.user, err)
+				failed = append(failed, strconv.Itoa(msg+1))
+			}
+		}
 	}
-	return s.writeLine(line)
+	if len(failed) > 0 {
+		return fmt.Errorf("%w (%s)", ErrMessagesNotRemoved, strings.Join(failed, " "))
+	}
+	return nil
+}
+
+// checkMessage validates message number msg (0-based) used
+// as argument of command: the message must exist and must not
+// be marked as deleted.
+func (s *Session) checkMessage(msg int) error {
+	if msg < 0 || msg >= s.msgCount {
+		return ErrNoSuchMessage
+	}
+	if s.isMarkedAsDeleted(msg) {
+		return ErrMessageMarkedAsDeleted
+	}
+	return nil
+}
+
+// checkListLength returns [ErrTooManyMessages] if the list
+// returned by the mailbox exceeds MaxListEntries.
+func (s *Session) checkListLength(n int) error {
+	if s.MaxListEntries > 0 && n > s.MaxListEntries {
+		s.logf("Mailbox of %q returned %d entries, limit is %d", s.user, n, s.MaxListEntries)
+		return ErrTooManyMessages
+	}
+	return nil
 }
 
 func (s *Session) isMarkedAsDeleted(msg int) bool {
@@ -411,25 +2167,33 @@ func (s *Session) isMarkedAsDeleted(msg int) bool {
 	return ok
 }
 
-func timeoutCall[T any](fn func() (T, error), timeout time.Duration) (v T, err error) {
+// timeoutCall calls fn and returns [context.DeadlineExceeded]
+// if it doesn't return within timeout (fn still runs then).
+func timeoutCall[T any](fn func() (T, error), timeout time.Duration) (T, error) {
 	if timeout <= 0 {
 		return fn()
 	}
 
-	callDone := make(chan struct{})
+	type result struct {
+		v   T
+		err error
+	}
+	callDone := make(chan result, 1)
 
 	go func() {
-		defer close(callDone)
-		v, err = fn()
+		v, err := fn()
+		callDone <- result{v, err}
 	}()
 
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
 	select {
-	case <-time.After(timeout):
-		err = context.DeadlineExceeded
-	case <-callDone:
+	case <-timer.C:
+		var zero T
+		return zero, context.DeadlineExceeded
+	case r := <-callDone:
+		return r.v, r.err
 	}
-
-	return
 }
 
 // #endregion
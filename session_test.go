@@ -1,15 +1,28 @@
 package pop3srv_test
 
 import (
+	"context"
+	"encoding/base64"
 	"errors"
+	"fmt"
 	"io"
+	"iter"
+	"log"
+	"net"
+	"net/textproto"
+	"os"
+	"regexp"
+	"slices"
 	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/pkierski/pop3srv"
 	"github.com/pkierski/pop3srv/internal/mocks"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -60,47 +73,2270 @@ func (suite *ConnectionTestSuite) TestSessionConnectQuit() {
 	assert.True(suite.T(), suite.conn.Closed)
 }
 
+func (suite *ConnectionTestSuite) TestSessionReadBufferSize() {
+	for _, size := range []int{16, 1024, 64 * 1024} {
+		suite.Run(fmt.Sprint(size), func() {
+			// GIVEN
+			conn := mocks.NewConnMock()
+			conn.LinesToRead = []string{ // pipelined commands in single read
+				"USER " + strings.Repeat("u", 600) + "\r\nNOOP\r\nQUIT\r\n",
+			}
+			session := pop3srv.NewSession(conn, suite.provider, suite.authorizer)
+			session.ReadBufferSize = size
+
+			// WHEN
+			err := session.Serve()
+
+			// THEN
+			assert.NoError(suite.T(), err)
+			assert.True(suite.T(), strings.HasPrefix(conn.NextWrittenLine(), "+OK")) // Banner
+			assert.True(suite.T(), strings.HasPrefix(conn.NextWrittenLine(), "+OK")) // USER response
+			assert.Equal(suite.T(), "-ERR command not permitted in this state\r\n", conn.NextWrittenLine())
+			assert.True(suite.T(), strings.HasPrefix(conn.NextWrittenLine(), "+OK")) // QUIT response
+		})
+	}
+}
+
+func (suite *ConnectionTestSuite) TestSessionEvents() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{
+		"USER testuser\r\n",
+		"PASS testpass\r\n",
+		"QUIT\r\n",
+	}
+	mailbox := mocks.NewMailbox(suite.T())
+	mailbox.On("Stat").Return(2, 1024, nil).Once()         // Called during auth
+	mailbox.On("List").Return([]int{500, 524}, nil).Once() // Called during auth
+	mailbox.On("Close").Return(nil).Once()                 // Called during QUIT
+	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
+	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
+	events := make(chan pop3srv.SessionEvent, 2) // too small, the rest is dropped
+	session := pop3srv.NewSessionWithEvents(suite.conn, suite.provider, suite.authorizer, events)
+
+	// WHEN
+	err := session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), pop3srv.CommandHandledEvent{Name: "USER"}, <-events)
+	assert.Equal(suite.T(), pop3srv.AuthenticatedEvent{User: "testuser"}, <-events)
+	assert.Empty(suite.T(), events)
+}
+
+func (suite *ConnectionTestSuite) TestSessionLineTerminators() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{
+		"NOOP\r",          // lone CR, LF arrives with the next read
+		"\nNOOP\n",        // bare LF
+		"QUIT\rmore data", // lone CR followed by more data
+	}
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)
+
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK "))
+	assert.Equal(suite.T(), "-ERR command not permitted in this state\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "-ERR command not permitted in this state\r\n", suite.conn.NextWrittenLine())
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK "))
+	assert.True(suite.T(), suite.conn.Closed)
+}
+
 func (suite *ConnectionTestSuite) TestSessionConnectInvalidCommand() {
 	// GIVEN
-	suite.conn.LinesToRead = []string{"foobar\r\n"}
+	suite.conn.LinesToRead = []string{"foobar\r\n"}
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.ErrorIs(suite.T(), err, io.EOF)
+
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK "))
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "-ERR "))
+	assert.False(suite.T(), suite.conn.Closed) // don't enter in update state, don't close connection as far as io.EOF was encoutered
+}
+
+func (suite *ConnectionTestSuite) TestSessionCommandNotPermittedBeforeAuth() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{
+		"STAT\r\n",
+		"RETR 1\r\n",
+		"QUIT\r\n",
+	}
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK ")) // Banner
+	assert.Equal(suite.T(), "-ERR command not permitted in this state\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "-ERR command not permitted in this state\r\n", suite.conn.NextWrittenLine())
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK ")) // QUIT response
+}
+
+func (suite *ConnectionTestSuite) TestSessionCommandNotPermittedAfterAuth() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{
+		"USER testuser\r\n",
+		"PASS testpass\r\n",
+		"USER otheruser\r\n",
+		"QUIT\r\n",
+	}
+	mailbox := mocks.NewMailbox(suite.T())
+	mailbox.On("Stat").Return(2, 1024, nil).Once()         // Called during auth
+	mailbox.On("List").Return([]int{500, 524}, nil).Once() // Called during auth
+	mailbox.On("Close").Return(nil).Once()                 // Called during QUIT
+	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
+	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Banner
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // USER response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // PASS response
+	assert.Equal(suite.T(), "-ERR command not permitted in this state\r\n", suite.conn.NextWrittenLine())
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // QUIT response
+}
+
+func (suite *ConnectionTestSuite) TestSessionTooManyInvalidCommands() {
+	// GIVEN
+	for range pop3srv.DefaultMaxInvalidCommands + 1 {
+		suite.conn.LinesToRead = append(suite.conn.LinesToRead, "foobar\r\n")
+	}
+	suite.conn.LinesToRead = append(suite.conn.LinesToRead, "QUIT\r\n")
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.ErrorIs(suite.T(), err, pop3srv.ErrTooManyInvalidCommands)
+
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK ")) // Banner
+	for range pop3srv.DefaultMaxInvalidCommands {
+		assert.Equal(suite.T(), "-ERR invalid command\r\n", suite.conn.NextWrittenLine())
+	}
+	assert.Equal(suite.T(), "-ERR too many invalid commands\r\n", suite.conn.NextWrittenLine())
+	assert.Empty(suite.T(), suite.conn.NextWrittenLine()) // QUIT isn't processed
+	assert.True(suite.T(), suite.conn.Closed)
+}
+
+func (suite *ConnectionTestSuite) TestSessionInvalidCommandsLenient() {
+	// GIVEN
+	for range pop3srv.DefaultMaxInvalidCommands + 1 {
+		suite.conn.LinesToRead = append(suite.conn.LinesToRead, "foobar\r\n")
+	}
+	suite.conn.LinesToRead = append(suite.conn.LinesToRead, "QUIT\r\n")
+	suite.session.InvalidCommandPolicy = pop3srv.InvalidCommandsLenient
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)
+
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK ")) // Banner
+	for range pop3srv.DefaultMaxInvalidCommands + 1 {
+		assert.Equal(suite.T(), "-ERR invalid command\r\n", suite.conn.NextWrittenLine())
+	}
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK ")) // QUIT response
+}
+
+func (suite *ConnectionTestSuite) TestSessionDotLine() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{
+		".\r\n",
+		"AUTH XOAUTH2\r\n",
+		".\r\n", // SASL response isn't dot-unstuffed
+		"QUIT\r\n",
+	}
+	session := pop3srv.NewSession(suite.conn, suite.provider, oauthAuthorizer{suite.mockAuthorizer})
+
+	// WHEN
+	err := session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK ")) // Banner
+	assert.Equal(suite.T(), "-ERR invalid command\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "+ \r\n", suite.conn.NextWrittenLine()) // Continuation for initial response
+	assert.Equal(suite.T(), "-ERR invalid argument\r\n", suite.conn.NextWrittenLine())
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK ")) // QUIT response
+}
+
+func (suite *ConnectionTestSuite) TestSessionBlankLinesIgnored() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{
+		"\r\n",
+		"CAPA\r\n",
+		" \t\r\n",
+		"QUIT\r\n",
+	}
+	suite.session.InvalidCommandPolicy = pop3srv.InvalidCommandsStrict
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK ")) // Banner
+	assert.Equal(suite.T(), "+OK Capability list follows\r\n", suite.conn.NextWrittenLine())
+	for line := suite.conn.NextWrittenLine(); line != ".\r\n"; line = suite.conn.NextWrittenLine() {
+		require.NotEmpty(suite.T(), line)
+	}
+	assert.Equal(suite.T(), "+OK server signing off\r\n", suite.conn.NextWrittenLine()) // QUIT response
+}
+
+func (suite *ConnectionTestSuite) TestSessionInvalidCommandsStrict() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{"foobar\r\n", "QUIT\r\n"}
+	suite.session.InvalidCommandPolicy = pop3srv.InvalidCommandsStrict
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.ErrorIs(suite.T(), err, pop3srv.ErrTooManyInvalidCommands)
+
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK ")) // Banner
+	assert.Equal(suite.T(), "-ERR too many invalid commands\r\n", suite.conn.NextWrittenLine())
+	assert.Empty(suite.T(), suite.conn.NextWrittenLine()) // QUIT isn't processed
+	assert.True(suite.T(), suite.conn.Closed)
+}
+
+func (suite *ConnectionTestSuite) TestSessionInvalidCommandsStrictAfterAuth() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{
+		"USER testuser\r\n",
+		"PASS testpass\r\n",
+		"foobar\r\n",
+		"QUIT\r\n",
+	}
+	suite.session.InvalidCommandPolicy = pop3srv.InvalidCommandsStrict
+	mailbox := mocks.NewMailbox(suite.T())
+	mailbox.On("Stat").Return(2, 1024, nil).Once()         // Called during auth
+	mailbox.On("List").Return([]int{500, 524}, nil).Once() // Called during auth
+	mailbox.On("Close").Return(nil).Once()                 // Called during QUIT
+	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
+	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Banner
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // USER response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // PASS response
+	assert.Equal(suite.T(), "-ERR invalid command\r\n", suite.conn.NextWrittenLine())
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // QUIT response
+}
+
+func (suite *ConnectionTestSuite) TestSessionConnectErrorRead() {
+	// GIVEN
+	expectedErr := errors.New("foobar")
+	suite.conn.Err = expectedErr
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.ErrorIs(suite.T(), err, expectedErr)
+
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK "))
+	assert.Empty(suite.T(), suite.conn.NextWrittenLine())
+	assert.False(suite.T(), suite.conn.Closed) // don't enter in update state, don't close connection as far as io.EOF was encoutered
+}
+
+func (suite *ConnectionTestSuite) TestSessionServeContextCancel() {
+	// GIVEN
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	session := pop3srv.NewSession(serverConn, suite.provider, suite.authorizer)
+	ctx, cancel := context.WithCancel(context.Background())
+	mailbox := mocks.NewMailbox(suite.T())
+	mailbox.On("Stat").Return(2, 1024, nil).Once()         // Called during auth
+	mailbox.On("List").Return([]int{500, 524}, nil).Once() // Called during auth
+	mailbox.On("Close").Return(nil).Once()                 // Called on cancel, without Dele
+	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
+	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
+
+	errCh := make(chan error)
+	go func() { errCh <- session.ServeContext(ctx) }()
+
+	client := textproto.NewConn(clientConn)
+	readOK := func() {
+		line, err := client.ReadLine()
+		suite.Require().NoError(err)
+		suite.Require().True(strings.HasPrefix(line, "+OK"), line)
+	}
+	readOK() // Banner
+	suite.Require().NoError(client.PrintfLine("USER testuser"))
+	readOK()
+	suite.Require().NoError(client.PrintfLine("PASS testpass"))
+	readOK()
+	suite.Require().NoError(client.PrintfLine("DELE 1"))
+	readOK()
+
+	// WHEN
+	cancel()
+
+	// THEN
+	assert.ErrorIs(suite.T(), <-errCh, context.Canceled)
+	_, err := client.ReadLine()
+	assert.Error(suite.T(), err) // connection is closed
+}
+
+func (suite *ConnectionTestSuite) TestSessionUserPassSuccess() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{
+		"USER testuser\r\n",
+		"PASS testpass\r\n",
+		"QUIT\r\n",
+	}
+	mailbox := mocks.NewMailbox(suite.T())
+	mailbox.On("Stat").Return(2, 1024, nil).Once()         // Called during auth
+	mailbox.On("List").Return([]int{500, 524}, nil).Once() // Called during auth
+	mailbox.On("Close").Return(nil).Once()                 // Called during QUIT
+	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
+	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Banner
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // USER response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // PASS response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // QUIT response
+}
+
+func (suite *ConnectionTestSuite) TestSessionUserWithSpaces() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{
+		"USER\r\n",
+		"USER bob smith\r\n",
+		"PASS my secret\r\n",
+		"QUIT\r\n",
+	}
+	mailbox := mocks.NewMailbox(suite.T())
+	mailbox.On("Stat").Return(2, 1024, nil).Once()         // Called during auth
+	mailbox.On("List").Return([]int{500, 524}, nil).Once() // Called during auth
+	mailbox.On("Close").Return(nil).Once()                 // Called during QUIT
+	suite.mockAuthorizer.On("UserPass", "bob smith", "my secret").Return(nil)
+	suite.provider.On("Provide", "bob smith").Return(mailbox, nil)
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))     // Banner
+	assert.Equal(suite.T(), "-ERR invalid argument\r\n", suite.conn.NextWrittenLine()) // USER without name
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))     // USER response
+	assert.Equal(suite.T(), "+OK logged in\r\n", suite.conn.NextWrittenLine())         // PASS response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))     // QUIT response
+}
+
+func (suite *ConnectionTestSuite) TestSessionStatErrorDuringAuth() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{
+		"USER testuser\r\n",
+		"PASS testpass\r\n",
+		"STAT\r\n",
+		"QUIT\r\n",
+	}
+	mailbox := mocks.NewMailbox(suite.T())
+	mailbox.On("Stat").Return(0, 0, errors.New("stat error")).Once() // Called during auth
+	mailbox.On("Close").Return(nil).Once()                           // Called after failed Stat
+	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
+	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))                        // Banner
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))                        // USER response
+	assert.Equal(suite.T(), "-ERR stat error\r\n", suite.conn.NextWrittenLine())                          // PASS response
+	assert.Equal(suite.T(), "-ERR command not permitted in this state\r\n", suite.conn.NextWrittenLine()) // still not logged in
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))                        // QUIT response
+}
+
+// lockableMailbox adds locking to mocked mailbox
+// and records Lock, Close and Unlock calls.
+type lockableMailbox struct {
+	*mocks.Mailbox
+	lockErr error
+	calls   []string
+}
+
+func (m *lockableMailbox) Lock() error {
+	m.calls = append(m.calls, "Lock")
+	return m.lockErr
+}
+
+func (m *lockableMailbox) Unlock() error {
+	m.calls = append(m.calls, "Unlock")
+	return nil
+}
+
+func (m *lockableMailbox) Close() error {
+	m.calls = append(m.calls, "Close")
+	return m.Mailbox.Close()
+}
+
+func (suite *ConnectionTestSuite) TestSessionLockableMailbox() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{
+		"USER testuser\r\n",
+		"PASS testpass\r\n",
+		"QUIT\r\n",
+	}
+	mailbox := &lockableMailbox{Mailbox: mocks.NewMailbox(suite.T())}
+	mailbox.On("Stat").Return(2, 1024, nil).Once()         // Called during auth
+	mailbox.On("List").Return([]int{500, 524}, nil).Once() // Called during auth
+	mailbox.On("Close").Return(nil).Once()                 // Called during QUIT
+	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
+	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Banner
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // USER response
+	assert.Equal(suite.T(), "+OK logged in\r\n", suite.conn.NextWrittenLine())
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // QUIT response
+	assert.Equal(suite.T(), []string{"Lock", "Close", "Unlock"}, mailbox.calls)
+}
+
+func (suite *ConnectionTestSuite) TestSessionCloseBeforeDisconnect() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{
+		"USER testuser\r\n",
+		"PASS testpass\r\n",
+		"XBYE\r\n",
+	}
+	mailbox := &lockableMailbox{Mailbox: mocks.NewMailbox(suite.T())}
+	mailbox.On("Stat").Return(2, 1024, nil).Once()         // Called during auth
+	mailbox.On("List").Return([]int{500, 524}, nil).Once() // Called during auth
+	mailbox.On("Close").Return(nil).Once()                 // Called by XBYE only
+	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
+	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
+	suite.session.HandleCommand(pop3srv.TransactionState, "XBYE", func(s *pop3srv.Session, _ []string) error {
+		return s.Close()
+	})
+
+	// WHEN
+	suite.session.Serve()
+
+	// THEN
+	assert.True(suite.T(), suite.conn.Closed)
+	assert.Equal(suite.T(), []string{"Lock", "Close", "Unlock"}, mailbox.calls)
+	assert.Nil(suite.T(), suite.session.Mailbox())
+}
+
+func (suite *ConnectionTestSuite) TestSessionLockableMailboxLockFails() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{
+		"USER testuser\r\n",
+		"PASS testpass\r\n",
+		"STAT\r\n",
+		"QUIT\r\n",
+	}
+	mailbox := &lockableMailbox{Mailbox: mocks.NewMailbox(suite.T()), lockErr: errors.New("dotlock exists")}
+	mailbox.On("Close").Return(nil).Once() // Called after failed Lock
+	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
+	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))                        // Banner
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))                        // USER response
+	assert.Equal(suite.T(), "-ERR [IN-USE] mailbox already locked\r\n", suite.conn.NextWrittenLine())     // PASS response
+	assert.Equal(suite.T(), "-ERR command not permitted in this state\r\n", suite.conn.NextWrittenLine()) // still not logged in
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))                        // QUIT response
+	assert.Equal(suite.T(), []string{"Lock", "Close"}, mailbox.calls)
+}
+
+// authProvider returns static mailbox on successful authentication.
+type authProvider struct {
+	*mocks.Authorizer
+}
+
+func (authProvider) Authenticate(user, pass string) (pop3srv.Mailbox, error) {
+	if user != "testuser" || pass != "testpass" {
+		return nil, pop3srv.ErrAuthFailed
+	}
+	return pop3srv.NewStaticMailbox([][]byte{[]byte("Subject: test\r\n\r\nbody\r\n")}), nil
+}
+
+func (suite *ConnectionTestSuite) TestSessionAuthProvider() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{
+		"USER testuser\r\n",
+		"PASS badpass\r\n",
+		"USER testuser\r\n",
+		"PASS testpass\r\n",
+		"STAT\r\n",
+		"QUIT\r\n",
+	}
+	// provider isn't called, authProvider returns the mailbox
+	session := pop3srv.NewSession(suite.conn, suite.provider, authProvider{suite.mockAuthorizer})
+	session.AuthFailDelay = 0
+
+	// WHEN
+	err := session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Banner
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // USER response
+	assert.Equal(suite.T(), "-ERR [AUTH] authentication failed\r\n", suite.conn.NextWrittenLine())
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // USER response
+	assert.Equal(suite.T(), "+OK logged in\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "+OK 1 23\r\n", suite.conn.NextWrittenLine())
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // QUIT response
+}
+
+func (suite *ConnectionTestSuite) TestSessionUserReissued() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{
+		"USER a\r\n",
+		"USER b\r\n",
+		"PASS x\r\n",
+		"QUIT\r\n",
+	}
+	mailbox := mocks.NewMailbox(suite.T())
+	mailbox.On("Stat").Return(2, 1024, nil).Once()         // Called during auth
+	mailbox.On("List").Return([]int{500, 524}, nil).Once() // Called during auth
+	mailbox.On("Close").Return(nil).Once()                 // Called during QUIT
+	suite.mockAuthorizer.On("UserPass", "b", "x").Return(nil)
+	suite.provider.On("Provide", "b").Return(mailbox, nil)
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Banner
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // first USER response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // second USER response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // PASS response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // QUIT response
+}
+
+func (suite *ConnectionTestSuite) TestSessionProvideError() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{
+		"USER testuser\r\n",
+		"PASS testpass\r\n",
+		"STAT\r\n",
+		"USER otheruser\r\n",
+		"PASS otherpass\r\n",
+		"QUIT\r\n",
+	}
+	mailbox := mocks.NewMailbox(suite.T())
+	mailbox.On("Stat").Return(0, 0, nil).Once()    // Called during auth
+	mailbox.On("List").Return([]int{}, nil).Once() // Called during auth
+	mailbox.On("Close").Return(nil).Once()
+	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
+	suite.mockAuthorizer.On("UserPass", "otheruser", "otherpass").Return(nil)
+	suite.provider.On("Provide", "testuser").Return(nil, errors.New("db: connection refused")).Once()
+	suite.provider.On("Provide", "otheruser").Return(mailbox, nil).Once()
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Banner
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // USER response
+	assert.Equal(suite.T(), "-ERR [SYS/PERM] mailbox unavailable\r\n", suite.conn.NextWrittenLine())
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "-ERR")) // STAT in authorization state
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))  // USER response
+	assert.Equal(suite.T(), "+OK logged in\r\n", suite.conn.NextWrittenLine())
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // QUIT response
+}
+
+func (suite *ConnectionTestSuite) TestSessionUsernameNormalizer() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{
+		"USER TestUser@Example.COM\r\n",
+		"PASS testpass\r\n",
+		"QUIT\r\n",
+	}
+	suite.session.UsernameNormalizer = strings.ToLower
+	mailbox := mocks.NewMailbox(suite.T())
+	mailbox.On("Stat").Return(0, 0, nil).Once()    // Called during auth
+	mailbox.On("List").Return([]int{}, nil).Once() // Called during auth
+	mailbox.On("Close").Return(nil).Once()
+	suite.mockAuthorizer.On("UserPass", "testuser@example.com", "testpass").Return(nil)
+	suite.provider.On("Provide", "testuser@example.com").Return(mailbox, nil)
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "testuser@example.com", suite.session.Info().User)
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Banner
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // USER response
+	assert.Equal(suite.T(), "+OK logged in\r\n", suite.conn.NextWrittenLine())
+}
+
+func (suite *ConnectionTestSuite) TestSessionTooManyAuthAttempts() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{
+		"USER testuser\r\n",
+		"PASS wrong1\r\n",
+		"APOP testuser wrongdigest\r\n",
+		"PASS testpass\r\n",
+	}
+	suite.session.MaxAuthAttempts = 2
+	suite.mockAuthorizer.On("UserPass", "testuser", "wrong1").Return(errors.New("invalid password"))
+	suite.mockAuthorizer.On("Apop", "testuser", mock.AnythingOfType("string"), "wrongdigest").Return(errors.New("invalid digest"))
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.ErrorIs(suite.T(), err, pop3srv.ErrTooManyAuthAttempts)
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Banner
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // USER response
+	assert.Equal(suite.T(), "-ERR invalid password\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "-ERR too many authentication attempts\r\n", suite.conn.NextWrittenLine())
+	assert.Empty(suite.T(), suite.conn.NextWrittenLine()) // last PASS isn't processed
+	assert.True(suite.T(), suite.conn.Closed)
+}
+
+func (suite *ConnectionTestSuite) TestSessionUnsupportedAuthMethodNotCounted() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{
+		"APOP testuser somedigest\r\n",
+		"USER otheruser\r\n",
+		"PASS otherpass\r\n",
+		"USER testuser\r\n",
+		"PASS testpass\r\n",
+		"QUIT\r\n",
+	}
+	suite.session.MaxAuthAttempts = 1
+	suite.mockAuthorizer.ExpectedCalls = nil
+	suite.mockAuthorizer.On("UserPass", "", "").Return(nil)
+	suite.mockAuthorizer.On("Apop", "", "", "").Return(pop3srv.ErrNotSupportedAuthMethod) // not called for APOP command
+	suite.mockAuthorizer.On("UserPass", "otheruser", "otherpass").Return(pop3srv.ErrNotSupportedAuthMethod)
+	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
+	mailbox := mocks.NewMailbox(suite.T())
+	mailbox.On("Stat").Return(0, 0, nil).Once()    // Called during auth
+	mailbox.On("List").Return([]int{}, nil).Once() // Called during auth
+	mailbox.On("Close").Return(nil).Once()         // Called during QUIT
+	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Banner
+	assert.Equal(suite.T(), "-ERR not suported authorization method\r\n", suite.conn.NextWrittenLine())
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // USER response
+	assert.Equal(suite.T(), "-ERR not suported authorization method\r\n", suite.conn.NextWrittenLine())
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // USER response
+	assert.Equal(suite.T(), "+OK logged in\r\n", suite.conn.NextWrittenLine())
+}
+
+func (suite *ConnectionTestSuite) TestSessionAuthorizerErrors() {
+	for _, c := range []struct {
+		name      string
+		authErr   error
+		responses []string
+		err       error
+	}{
+		{
+			name:    "auth failed",
+			authErr: fmt.Errorf("%w: wrong password", pop3srv.ErrAuthFailed),
+			responses: []string{
+				"-ERR [AUTH] authentication failed\r\n",
+				"-ERR too many authentication attempts\r\n",
+			},
+			err: pop3srv.ErrTooManyAuthAttempts,
+		},
+		{
+			name:    "account disabled",
+			authErr: fmt.Errorf("%w: expired", pop3srv.ErrAccountDisabled),
+			responses: []string{
+				"-ERR [AUTH] account disabled\r\n",
+				"-ERR [AUTH] account disabled\r\n",
+				"+OK server signing off\r\n",
+			},
+		},
+		{
+			name:    "temporary failure",
+			authErr: fmt.Errorf("%w: LDAP unavailable", pop3srv.ErrTemporaryFailure),
+			responses: []string{
+				"-ERR [SYS/TEMP] temporary failure, try again later\r\n",
+				"-ERR [SYS/TEMP] temporary failure, try again later\r\n",
+				"+OK server signing off\r\n",
+			},
+		},
+	} {
+		suite.Run(c.name, func() {
+			// GIVEN
+			user := strings.ReplaceAll(c.name, " ", "")
+			conn := mocks.NewConnMock()
+			conn.LinesToRead = []string{
+				"USER " + user + "\r\n",
+				"PASS testpass\r\n",
+				"PASS testpass\r\n",
+				"QUIT\r\n",
+			}
+			suite.mockAuthorizer.On("UserPass", user, "testpass").Return(c.authErr)
+			session := pop3srv.NewSession(conn, suite.provider, suite.authorizer)
+			session.MaxAuthAttempts = 2
+
+			// WHEN
+			err := session.Serve()
+
+			// THEN
+			if c.err != nil {
+				assert.ErrorIs(suite.T(), err, c.err)
+			} else {
+				assert.NoError(suite.T(), err)
+			}
+			assert.True(suite.T(), strings.HasPrefix(conn.NextWrittenLine(), "+OK")) // Banner
+			assert.True(suite.T(), strings.HasPrefix(conn.NextWrittenLine(), "+OK")) // USER response
+			for _, response := range c.responses {
+				assert.Equal(suite.T(), response, conn.NextWrittenLine())
+			}
+			assert.Empty(suite.T(), conn.NextWrittenLine())
+		})
+	}
+}
+
+func (suite *ConnectionTestSuite) TestSessionGreetingWriteError() {
+	// GIVEN
+	writeErr := errors.New("connection reset by peer")
+	suite.conn.WriteErr = writeErr
+	written := suite.conn.NextWrittenLine() // nothing written by NewSession
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.Empty(suite.T(), written)
+	assert.ErrorIs(suite.T(), err, pop3srv.ErrConnectionLost)
+	assert.ErrorIs(suite.T(), err, writeErr)
+	assert.Empty(suite.T(), suite.conn.NextWrittenLine())
+}
+
+func (suite *ConnectionTestSuite) TestSessionGreetingDelay() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{"QUIT\r\n"}
+	suite.session.GreetingDelay = 50 * time.Millisecond
+
+	// WHEN
+	start := time.Now()
+	err := suite.session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)
+	assert.GreaterOrEqual(suite.T(), time.Since(start), suite.session.GreetingDelay)
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Banner
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // QUIT response
+}
+
+func (suite *ConnectionTestSuite) TestSessionAuthFailDelay() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{
+		"USER testuser\r\n",
+		"PASS wrong\r\n",
+		"QUIT\r\n",
+	}
+	suite.session.AuthFailDelay = 50 * time.Millisecond
+	suite.mockAuthorizer.On("UserPass", "testuser", "wrong").Return(errors.New("invalid password"))
+
+	// WHEN
+	start := time.Now()
+	err := suite.session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)
+	assert.GreaterOrEqual(suite.T(), time.Since(start), suite.session.AuthFailDelay)
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Banner
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // USER response
+	assert.Equal(suite.T(), "-ERR invalid password\r\n", suite.conn.NextWrittenLine())
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // QUIT response
+}
+
+// rpopAuthorizer adds RPOP support to mocked authorizer,
+// it trusts remote user with the same name as local one.
+type rpopAuthorizer struct {
+	*mocks.Authorizer
+}
+
+func (rpopAuthorizer) Rpop(user, remoteUser string) error {
+	if user != remoteUser {
+		return errors.New("untrusted user")
+	}
+	return nil
+}
+
+func (suite *ConnectionTestSuite) TestSessionRpopDisabled() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{
+		"USER testuser\r\n",
+		"RPOP testuser\r\n",
+		"QUIT\r\n",
+	}
+	session := pop3srv.NewSession(suite.conn, suite.provider, rpopAuthorizer{suite.mockAuthorizer})
+
+	// WHEN
+	err := session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))          // Banner
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))          // USER response
+	assert.Equal(suite.T(), "-ERR command not supported\r\n", suite.conn.NextWrittenLine()) // RPOP response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))          // QUIT response
+}
+
+func (suite *ConnectionTestSuite) TestSessionRpop() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{
+		"RPOP testuser\r\n",
+		"USER testuser\r\n",
+		"RPOP otheruser\r\n",
+		"RPOP testuser\r\n",
+		"QUIT\r\n",
+	}
+	mailbox := mocks.NewMailbox(suite.T())
+	mailbox.On("Stat").Return(2, 1024, nil).Once()         // Called during auth
+	mailbox.On("List").Return([]int{500, 524}, nil).Once() // Called during auth
+	mailbox.On("Close").Return(nil).Once()                 // Called during QUIT
+	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
+	session := pop3srv.NewSession(suite.conn, suite.provider, rpopAuthorizer{suite.mockAuthorizer})
+	session.EnableRpop = true
+
+	// WHEN
+	err := session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))       // Banner
+	assert.Equal(suite.T(), "-ERR user not specified\r\n", suite.conn.NextWrittenLine()) // RPOP before USER
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))       // USER response
+	assert.Equal(suite.T(), "-ERR untrusted user\r\n", suite.conn.NextWrittenLine())     // RPOP rejected
+	assert.Equal(suite.T(), "+OK logged in\r\n", suite.conn.NextWrittenLine())           // RPOP accepted
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))       // QUIT response
+}
+
+// oauthAuthorizer adds XOAUTH2 support to mocked authorizer,
+// it accepts only "valid-token".
+type oauthAuthorizer struct {
+	*mocks.Authorizer
+}
+
+func (oauthAuthorizer) OAuth(user, token string) error {
+	if token != "valid-token" {
+		return errors.New("invalid token")
+	}
+	return nil
+}
+
+func xoauth2Response(user, token string) string {
+	return base64.StdEncoding.EncodeToString([]byte("user=" + user + "\x01auth=Bearer " + token + "\x01\x01"))
+}
+
+func (suite *ConnectionTestSuite) TestSessionAuthXoauth2() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{
+		"CAPA\r\n",
+		"AUTH XOAUTH2 " + xoauth2Response("testuser", "invalid-token") + "\r\n",
+		"\r\n",
+		"AUTH XOAUTH2\r\n",
+		xoauth2Response("testuser", "valid-token") + "\r\n",
+		"QUIT\r\n",
+	}
+	mailbox := mocks.NewMailbox(suite.T())
+	mailbox.On("Stat").Return(2, 1024, nil).Once()         // Called during auth
+	mailbox.On("List").Return([]int{500, 524}, nil).Once() // Called during auth
+	mailbox.On("Close").Return(nil).Once()                 // Called during QUIT
+	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
+	session := pop3srv.NewSession(suite.conn, suite.provider, oauthAuthorizer{suite.mockAuthorizer})
+
+	// WHEN
+	err := session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Banner
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // CAPA response
+	assert.Equal(suite.T(), "USER\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "SASL XOAUTH2\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "TOP\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "UIDL\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "RESP-CODES\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "AUTH-RESP-CODE\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "IMPLEMENTATION pop3srv\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), ".\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "+ "+base64.StdEncoding.EncodeToString([]byte(`{"status":"401","schemes":"bearer"}`))+"\r\n",
+		suite.conn.NextWrittenLine()) // Error status continuation
+	assert.Equal(suite.T(), "-ERR invalid token\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "+ \r\n", suite.conn.NextWrittenLine()) // Continuation for initial response
+	assert.Equal(suite.T(), "+OK logged in\r\n", suite.conn.NextWrittenLine())
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // QUIT response
+}
+
+func (suite *ConnectionTestSuite) TestSessionAuthXoauth2Malformed() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{
+		"AUTH XOAUTH2 " + base64.StdEncoding.EncodeToString([]byte("user=testuser")) + "\r\n",
+		"AUTH XOAUTH2 not-base64!\r\n",
+		"QUIT\r\n",
+	}
+	session := pop3srv.NewSession(suite.conn, suite.provider, oauthAuthorizer{suite.mockAuthorizer})
+
+	// WHEN
+	err := session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Banner
+	assert.Equal(suite.T(), "-ERR invalid argument\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "-ERR invalid argument\r\n", suite.conn.NextWrittenLine())
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // QUIT response
+}
+
+func (suite *ConnectionTestSuite) TestSessionApopSuccess() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{
+		"APOP testuser digestvalue\r\n",
+		"QUIT\r\n",
+	}
+	mailbox := mocks.NewMailbox(suite.T())
+	mailbox.On("Stat").Return(2, 1024, nil).Once()         // Called during auth
+	mailbox.On("List").Return([]int{500, 524}, nil).Once() // Called during auth
+	mailbox.On("Close").Return(nil).Once()                 // Called during QUIT
+	suite.mockAuthorizer.On("Apop", "testuser", mock.AnythingOfType("string"), "digestvalue").Return(nil)
+	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)
+	banner := suite.conn.NextWrittenLine()
+	assert.True(suite.T(), strings.HasPrefix(banner, "+OK"))
+	assert.True(suite.T(), strings.Contains(banner, "<"))                          // Contains APOP banner
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // APOP response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // QUIT response
+}
+
+func (suite *ConnectionTestSuite) TestSessionApopInvalidArguments() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{
+		"APOP testuser\r\n",
+		"APOP\r\n",
+		"QUIT\r\n",
+	}
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Banner
+	assert.Equal(suite.T(), "-ERR invalid argument\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "-ERR invalid argument\r\n", suite.conn.NextWrittenLine())
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // QUIT response
+}
+
+func (suite *ConnectionTestSuite) TestSessionApopRepeatedAttempts() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{
+		"APOP testuser wrongdigest\r\n",
+		"APOP testuser digestvalue\r\n",
+		"QUIT\r\n",
+	}
+	suite.session.InvalidateBannerOnApopFailure = true
+	suite.mockAuthorizer.On("Apop", "testuser", mock.AnythingOfType("string"), "wrongdigest").Return(errors.New("invalid digest")).Once()
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Banner
+	assert.Equal(suite.T(), "-ERR invalid digest\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "-ERR APOP challenge expired, reconnect\r\n", suite.conn.NextWrittenLine()) // authorizer isn't called
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))                      // QUIT response
+}
+
+func (suite *ConnectionTestSuite) TestSessionApopAfterLogin() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{
+		"APOP testuser digestvalue\r\n",
+		"APOP testuser digestvalue\r\n",
+		"QUIT\r\n",
+	}
+	mailbox := mocks.NewMailbox(suite.T())
+	mailbox.On("Stat").Return(2, 1024, nil).Once()         // Called during auth
+	mailbox.On("List").Return([]int{500, 524}, nil).Once() // Called during auth
+	mailbox.On("Close").Return(nil).Once()                 // Called during QUIT
+	suite.mockAuthorizer.On("Apop", "testuser", mock.AnythingOfType("string"), "digestvalue").Return(nil).Once()
+	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))  // Banner
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))  // first APOP response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "-ERR")) // replayed APOP is rejected
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))  // QUIT response
+}
+
+func (suite *ConnectionTestSuite) TestSessionApopCustomBanner() {
+	// GIVEN
+	const banner = "<c0ffee@pop3.example.org>"
+	suite.conn.LinesToRead = []string{
+		"APOP testuser " + pop3srv.ApopDigest(banner, "secret") + "\r\n",
+		"QUIT\r\n",
+	}
+	suite.session.TimestampBannerGenerator = func() string { return banner }
+	mailbox := mocks.NewMailbox(suite.T())
+	mailbox.On("Stat").Return(2, 1024, nil).Once()         // Called during auth
+	mailbox.On("List").Return([]int{500, 524}, nil).Once() // Called during auth
+	mailbox.On("Close").Return(nil).Once()                 // Called during QUIT
+	suite.mockAuthorizer.On("Apop", "testuser", banner, mock.AnythingOfType("string")).
+		Return(func(user, timestampBanner, digest string) error {
+			if !pop3srv.ApopVerify(timestampBanner, digest, "secret") {
+				return errors.New("invalid digest")
+			}
+			return nil
+		})
+	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "+OK POP3 server ready "+banner+"\r\n", suite.conn.NextWrittenLine())
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // APOP response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // QUIT response
+}
+
+func (suite *ConnectionTestSuite) TestSessionBannerHostname() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{"QUIT\r\n"}
+	suite.session.BannerHostname = "pop3.example.org"
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)
+	assert.Regexp(suite.T(), `^\+OK .+ <\d+\.\d+@pop3\.example\.org>\r\n$`, suite.conn.NextWrittenLine())
+}
+
+func (suite *ConnectionTestSuite) TestSessionBannerHostnameSanitized() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{"QUIT\r\n"}
+	suite.session.BannerHostname = "my host.zażółć"
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)
+	assert.Regexp(suite.T(), `^\+OK .+ <\d+\.\d+@my-host\.za---->\r\n$`, suite.conn.NextWrittenLine())
+}
+
+func (suite *ConnectionTestSuite) TestSessionInvalidCustomBanner() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{"QUIT\r\n"}
+	suite.session.TimestampBannerGenerator = func() string { return "no-at-sign" }
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)
+	assert.Regexp(suite.T(), `\+OK .+ \<\d+\.\d+@.+\>`, suite.conn.NextWrittenLine()) // default banner is used
+}
+
+func (suite *ConnectionTestSuite) TestSessionListAllMessages() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{
+		"USER testuser\r\n",
+		"PASS testpass\r\n",
+		"LIST\r\n",
+		"QUIT\r\n",
+	}
+	mailbox := mocks.NewMailbox(suite.T())
+	mailbox.On("Stat").Return(2, 1024, nil).Once()         // Called during auth
+	mailbox.On("List").Return([]int{500, 524}, nil).Once() // Called during auth
+	mailbox.On("List").Return([]int{500, 524}, nil)
+	mailbox.On("Close").Return(nil).Once() // Called during QUIT
+	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
+	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Banner
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // USER response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // PASS response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // LIST response
+	assert.Equal(suite.T(), "1 500\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "2 524\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), ".\r\n", suite.conn.NextWrittenLine())
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // QUIT response
+}
+
+// batchDeleterMailbox adds mocked DeleBatch to mocked mailbox.
+type batchDeleterMailbox struct {
+	*mocks.Mailbox
+}
+
+func (m batchDeleterMailbox) DeleBatch(msgNumbers []int) error {
+	return m.Called(msgNumbers).Error(0)
+}
+
+func (suite *ConnectionTestSuite) TestSessionBatchDeleter() {
+	for _, c := range []struct {
+		name     string
+		batchErr error
+		response string
+	}{
+		{name: "success", response: "+OK server signing off\r\n"},
+		{name: "failure", batchErr: errors.New("batch error"), response: "-ERR some deleted messages not removed (1 3)\r\n"},
+	} {
+		suite.Run(c.name, func() {
+			// GIVEN
+			conn := mocks.NewConnMock()
+			conn.LinesToRead = []string{
+				"USER testuser\r\n",
+				"PASS testpass\r\n",
+				"DELE 3\r\n",
+				"DELE 1\r\n",
+				"QUIT\r\n",
+			}
+			mailbox := batchDeleterMailbox{mocks.NewMailbox(suite.T())}
+			mailbox.On("Stat").Return(3, 1524, nil).Once()              // Called during auth
+			mailbox.On("List").Return([]int{500, 524, 500}, nil).Once() // Called during auth
+			mailbox.On("DeleBatch", []int{0, 2}).Return(c.batchErr).Once()
+			mailbox.On("Close").Return(nil).Once()
+			provider := mocks.NewMailboxProvider(suite.T())
+			provider.On("Provide", "testuser").Return(mailbox, nil)
+			suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
+			session := pop3srv.NewSession(conn, provider, suite.authorizer)
+
+			// WHEN
+			err := session.Serve()
+
+			// THEN
+			assert.NoError(suite.T(), err)
+			assert.True(suite.T(), strings.HasPrefix(conn.NextWrittenLine(), "+OK")) // Banner
+			assert.True(suite.T(), strings.HasPrefix(conn.NextWrittenLine(), "+OK")) // USER response
+			assert.True(suite.T(), strings.HasPrefix(conn.NextWrittenLine(), "+OK")) // PASS response
+			assert.True(suite.T(), strings.HasPrefix(conn.NextWrittenLine(), "+OK")) // DELE response
+			assert.True(suite.T(), strings.HasPrefix(conn.NextWrittenLine(), "+OK")) // DELE response
+			assert.Equal(suite.T(), c.response, conn.NextWrittenLine())              // QUIT response
+		})
+	}
+}
+
+// quotaMailbox adds mocked Quota to mocked mailbox.
+type quotaMailbox struct {
+	*mocks.Mailbox
+}
+
+func (m quotaMailbox) Quota() (int64, int64, error) {
+	args := m.Called()
+	return args.Get(0).(int64), args.Get(1).(int64), args.Error(2)
+}
+
+func (suite *ConnectionTestSuite) TestSessionQuotaMailbox() {
+	for _, c := range []struct {
+		name     string
+		used     int64
+		limit    int64
+		quotaErr error
+		response string
+	}{
+		{name: "below threshold", used: 899, limit: 1000, response: "+OK logged in\r\n"},
+		{name: "near quota", used: 950, limit: 1000, response: "+OK logged in, 95% of quota used (950 of 1000 octets)\r\n"},
+		{name: "over quota", used: 2048, limit: 1024, response: "+OK logged in, over quota (2048 of 1024 octets used)\r\n"},
+		{name: "no limit", used: 2048, limit: 0, response: "+OK logged in\r\n"},
+		{name: "error", quotaErr: errors.New("quota error"), response: "+OK logged in\r\n"},
+	} {
+		suite.Run(c.name, func() {
+			// GIVEN
+			conn := mocks.NewConnMock()
+			conn.LinesToRead = []string{
+				"USER testuser\r\n",
+				"PASS testpass\r\n",
+				"QUIT\r\n",
+			}
+			mailbox := quotaMailbox{mocks.NewMailbox(suite.T())}
+			mailbox.On("Stat").Return(1, 500, nil).Once()     // Called during auth
+			mailbox.On("List").Return([]int{500}, nil).Once() // Called during auth
+			mailbox.On("Quota").Return(c.used, c.limit, c.quotaErr).Once()
+			mailbox.On("Close").Return(nil).Once()
+			provider := mocks.NewMailboxProvider(suite.T())
+			provider.On("Provide", "testuser").Return(mailbox, nil)
+			suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
+			session := pop3srv.NewSession(conn, provider, suite.authorizer)
+
+			// WHEN
+			err := session.Serve()
+
+			// THEN
+			assert.NoError(suite.T(), err)
+			assert.True(suite.T(), strings.HasPrefix(conn.NextWrittenLine(), "+OK")) // Banner
+			assert.True(suite.T(), strings.HasPrefix(conn.NextWrittenLine(), "+OK")) // USER response
+			assert.Equal(suite.T(), c.response, conn.NextWrittenLine())              // PASS response
+		})
+	}
+}
+
+// seqMailbox adds iterators over fixed entries to mocked mailbox,
+// List and Uidl of the mock aren't expected to be called.
+type seqMailbox struct {
+	*mocks.Mailbox
+	sizes []int
+	uids  []string
+}
+
+func (m seqMailbox) ListSeq() iter.Seq2[int, int] {
+	return slices.All(m.sizes)
+}
+
+func (m seqMailbox) UidlSeq() iter.Seq2[int, string] {
+	return slices.All(m.uids)
+}
+
+func (suite *ConnectionTestSuite) TestSessionSeqMailbox() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{
+		"USER testuser\r\n",
+		"PASS testpass\r\n",
+		"DELE 2\r\n",
+		"LIST\r\n",
+		"UIDL\r\n",
+		"QUIT\r\n",
+	}
+	mailbox := seqMailbox{
+		Mailbox: mocks.NewMailbox(suite.T()),
+		sizes:   []int{500, 524, 500},
+		uids:    []string{"uid1", "uid2", "uid3"},
+	}
+	mailbox.On("Stat").Return(3, 1524, nil).Once() // Called during auth
+	mailbox.On("Dele", 1).Return(nil).Once()       // Called during QUIT
+	mailbox.On("Close").Return(nil).Once()         // Called during QUIT
+	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
+	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
+	suite.session.DisableSizesCache = true
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Banner
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // USER response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // PASS response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // DELE response
+	assert.Equal(suite.T(), "+OK 2 messages in mailbox\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "1 500\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "3 500\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), ".\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "+OK 2 messages in mailbox\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "1 uid1\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "3 uid3\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), ".\r\n", suite.conn.NextWrittenLine())
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // QUIT response
+}
+
+func (suite *ConnectionTestSuite) TestSessionSeqMailboxEntriesLimit() {
+	for _, c := range []struct {
+		name           string
+		maxListEntries int
+		lines          []string
+	}{
+		{name: "more entries than messages", lines: []string{"+OK 2 messages in mailbox\r\n", "1 500\r\n", "2 524\r\n", ".\r\n"}},
+		{name: "too many messages", maxListEntries: 1, lines: []string{"-ERR " + pop3srv.ErrTooManyMessages.Error() + "\r\n"}},
+	} {
+		suite.Run(c.name, func() {
+			// GIVEN
+			conn := mocks.NewConnMock()
+			conn.LinesToRead = []string{
+				"USER testuser\r\n",
+				"PASS testpass\r\n",
+				"LIST\r\n",
+				"QUIT\r\n",
+			}
+			mailbox := seqMailbox{
+				Mailbox: mocks.NewMailbox(suite.T()),
+				sizes:   []int{500, 524, 500},
+			}
+			mailbox.On("Stat").Return(2, 1024, nil).Once() // Called during auth
+			mailbox.On("Close").Return(nil).Once()         // Called during QUIT
+			provider := mocks.NewMailboxProvider(suite.T())
+			provider.On("Provide", "testuser").Return(mailbox, nil)
+			suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
+			session := pop3srv.NewSession(conn, provider, suite.authorizer)
+			session.DisableSizesCache = true
+			session.MaxListEntries = c.maxListEntries
+			session.Logger = log.New(io.Discard, "", 0)
+
+			// WHEN
+			err := session.Serve()
+
+			// THEN
+			assert.NoError(suite.T(), err)
+			assert.True(suite.T(), strings.HasPrefix(conn.NextWrittenLine(), "+OK")) // Banner
+			assert.True(suite.T(), strings.HasPrefix(conn.NextWrittenLine(), "+OK")) // USER response
+			assert.True(suite.T(), strings.HasPrefix(conn.NextWrittenLine(), "+OK")) // PASS response
+			for _, line := range c.lines {
+				assert.Equal(suite.T(), line, conn.NextWrittenLine())
+			}
+			assert.True(suite.T(), strings.HasPrefix(conn.NextWrittenLine(), "+OK")) // QUIT response
+		})
+	}
+}
+
+func (suite *ConnectionTestSuite) TestSessionSeqMailboxIncomplete() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{
+		"USER testuser\r\n",
+		"PASS testpass\r\n",
+		"UIDL\r\n",
+		"QUIT\r\n",
+	}
+	mailbox := seqMailbox{
+		Mailbox: mocks.NewMailbox(suite.T()),
+		uids:    []string{"uid1", "uid2"}, // backend failed after 2 entries
+	}
+	mailbox.On("Stat").Return(3, 1524, nil).Once() // Called during auth
+	mailbox.On("Close").Return(nil).Once()         // Called at the end of session
+	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
+	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
+	suite.session.DisableSizesCache = true
+	logOutput := &syncBuffer{}
+	suite.session.Logger = log.New(logOutput, "", 0)
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.ErrorIs(suite.T(), err, pop3srv.ErrIncompleteListing)
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Banner
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // USER response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // PASS response
+	assert.Equal(suite.T(), "+OK 3 messages in mailbox\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "1 uid1\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "2 uid2\r\n", suite.conn.NextWrittenLine())
+	assert.Empty(suite.T(), suite.conn.NextWrittenLine()) // not terminated, QUIT isn't processed
+	assert.Contains(suite.T(), logOutput.String(), `Mailbox of "testuser" yielded 2 of 3 entries`)
+}
+
+// refreshableMailbox adds mocked Refresh to mocked mailbox.
+type refreshableMailbox struct {
+	*mocks.Mailbox
+}
+
+func (m refreshableMailbox) Refresh() (int, int, error) {
+	args := m.Called()
+	return args.Int(0), args.Int(1), args.Error(2)
+}
+
+func (suite *ConnectionTestSuite) TestSessionRefreshableMailbox() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{
+		"USER testuser\r\n",
+		"PASS testpass\r\n",
+		"STAT\r\n",
+		"NOOP\r\n",
+		"STAT\r\n",
+		"LIST 3\r\n",
+		"DELE 1\r\n",
+		"NOOP\r\n", // no refresh with message marked as deleted
+		"QUIT\r\n",
+	}
+	mailbox := refreshableMailbox{mocks.NewMailbox(suite.T())}
+	mailbox.On("Stat").Return(2, 1024, nil).Once()         // Called during auth
+	mailbox.On("List").Return([]int{500, 524}, nil).Once() // Called during auth
+	mailbox.On("Refresh").Return(3, 1124, nil).Once()
+	mailbox.On("List").Return([]int{500, 524, 100}, nil).Once() // Called after refresh
+	mailbox.On("Dele", 0).Return(nil).Once()
+	mailbox.On("Close").Return(nil).Once()
+	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
+	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Banner
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // USER response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // PASS response
+	assert.Equal(suite.T(), "+OK 2 1024\r\n", suite.conn.NextWrittenLine())        // STAT response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // NOOP response
+	assert.Equal(suite.T(), "+OK 3 1124\r\n", suite.conn.NextWrittenLine())        // STAT response
+	assert.Equal(suite.T(), "+OK 3 100\r\n", suite.conn.NextWrittenLine())         // LIST response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // DELE response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // NOOP response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // QUIT response
+}
+
+func (suite *ConnectionTestSuite) TestSessionMaxListEntries() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{
+		"USER testuser\r\n",
+		"PASS testpass\r\n",
+		"LIST\r\n",
+		"UIDL\r\n",
+		"LIST 2\r\n",
+		"QUIT\r\n",
+	}
+	mailbox := mocks.NewMailbox(suite.T())
+	mailbox.On("Stat").Return(5, 500, nil).Once()                            // Called during auth
+	mailbox.On("List").Return([]int{100, 100, 100, 100, 100}, nil).Once()    // Called during auth
+	mailbox.On("Uidl").Return([]string{"a", "b", "c", "d", "e"}, nil).Once() // Too many to list
+	mailbox.On("Close").Return(nil).Once()                                   // Called during QUIT
+	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
+	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
+	suite.session.MaxListEntries = 3
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))              // Banner
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))              // USER response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))              // PASS response
+	assert.Equal(suite.T(), "-ERR too many messages to list\r\n", suite.conn.NextWrittenLine()) // LIST response
+	assert.Equal(suite.T(), "-ERR too many messages to list\r\n", suite.conn.NextWrittenLine()) // UIDL response
+	assert.Equal(suite.T(), "+OK 2 100\r\n", suite.conn.NextWrittenLine())                      // single message still works
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))              // QUIT response
+}
+
+func (suite *ConnectionTestSuite) TestSessionListSkipsDeletedMessages() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{
+		"USER testuser\r\n",
+		"PASS testpass\r\n",
+		"DELE 1\r\n",
+		"LIST\r\n",
+		"QUIT\r\n",
+	}
+	mailbox := mocks.NewMailbox(suite.T())
+	mailbox.On("Stat").Return(2, 1024, nil).Once()         // Called during auth
+	mailbox.On("List").Return([]int{500, 524}, nil).Once() // Called during auth
+	mailbox.On("Dele", 0).Return(nil).Once()               // Called during QUIT
+	mailbox.On("Close").Return(nil).Once()                 // Called during QUIT
+	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
+	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Banner
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // USER response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // PASS response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // DELE response
+	assert.Equal(suite.T(), "+OK 1 messages in mailbox\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "2 524\r\n", suite.conn.NextWrittenLine()) // message 1 is absent, message 2 keeps its number
+	assert.Equal(suite.T(), ".\r\n", suite.conn.NextWrittenLine())
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // QUIT response
+}
+
+func (suite *ConnectionTestSuite) TestSessionListSingleMessageSuccess() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{
+		"USER testuser\r\n",
+		"PASS testpass\r\n",
+		"LIST 1\r\n",
+		"QUIT\r\n",
+	}
+	mailbox := mocks.NewMailbox(suite.T())
+	mailbox.On("Stat").Return(2, 1024, nil).Once()         // Called during auth
+	mailbox.On("List").Return([]int{500, 524}, nil).Once() // Called during auth, LIST is served from cache
+	mailbox.On("Close").Return(nil).Once()                 // Called during QUIT
+	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
+	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)
+	mailbox.AssertNotCalled(suite.T(), "ListOne", mock.Anything)
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Banner
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // USER response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // PASS response
+	assert.Equal(suite.T(), "+OK 1 500\r\n", suite.conn.NextWrittenLine())         // LIST response with size
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // QUIT response
+}
+
+func (suite *ConnectionTestSuite) TestSessionListSizesCacheDisabled() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{
+		"USER testuser\r\n",
+		"PASS testpass\r\n",
+		"LIST 1\r\n",
+		"STAT\r\n",
+		"QUIT\r\n",
+	}
+	suite.session.DisableSizesCache = true
+	mailbox := mocks.NewMailbox(suite.T())
+	mailbox.On("Stat").Return(2, 1024, nil).Once()   // Called during auth
+	mailbox.On("ListOne", 0).Return(500, nil).Once() // Called for LIST command
+	mailbox.On("Stat").Return(2, 1024, nil).Once()   // Called for STAT command
+	mailbox.On("Close").Return(nil).Once()           // Called during QUIT
+	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
+	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Banner
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // USER response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // PASS response
+	assert.Equal(suite.T(), "+OK 1 500\r\n", suite.conn.NextWrittenLine())         // LIST response
+	assert.Equal(suite.T(), "+OK 2 1024\r\n", suite.conn.NextWrittenLine())        // STAT response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // QUIT response
+}
+
+func (suite *ConnectionTestSuite) TestSessionStatSizesCacheDisabled() {
+	for _, c := range []struct {
+		name      string
+		totalSize int
+		response  string
+	}{
+		{name: "live stat", totalSize: 1024, response: "+OK 1 524\r\n"},
+		{name: "unknown total size", totalSize: -1, response: "+OK 1 524\r\n"},
+	} {
+		suite.Run(c.name, func() {
+			// GIVEN
+			conn := mocks.NewConnMock()
+			conn.LinesToRead = []string{
+				"USER testuser\r\n",
+				"PASS testpass\r\n",
+				"DELE 1\r\n",
+				"STAT\r\n",
+				"RSET\r\n",
+				"QUIT\r\n",
+			}
+			mailbox := mocks.NewMailbox(suite.T())
+			mailbox.On("Stat").Return(2, c.totalSize, nil).Twice() // Called during auth and for STAT command
+			if c.totalSize >= 0 {
+				mailbox.On("ListOne", 0).Return(500, nil).Once() // Size of deleted message
+			} else {
+				mailbox.On("List").Return([]int{500, 524}, nil).Once() // Fallback for unknown total size
+			}
+			mailbox.On("Close").Return(nil).Once() // Called during QUIT
+			provider := mocks.NewMailboxProvider(suite.T())
+			provider.On("Provide", "testuser").Return(mailbox, nil)
+			suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
+			session := pop3srv.NewSession(conn, provider, suite.authorizer)
+			session.DisableSizesCache = true
+
+			// WHEN
+			err := session.Serve()
+
+			// THEN
+			assert.NoError(suite.T(), err)
+			assert.True(suite.T(), strings.HasPrefix(conn.NextWrittenLine(), "+OK")) // Banner
+			assert.True(suite.T(), strings.HasPrefix(conn.NextWrittenLine(), "+OK")) // USER response
+			assert.True(suite.T(), strings.HasPrefix(conn.NextWrittenLine(), "+OK")) // PASS response
+			assert.True(suite.T(), strings.HasPrefix(conn.NextWrittenLine(), "+OK")) // DELE response
+			assert.Equal(suite.T(), c.response, conn.NextWrittenLine())              // STAT response
+		})
+	}
+}
+
+func (suite *ConnectionTestSuite) TestSessionListInvalidMessageNumber() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{
+		"USER testuser\r\n",
+		"PASS testpass\r\n",
+		"LIST 999\r\n", // Message number beyond mailbox size
+		"LIST 0\r\n",   // Message numbers start from 1
+		"LIST abc\r\n", // Not a number
+		"QUIT\r\n",
+	}
+	mailbox := mocks.NewMailbox(suite.T())
+	mailbox.On("Stat").Return(2, 1024, nil).Once()         // Called during auth
+	mailbox.On("List").Return([]int{500, 524}, nil).Once() // Called during auth
+	mailbox.On("Close").Return(nil).Once()                 // Called during QUIT
+	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
+	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Banner
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // USER response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // PASS response
+	assert.Equal(suite.T(), "-ERR no such message\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "-ERR invalid argument\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "-ERR invalid argument\r\n", suite.conn.NextWrittenLine())
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // QUIT response
+}
+
+func (suite *ConnectionTestSuite) TestSessionMessageNumberZero() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{
+		"USER testuser\r\n",
+		"PASS testpass\r\n",
+		"RETR 0\r\n",
+		"DELE 0\r\n",
+		"LIST 0\r\n",
+		"UIDL 0\r\n",
+		"TOP 0 5\r\n",
+		"QUIT\r\n",
+	}
+	mailbox := mocks.NewMailbox(suite.T())
+	mailbox.On("Stat").Return(2, 1024, nil).Once()         // Called during auth
+	mailbox.On("List").Return([]int{500, 524}, nil).Once() // Called during auth
+	mailbox.On("Close").Return(nil).Once()                 // Called during QUIT, no Dele
+	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
+	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Banner
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // USER response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // PASS response
+	for _, cmd := range []string{"RETR", "DELE", "LIST", "UIDL", "TOP"} {
+		assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "-ERR"), cmd)
+	}
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // QUIT response
+}
+
+func (suite *ConnectionTestSuite) TestSessionHugeMessageNumber() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{
+		"USER testuser\r\n",
+		"PASS testpass\r\n",
+		"RETR 4000000000\r\n",
+		"DELE 4000000000\r\n",
+		"LIST 4000000000\r\n",
+		"UIDL 4000000000\r\n",
+		"TOP 4000000000 5\r\n",
+		"RETR 99999999999999999999\r\n", // overflows int
+		"QUIT\r\n",
+	}
+	mailbox := mocks.NewMailbox(suite.T())
+	mailbox.On("Stat").Return(2, 1024, nil).Once()         // Called during auth
+	mailbox.On("List").Return([]int{500, 524}, nil).Once() // Called during auth
+	mailbox.On("Close").Return(nil).Once()                 // Called during QUIT, no Dele
+	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
+	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Banner
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // USER response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // PASS response
+	for _, cmd := range []string{"RETR", "DELE", "LIST", "UIDL", "TOP"} {
+		assert.Equal(suite.T(), "-ERR no such message\r\n", suite.conn.NextWrittenLine(), cmd)
+	}
+	assert.Equal(suite.T(), "-ERR no such message\r\n", suite.conn.NextWrittenLine())
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // QUIT response
+}
+
+func (suite *ConnectionTestSuite) TestSessionMailboxPanic() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{
+		"USER testuser\r\n",
+		"PASS testpass\r\n",
+		"DELE 2\r\n",
+		"RETR 1\r\n",
+		"QUIT\r\n",
+	}
+	mailbox := mocks.NewMailbox(suite.T())
+	mailbox.On("Stat").Return(2, 1024, nil).Once()         // Called during auth
+	mailbox.On("List").Return([]int{500, 524}, nil).Once() // Called during auth
+	mailbox.On("Message", 0).Run(func(mock.Arguments) { panic("nil map write") }).Return(nil, nil).Once()
+	mailbox.On("Close").Return(nil).Once() // Called at the end of session, no Dele
+	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
+	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
+	suite.session.Logger = log.New(io.Discard, "", 0)
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.ErrorIs(suite.T(), err, pop3srv.ErrInternal)
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Banner
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // USER response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // PASS response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // DELE response
+	assert.Equal(suite.T(), "-ERR internal server error\r\n", suite.conn.NextWrittenLine())
+	assert.True(suite.T(), suite.conn.Closed)
+}
+
+func (suite *ConnectionTestSuite) TestSessionMailboxClosePanic() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{
+		"USER testuser\r\n",
+		"PASS testpass\r\n",
+		// client disconnects without QUIT
+	}
+	mailbox := mocks.NewMailbox(suite.T())
+	mailbox.On("Stat").Return(2, 1024, nil).Once()         // Called during auth
+	mailbox.On("List").Return([]int{500, 524}, nil).Once() // Called during auth
+	mailbox.On("Close").Run(func(mock.Arguments) { panic("double close") }).Return(nil).Once()
+	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
+	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
+	var logs strings.Builder
+	suite.session.Logger = log.New(&logs, "", 0)
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.ErrorIs(suite.T(), err, pop3srv.ErrInternal)
+	assert.Contains(suite.T(), logs.String(), "Panic in session of \"testuser\": double close")
+}
+
+func (suite *ConnectionTestSuite) TestSessionMailboxClosePanicOnQuit() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{
+		"USER testuser\r\n",
+		"PASS testpass\r\n",
+		"QUIT\r\n",
+	}
+	mailbox := mocks.NewMailbox(suite.T())
+	mailbox.On("Stat").Return(2, 1024, nil).Once()         // Called during auth
+	mailbox.On("List").Return([]int{500, 524}, nil).Once() // Called during auth
+	mailbox.On("Close").Run(func(mock.Arguments) { panic("double close") }).Return(nil).Once()
+	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
+	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
+	suite.session.Logger = log.New(io.Discard, "", 0)
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)                                                 // reported to the client in QUIT response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Banner
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // USER response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // PASS response
+	assert.Equal(suite.T(), "-ERR internal server error\r\n", suite.conn.NextWrittenLine())
+	assert.True(suite.T(), suite.conn.Closed)
+}
+
+func (suite *ConnectionTestSuite) TestSessionCloseError() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{
+		"USER testuser\r\n",
+		"PASS testpass\r\n",
+		"QUIT\r\n",
+	}
+	expectedErr := errors.New("close error")
+	mailbox := mocks.NewMailbox(suite.T())
+	mailbox.On("Stat").Return(2, 1024, nil).Once()         // Called during auth
+	mailbox.On("List").Return([]int{500, 524}, nil).Once() // Called during auth
+	mailbox.On("Close").Return(expectedErr).Once()         // Called during QUIT
+	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
+	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)                                                  // Server continues despite Close error
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))  // Banner
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))  // USER response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))  // PASS response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "-ERR")) // QUIT response with error
+}
+
+func (suite *ConnectionTestSuite) TestSessionDeleError() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{
+		"USER testuser\r\n",
+		"PASS testpass\r\n",
+		"DELE 1\r\n",
+		"DELE 2\r\n",
+		"DELE 3\r\n",
+		"QUIT\r\n",
+	}
+	mailbox := mocks.NewMailbox(suite.T())
+	mailbox.On("Stat").Return(3, 1500, nil).Once()              // Called during auth
+	mailbox.On("List").Return([]int{500, 500, 500}, nil).Once() // Called during auth
+	mailbox.On("Dele", 0).Return(nil).Once()
+	mailbox.On("Dele", 1).Return(errors.New("dele error")).Once()
+	mailbox.On("Dele", 2).Return(nil).Once() // Called despite previous error
+	mailbox.On("Close").Return(nil).Once()   // Called during QUIT
+	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
+	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)
+	for range 6 { // Banner, USER, PASS and DELE responses
+		assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))
+	}
+	assert.Equal(suite.T(), "-ERR some deleted messages not removed (2)\r\n", suite.conn.NextWrittenLine()) // QUIT response
+}
+
+func (suite *ConnectionTestSuite) TestSessionStat() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{
+		"USER testuser\r\n",
+		"PASS testpass\r\n",
+		"STAT\r\n",
+		"QUIT\r\n",
+	}
+	mailbox := mocks.NewMailbox(suite.T())
+	mailbox.On("Stat").Return(2, 1024, nil).Once()         // Called during auth
+	mailbox.On("List").Return([]int{500, 524}, nil).Once() // Called during auth
+	mailbox.On("Close").Return(nil).Once()
+	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
+	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Banner
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // USER response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // PASS response
+	assert.Equal(suite.T(), "+OK 2 1024\r\n", suite.conn.NextWrittenLine())        // STAT response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // QUIT response
+}
+
+func (suite *ConnectionTestSuite) TestSessionStatUnknownTotalSize() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{
+		"USER testuser\r\n",
+		"PASS testpass\r\n",
+		"STAT\r\n",
+		"QUIT\r\n",
+	}
+	mailbox := mocks.NewMailbox(suite.T())
+	mailbox.On("Stat").Return(2, -1, nil).Once()           // Called during auth
+	mailbox.On("List").Return([]int{500, 524}, nil).Once() // Called during auth
+	mailbox.On("Close").Return(nil).Once()
+	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
+	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Banner
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // USER response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // PASS response
+	assert.Equal(suite.T(), "+OK 2 1024\r\n", suite.conn.NextWrittenLine())        // STAT response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // QUIT response
+}
+
+func (suite *ConnectionTestSuite) TestSessionStatAfterDele() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{
+		"USER testuser\r\n",
+		"PASS testpass\r\n",
+		"DELE 1\r\n",
+		"STAT\r\n",
+		"RSET\r\n",
+		"STAT\r\n",
+		"QUIT\r\n",
+	}
+	mailbox := mocks.NewMailbox(suite.T())
+	mailbox.On("Stat").Return(2, 1024, nil).Once()         // Called during auth
+	mailbox.On("List").Return([]int{500, 524}, nil).Once() // Called during auth
+	mailbox.On("List").Return([]int{500, 524}, nil).Once() // Called for STAT after RSET
+	mailbox.On("Close").Return(nil).Once()
+	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
+	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Banner
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // USER response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // PASS response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // DELE response
+	assert.Equal(suite.T(), "+OK 1 524\r\n", suite.conn.NextWrittenLine())         // STAT response without deleted message
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // RSET response
+	assert.Equal(suite.T(), "+OK 2 1024\r\n", suite.conn.NextWrittenLine())        // STAT response after RSET
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // QUIT response
+}
+
+func (suite *ConnectionTestSuite) TestSessionTop() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{
+		"USER testuser\r\n",
+		"PASS testpass\r\n",
+		"TOP 1 2\r\n",
+		"QUIT\r\n",
+	}
+	messageContent := "Subject: Test\r\n\r\nLine1\r\nLine2\r\nLine3\r\n"
+	mailbox := mocks.NewMailbox(suite.T())
+	mailbox.On("Stat").Return(2, 1024, nil).Once()
+	mailbox.On("List").Return([]int{500, 524}, nil).Once() // Called during auth
+	mailbox.On("Message", 0).Return(io.NopCloser(strings.NewReader(messageContent)), nil)
+	mailbox.On("Close").Return(nil).Once()
+	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
+	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Banner
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // USER response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // PASS response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // TOP response
+	assert.Equal(suite.T(), "Subject: Test\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "Line1\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "Line2\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), ".\r\n", suite.conn.NextWrittenLine())
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // QUIT response
+}
+
+func (suite *ConnectionTestSuite) TestSessionTopHeadersOnly() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{
+		"USER testuser\r\n",
+		"PASS testpass\r\n",
+		"TOP 1 0\r\n",
+		"TOP 1 -5\r\n",
+		"QUIT\r\n",
+	}
+	messageContent := "Subject: Test\r\n\r\nLine1\r\nLine2\r\n"
+	mailbox := mocks.NewMailbox(suite.T())
+	mailbox.On("Stat").Return(2, 1024, nil).Once()
+	mailbox.On("List").Return([]int{500, 524}, nil).Once() // Called during auth
+	mailbox.On("Message", 0).Return(io.NopCloser(strings.NewReader(messageContent)), nil).Once()
+	mailbox.On("Close").Return(nil).Once()
+	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
+	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Banner
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // USER response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // PASS response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // TOP 1 0 response
+	assert.Equal(suite.T(), "Subject: Test\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), ".\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "-ERR invalid argument\r\n", suite.conn.NextWrittenLine()) // TOP 1 -5 response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))     // QUIT response
+}
+
+func (suite *ConnectionTestSuite) TestSessionUidl() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{
+		"USER testuser\r\n",
+		"PASS testpass\r\n",
+		"UIDL\r\n",
+		"QUIT\r\n",
+	}
+	mailbox := mocks.NewMailbox(suite.T())
+	mailbox.On("Stat").Return(2, 1024, nil).Once()
+	mailbox.On("List").Return([]int{500, 524}, nil).Once() // Called during auth
+	mailbox.On("Uidl").Return([]string{"uid1", "uid2"}, nil)
+	mailbox.On("Close").Return(nil).Once()
+	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
+	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Banner
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // USER response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // PASS response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // UIDL response
+	assert.Equal(suite.T(), "1 uid1\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "2 uid2\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), ".\r\n", suite.conn.NextWrittenLine())
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // QUIT response
+}
+
+func (suite *ConnectionTestSuite) TestSessionUidlSkipsDeletedMessages() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{
+		"USER testuser\r\n",
+		"PASS testpass\r\n",
+		"DELE 1\r\n",
+		"UIDL\r\n",
+		"QUIT\r\n",
+	}
+	mailbox := mocks.NewMailbox(suite.T())
+	mailbox.On("Stat").Return(2, 1024, nil).Once()         // Called during auth
+	mailbox.On("List").Return([]int{500, 524}, nil).Once() // Called during auth
+	mailbox.On("Uidl").Return([]string{"uid1", "uid2"}, nil)
+	mailbox.On("Dele", 0).Return(nil).Once() // Called during QUIT
+	mailbox.On("Close").Return(nil).Once()   // Called during QUIT
+	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
+	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Banner
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // USER response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // PASS response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // DELE response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // UIDL response
+	assert.Equal(suite.T(), "2 uid2\r\n", suite.conn.NextWrittenLine())            // message 1 is absent, message 2 keeps its number
+	assert.Equal(suite.T(), ".\r\n", suite.conn.NextWrittenLine())
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // QUIT response
+}
+
+func (suite *ConnectionTestSuite) TestSessionUidlSingleMessage() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{
+		"USER testuser\r\n",
+		"PASS testpass\r\n",
+		"UIDL 1\r\n",
+		"QUIT\r\n",
+	}
+	mailbox := mocks.NewMailbox(suite.T())
+	mailbox.On("Stat").Return(2, 1024, nil).Once()         // Called during auth
+	mailbox.On("List").Return([]int{500, 524}, nil).Once() // Called during auth
+	mailbox.On("UidlOne", 0).Return("uid1", nil)           // Internal index is 0-based for message #1
+	mailbox.On("Close").Return(nil).Once()                 // Called during QUIT
+	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
+	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Banner
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // USER response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // PASS response
+	assert.Equal(suite.T(), "+OK 1 uid1\r\n", suite.conn.NextWrittenLine())        // UIDL response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // QUIT response
+}
+
+func (suite *ConnectionTestSuite) TestSessionUidlInvalidMessageNumber() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{
+		"USER testuser\r\n",
+		"PASS testpass\r\n",
+		"UIDL 999\r\n", // Message number beyond mailbox size
+		"QUIT\r\n",
+	}
+	mailbox := mocks.NewMailbox(suite.T())
+	mailbox.On("Stat").Return(2, 1024, nil).Once()         // Called during auth
+	mailbox.On("List").Return([]int{500, 524}, nil).Once() // Called during auth
+	mailbox.On("Close").Return(nil).Once()                 // Called during QUIT
+	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
+	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))  // Banner
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))  // USER response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))  // PASS response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "-ERR")) // UIDL response with error
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))  // QUIT response
+}
+
+func (suite *ConnectionTestSuite) TestSessionUidlDeletedMessage() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{
+		"USER testuser\r\n",
+		"PASS testpass\r\n",
+		"DELE 1\r\n",
+		"UIDL 1\r\n",
+		"QUIT\r\n",
+	}
+	mailbox := mocks.NewMailbox(suite.T())
+	mailbox.On("Stat").Return(2, 1024, nil).Once()         // Called during auth
+	mailbox.On("List").Return([]int{500, 524}, nil).Once() // Called during auth
+	mailbox.On("Dele", 0).Return(nil).Once()               // Called during QUIT
+	mailbox.On("Close").Return(nil).Once()                 // Called during QUIT
+	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
+	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))  // Banner
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))  // USER response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))  // PASS response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))  // DELE response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "-ERR")) // UIDL response (message deleted)
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))  // QUIT response
+}
+
+func (suite *ConnectionTestSuite) TestSessionNoop() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{
+		"USER testuser\r\n",
+		"PASS testpass\r\n",
+		"NOOP\r\n",
+		"QUIT\r\n",
+	}
+	mailbox := mocks.NewMailbox(suite.T())
+	mailbox.On("Stat").Return(2, 1024, nil).Once()
+	mailbox.On("List").Return([]int{500, 524}, nil).Once() // Called during auth
+	mailbox.On("Close").Return(nil).Once()
+	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
+	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Banner
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // USER response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // PASS response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // NOOP response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // QUIT response
+}
+
+func (suite *ConnectionTestSuite) TestSessionRetrMessage() {
+	// GIVEN
+	suite.conn.LinesToRead = []string{
+		"USER testuser\r\n",
+		"PASS testpass\r\n",
+		"RETR 1\r\n",
+		"QUIT\r\n",
+	}
+	messageContent := "From: sender@example.com\r\nTo: recipient@example.com\r\n\r\nTest message body\r\n"
+	mailbox := mocks.NewMailbox(suite.T())
+	mailbox.On("Stat").Return(2, 1024, nil).Once()                                        // Called during auth
+	mailbox.On("List").Return([]int{500, 524}, nil).Once()                                // Called during auth
+	mailbox.On("Message", 0).Return(io.NopCloser(strings.NewReader(messageContent)), nil) // Internal index is 0-based
+	mailbox.On("Close").Return(nil).Once()                                                // Called during QUIT
+	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
+	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
 
 	// WHEN
 	err := suite.session.Serve()
 
 	// THEN
-	assert.ErrorIs(suite.T(), err, io.EOF)
-
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK "))
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "-ERR "))
-	assert.False(suite.T(), suite.conn.Closed) // don't enter in update state, don't close connection as far as io.EOF was encoutered
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Banner
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // USER response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // PASS response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // RETR response
+	assert.Equal(suite.T(), "From: sender@example.com\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "To: recipient@example.com\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "Test message body\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), ".\r\n", suite.conn.NextWrittenLine())
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // QUIT response
 }
 
-func (suite *ConnectionTestSuite) TestSessionConnectErrorRead() {
+func (suite *ConnectionTestSuite) TestSessionRetrMessageWithoutTrailingNewline() {
 	// GIVEN
-	expectedErr := errors.New("foobar")
-	suite.conn.Err = expectedErr
+	suite.conn.LinesToRead = []string{
+		"USER testuser\r\n",
+		"PASS testpass\r\n",
+		"RETR 1\r\n",
+		"TOP 1 5\r\n",
+		"QUIT\r\n",
+	}
+	messageContent := "Subject: test\r\n\r\nlast line without newline"
+	mailbox := mocks.NewMailbox(suite.T())
+	mailbox.On("Stat").Return(1, 500, nil).Once()     // Called during auth
+	mailbox.On("List").Return([]int{500}, nil).Once() // Called during auth
+	mailbox.On("Message", 0).Return(io.NopCloser(strings.NewReader(messageContent)), nil).Once()
+	mailbox.On("Message", 0).Return(io.NopCloser(strings.NewReader(messageContent)), nil).Once()
+	mailbox.On("Close").Return(nil).Once() // Called during QUIT
+	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
+	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
 
 	// WHEN
 	err := suite.session.Serve()
 
 	// THEN
-	assert.ErrorIs(suite.T(), err, expectedErr)
-
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK "))
-	assert.Empty(suite.T(), suite.conn.NextWrittenLine())
-	assert.False(suite.T(), suite.conn.Closed) // don't enter in update state, don't close connection as far as io.EOF was encoutered
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Banner
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // USER response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // PASS response
+	for _, cmd := range []string{"RETR", "TOP"} {
+		assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"), cmd)
+		assert.Equal(suite.T(), "Subject: test\r\n", suite.conn.NextWrittenLine(), cmd)
+		assert.Equal(suite.T(), "\r\n", suite.conn.NextWrittenLine(), cmd)
+		assert.Equal(suite.T(), "last line without newline\r\n", suite.conn.NextWrittenLine(), cmd)
+		assert.Equal(suite.T(), ".\r\n", suite.conn.NextWrittenLine(), cmd) // terminator on its own line
+	}
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // QUIT response
 }
 
-func (suite *ConnectionTestSuite) TestSessionUserPassSuccess() {
+func (suite *ConnectionTestSuite) TestSessionRetrSizeInResponse() {
 	// GIVEN
 	suite.conn.LinesToRead = []string{
 		"USER testuser\r\n",
 		"PASS testpass\r\n",
+		"RETR 2\r\n",
 		"QUIT\r\n",
 	}
+	suite.session.RetrSizeInResponse = true
 	mailbox := mocks.NewMailbox(suite.T())
-	mailbox.On("Stat").Return(2, 1024, nil).Once() // Called during auth
-	mailbox.On("Close").Return(nil).Once()         // Called during QUIT
+	mailbox.On("Stat").Return(2, 1024, nil).Once()         // Called during auth
+	mailbox.On("List").Return([]int{500, 524}, nil).Once() // Called during auth
+	mailbox.On("Message", 1).Return(io.NopCloser(strings.NewReader("Subject: Test\r\n\r\nBody\r\n")), nil)
+	mailbox.On("Close").Return(nil).Once() // Called during QUIT
 	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
 	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
 
@@ -112,19 +2348,26 @@ func (suite *ConnectionTestSuite) TestSessionUserPassSuccess() {
 	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Banner
 	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // USER response
 	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // PASS response
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // QUIT response
+	assert.Equal(suite.T(), "+OK 524 octets\r\n", suite.conn.NextWrittenLine())    // RETR response with size
 }
 
-func (suite *ConnectionTestSuite) TestSessionApopSuccess() {
+func (suite *ConnectionTestSuite) TestSessionAccessLog() {
 	// GIVEN
+	logOutput := &strings.Builder{}
+	log.SetOutput(logOutput)
+	defer log.SetOutput(os.Stderr)
 	suite.conn.LinesToRead = []string{
-		"APOP testuser digestvalue\r\n",
+		"USER testuser\r\n",
+		"PASS testpass\r\n",
+		"RETR 1\r\n",
 		"QUIT\r\n",
 	}
 	mailbox := mocks.NewMailbox(suite.T())
-	mailbox.On("Stat").Return(2, 1024, nil).Once() // Called during auth
-	mailbox.On("Close").Return(nil).Once()         // Called during QUIT
-	suite.mockAuthorizer.On("Apop", "testuser", mock.AnythingOfType("string"), "digestvalue").Return(nil)
+	mailbox.On("Stat").Return(2, 1024, nil).Once()         // Called during auth
+	mailbox.On("List").Return([]int{500, 524}, nil).Once() // Called during auth
+	mailbox.On("Message", 0).Return(io.NopCloser(strings.NewReader("Subject: Test\r\n\r\nBody\r\n")), nil)
+	mailbox.On("Close").Return(nil).Once() // Called during QUIT
+	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
 	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
 
 	// WHEN
@@ -132,24 +2375,61 @@ func (suite *ConnectionTestSuite) TestSessionApopSuccess() {
 
 	// THEN
 	assert.NoError(suite.T(), err)
-	banner := suite.conn.NextWrittenLine()
-	assert.True(suite.T(), strings.HasPrefix(banner, "+OK"))
-	assert.True(suite.T(), strings.Contains(banner, "<"))                          // Contains APOP banner
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // APOP response
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // QUIT response
+	assert.Contains(suite.T(), logOutput.String(), `user="testuser" authenticated=true retrieved=1 bytes_received=44 bytes_sent=`)
+	assert.Contains(suite.T(), logOutput.String(), `reason="quit"`)
 }
 
-func (suite *ConnectionTestSuite) TestSessionListAllMessages() {
+func (suite *ConnectionTestSuite) TestSessionVerboseLog() {
+	// GIVEN
+	logOutput := &strings.Builder{}
+	log.SetOutput(logOutput)
+	defer log.SetOutput(os.Stderr)
+	suite.conn.LinesToRead = []string{"NOOP\r\n", "QUIT\r\n"}
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)
+	assert.Contains(suite.T(), logOutput.String(), "C->S: NOOP")
+	assert.Contains(suite.T(), logOutput.String(), "S->C: +OK POP3 server ready")
+}
+
+func (suite *ConnectionTestSuite) TestSessionVerboseDisabled() {
+	// GIVEN
+	logOutput := &strings.Builder{}
+	log.SetOutput(logOutput)
+	defer log.SetOutput(os.Stderr)
+	suite.conn.LinesToRead = []string{"NOOP\r\n", "QUIT\r\n"}
+	suite.session.Verbose = false
+
+	// WHEN
+	err := suite.session.Serve()
+
+	// THEN
+	assert.NoError(suite.T(), err)
+	assert.NotContains(suite.T(), logOutput.String(), "C->S")
+	assert.NotContains(suite.T(), logOutput.String(), "S->C")
+	assert.Contains(suite.T(), logOutput.String(), "Session summary:")
+}
+
+func (suite *ConnectionTestSuite) TestSessionBytesTransferred() {
 	// GIVEN
 	suite.conn.LinesToRead = []string{
 		"USER testuser\r\n",
 		"PASS testpass\r\n",
-		"LIST\r\n",
+		"RETR 1\r\n",
 		"QUIT\r\n",
 	}
+	bytesIn := 0
+	for _, line := range suite.conn.LinesToRead {
+		bytesIn += len(line)
+	}
+	messageContent := strings.Repeat("0123456789", 1000) + "\r\n"
 	mailbox := mocks.NewMailbox(suite.T())
-	mailbox.On("Stat").Return(2, 1024, nil).Once() // Called during auth
-	mailbox.On("List").Return([]int{500, 524}, nil)
+	mailbox.On("Stat").Return(2, 1024, nil).Once()         // Called during auth
+	mailbox.On("List").Return([]int{500, 524}, nil).Once() // Called during auth
+	mailbox.On("Message", 0).Return(io.NopCloser(strings.NewReader(messageContent)), nil)
 	mailbox.On("Close").Return(nil).Once() // Called during QUIT
 	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
 	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
@@ -159,28 +2439,27 @@ func (suite *ConnectionTestSuite) TestSessionListAllMessages() {
 
 	// THEN
 	assert.NoError(suite.T(), err)
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Banner
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // USER response
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // PASS response
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // LIST response
-	assert.Equal(suite.T(), "1 500\r\n", suite.conn.NextWrittenLine())
-	assert.Equal(suite.T(), "2 524\r\n", suite.conn.NextWrittenLine())
-	assert.Equal(suite.T(), ".\r\n", suite.conn.NextWrittenLine())
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // QUIT response
+	bytesOut := 0
+	for line := suite.conn.NextWrittenLine(); line != ""; line = suite.conn.NextWrittenLine() {
+		bytesOut += len(line)
+	}
+	assert.Greater(suite.T(), bytesOut, len(messageContent))
+	assert.EqualValues(suite.T(), bytesOut, suite.session.BytesOut())
+	assert.EqualValues(suite.T(), bytesIn, suite.session.BytesIn())
 }
 
-func (suite *ConnectionTestSuite) TestSessionListSingleMessageSuccess() {
+func (suite *ConnectionTestSuite) TestSessionRetrInvalidMessageNumber() {
 	// GIVEN
 	suite.conn.LinesToRead = []string{
 		"USER testuser\r\n",
 		"PASS testpass\r\n",
-		"LIST 1\r\n",
+		"RETR 999\r\n", // Message number beyond mailbox size
 		"QUIT\r\n",
 	}
 	mailbox := mocks.NewMailbox(suite.T())
-	mailbox.On("Stat").Return(2, 1024, nil).Once() // Called during auth
-	mailbox.On("ListOne", 0).Return(500, nil)      // Internal index is 0-based for message #1
-	mailbox.On("Close").Return(nil).Once()         // Called during QUIT
+	mailbox.On("Stat").Return(2, 1024, nil).Once()         // Called during auth
+	mailbox.On("List").Return([]int{500, 524}, nil).Once() // Called during auth
+	mailbox.On("Close").Return(nil).Once()                 // Called during QUIT
 	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
 	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
 
@@ -189,26 +2468,29 @@ func (suite *ConnectionTestSuite) TestSessionListSingleMessageSuccess() {
 
 	// THEN
 	assert.NoError(suite.T(), err)
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Banner
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // USER response
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // PASS response
-	assert.Equal(suite.T(), "+OK 1 500\r\n", suite.conn.NextWrittenLine())         // LIST response with size
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // QUIT response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))  // Banner
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))  // USER response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))  // PASS response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "-ERR")) // RETR response with error
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))  // QUIT response
 }
 
-func (suite *ConnectionTestSuite) TestSessionListInvalidMessageNumber() {
+func (suite *ConnectionTestSuite) TestSessionRetrDeletedMessage() {
 	// GIVEN
 	suite.conn.LinesToRead = []string{
 		"USER testuser\r\n",
 		"PASS testpass\r\n",
-		"LIST 999\r\n", // Message number beyond mailbox size
+		"DELE 1\r\n",
+		"RETR 1\r\n",
 		"QUIT\r\n",
 	}
 	mailbox := mocks.NewMailbox(suite.T())
-	mailbox.On("Stat").Return(2, 1024, nil).Once() // Called during auth
-	mailbox.On("Close").Return(nil).Once()         // Called during QUIT
+	mailbox.On("Stat").Return(2, 1024, nil).Once()         // Called during auth
+	mailbox.On("List").Return([]int{500, 524}, nil).Once() // Called during auth
+	mailbox.On("Close").Return(nil).Once()                 // Called during QUIT
 	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
 	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
+	mailbox.On("Dele", 0).Return(nil).Once() // Called during QUIT
 
 	// WHEN
 	err := suite.session.Serve()
@@ -218,21 +2500,25 @@ func (suite *ConnectionTestSuite) TestSessionListInvalidMessageNumber() {
 	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))  // Banner
 	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))  // USER response
 	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))  // PASS response
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "-ERR")) // LIST response with error
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))  // DELE response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "-ERR")) // RETR response (message deleted)
 	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))  // QUIT response
 }
 
-func (suite *ConnectionTestSuite) TestSessionCloseError() {
+func (suite *ConnectionTestSuite) TestSessionRetrMessageError() {
 	// GIVEN
 	suite.conn.LinesToRead = []string{
 		"USER testuser\r\n",
 		"PASS testpass\r\n",
+		"RETR 1\r\n",
 		"QUIT\r\n",
 	}
-	expectedErr := errors.New("close error")
+	expectedErr := errors.New("message access error")
 	mailbox := mocks.NewMailbox(suite.T())
-	mailbox.On("Stat").Return(2, 1024, nil).Once() // Called during auth
-	mailbox.On("Close").Return(expectedErr).Once() // Called during QUIT
+	mailbox.On("Stat").Return(2, 1024, nil).Once()         // Called during auth
+	mailbox.On("List").Return([]int{500, 524}, nil).Once() // Called during auth
+	mailbox.On("Message", 0).Return(nil, expectedErr)      // Message access fails
+	mailbox.On("Close").Return(nil).Once()                 // Called during QUIT
 	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
 	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
 
@@ -240,25 +2526,32 @@ func (suite *ConnectionTestSuite) TestSessionCloseError() {
 	err := suite.session.Serve()
 
 	// THEN
-	assert.NoError(suite.T(), err)                                                  // Server continues despite Close error
+	assert.NoError(suite.T(), err)
 	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))  // Banner
 	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))  // USER response
 	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))  // PASS response
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "-ERR")) // QUIT response with error
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "-ERR")) // RETR response with error
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))  // QUIT response
 }
 
-func (suite *ConnectionTestSuite) TestSessionStat() {
+func (suite *ConnectionTestSuite) TestSessionRetrClientDisconnect() {
 	// GIVEN
 	suite.conn.LinesToRead = []string{
 		"USER testuser\r\n",
 		"PASS testpass\r\n",
-		"STAT\r\n",
+		"DELE 2\r\n",
+		"RETR 1\r\n",
 		"QUIT\r\n",
 	}
+	writeErr := errors.New("connection reset by peer")
+	suite.conn.WriteErr = writeErr
+	suite.conn.WriteErrAfter = 1024
+	messageContent := strings.Repeat("Test message body line\r\n", 1000)
 	mailbox := mocks.NewMailbox(suite.T())
-	mailbox.On("Stat").Return(2, 1024, nil).Once() // Called during auth
-	mailbox.On("Stat").Return(2, 1024, nil).Once() // Called for STAT command
-	mailbox.On("Close").Return(nil).Once()
+	mailbox.On("Stat").Return(2, 1024, nil).Once()                                        // Called during auth
+	mailbox.On("List").Return([]int{500, 524}, nil).Once()                                // Called during auth
+	mailbox.On("Message", 0).Return(io.NopCloser(strings.NewReader(messageContent)), nil) // Internal index is 0-based
+	mailbox.On("Close").Return(nil).Once()                                                // Called without Dele
 	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
 	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
 
@@ -266,59 +2559,125 @@ func (suite *ConnectionTestSuite) TestSessionStat() {
 	err := suite.session.Serve()
 
 	// THEN
-	assert.NoError(suite.T(), err)
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Banner
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // USER response
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // PASS response
-	assert.Equal(suite.T(), "+OK 2 1024\r\n", suite.conn.NextWrittenLine())        // STAT response
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // QUIT response
+	assert.ErrorIs(suite.T(), err, pop3srv.ErrConnectionLost)
+	assert.ErrorIs(suite.T(), err, writeErr)
+	mailbox.AssertNotCalled(suite.T(), "Dele", mock.Anything) // QUIT wasn't issued
+	assert.Equal(suite.T(), []string{"QUIT\r\n"}, suite.conn.LinesToRead)
 }
 
-func (suite *ConnectionTestSuite) TestSessionTop() {
+func (suite *ConnectionTestSuite) TestSessionMaxBytesPerSecond() {
 	// GIVEN
 	suite.conn.LinesToRead = []string{
 		"USER testuser\r\n",
 		"PASS testpass\r\n",
-		"TOP 1 2\r\n",
+		"RETR 1\r\n",
 		"QUIT\r\n",
 	}
-	messageContent := "Subject: Test\r\n\r\nLine1\r\nLine2\r\nLine3\r\n"
+	suite.session.MaxBytesPerSecond = 2000
+	messageContent := strings.Repeat("Test message body line\r\n", 42) // 1008 bytes
 	mailbox := mocks.NewMailbox(suite.T())
-	mailbox.On("Stat").Return(2, 1024, nil).Once()
+	mailbox.On("Stat").Return(1, 1008, nil).Once()     // Called during auth
+	mailbox.On("List").Return([]int{1008}, nil).Once() // Called during auth
 	mailbox.On("Message", 0).Return(io.NopCloser(strings.NewReader(messageContent)), nil)
 	mailbox.On("Close").Return(nil).Once()
 	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
 	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
 
 	// WHEN
+	start := time.Now()
 	err := suite.session.Serve()
 
 	// THEN
 	assert.NoError(suite.T(), err)
+	assert.GreaterOrEqual(suite.T(), time.Since(start), 500*time.Millisecond)
 	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Banner
 	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // USER response
 	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // PASS response
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // TOP response
-	assert.Equal(suite.T(), "Subject: Test\r\n", suite.conn.NextWrittenLine())
-	assert.Equal(suite.T(), "\r\n", suite.conn.NextWrittenLine())
-	assert.Equal(suite.T(), "Line1\r\n", suite.conn.NextWrittenLine())
-	assert.Equal(suite.T(), "Line2\r\n", suite.conn.NextWrittenLine())
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // RETR response
+	for range 42 {
+		assert.Equal(suite.T(), "Test message body line\r\n", suite.conn.NextWrittenLine())
+	}
 	assert.Equal(suite.T(), ".\r\n", suite.conn.NextWrittenLine())
 	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // QUIT response
 }
 
-func (suite *ConnectionTestSuite) TestSessionUidl() {
+func (suite *ConnectionTestSuite) TestSessionContinueOnRetrError() {
+	readErr := errors.New("storage error")
+	for _, c := range []struct {
+		name                string
+		continueOnRetrError bool
+		failOnWrite         int
+		message             io.Reader
+		sentBody            []string
+	}{
+		{name: "read error fail-fast", message: iotest.ErrReader(readErr)},
+		{
+			name:     "mid-body read error fail-fast",
+			message:  io.MultiReader(strings.NewReader("Test message body\r\n"), iotest.ErrReader(readErr)),
+			sentBody: []string{"Test message body\r\n"},
+		},
+		{name: "read error continue", continueOnRetrError: true, message: iotest.ErrReader(readErr)},
+		{name: "write error continue", continueOnRetrError: true, failOnWrite: 4, message: strings.NewReader("Test message body\r\n")},
+	} {
+		suite.Run(c.name, func() {
+			// GIVEN
+			conn := &failingWriteConn{ConnMock: mocks.NewConnMock(), failOnWrite: c.failOnWrite}
+			conn.LinesToRead = []string{
+				"USER testuser\r\n",
+				"PASS testpass\r\n",
+				"RETR 1\r\n", // 4th write: banner, USER, PASS, RETR
+				"QUIT\r\n",
+			}
+			mailbox := mocks.NewMailbox(suite.T())
+			mailbox.On("Stat").Return(1, 500, nil).Once()     // Called during auth
+			mailbox.On("List").Return([]int{500}, nil).Once() // Called during auth
+			mailbox.On("Message", 0).Return(io.NopCloser(c.message), nil)
+			mailbox.On("Close").Return(nil).Once()
+			provider := mocks.NewMailboxProvider(suite.T())
+			provider.On("Provide", "testuser").Return(mailbox, nil)
+			suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
+			session := pop3srv.NewSession(conn, provider, suite.authorizer)
+			session.ContinueOnRetrError = c.continueOnRetrError
+
+			// WHEN
+			err := session.Serve()
+
+			// THEN
+			if !c.continueOnRetrError {
+				assert.ErrorIs(suite.T(), err, readErr)
+				assert.Equal(suite.T(), []string{"QUIT\r\n"}, conn.LinesToRead) // session ended
+				for range 4 {
+					conn.NextWrittenLine() // Banner, USER, PASS and RETR responses
+				}
+				var body []string
+				for line := conn.NextWrittenLine(); line != ""; line = conn.NextWrittenLine() {
+					body = append(body, line)
+				}
+				assert.Equal(suite.T(), c.sentBody, body) // no terminating dot line
+				return
+			}
+			assert.NoError(suite.T(), err)
+			assert.True(suite.T(), strings.HasPrefix(conn.NextWrittenLine(), "+OK")) // Banner
+			assert.True(suite.T(), strings.HasPrefix(conn.NextWrittenLine(), "+OK")) // USER response
+			assert.True(suite.T(), strings.HasPrefix(conn.NextWrittenLine(), "+OK")) // PASS response
+			assert.Equal(suite.T(), "-ERR [SYS/TEMP] message can't be sent\r\n", conn.NextWrittenLine())
+			assert.True(suite.T(), strings.HasPrefix(conn.NextWrittenLine(), "+OK")) // QUIT response
+		})
+	}
+}
+
+func (suite *ConnectionTestSuite) TestSessionDisconnectAfterDele() {
 	// GIVEN
 	suite.conn.LinesToRead = []string{
 		"USER testuser\r\n",
 		"PASS testpass\r\n",
-		"UIDL\r\n",
-		"QUIT\r\n",
+		"DELE 1\r\n",
+		"DELE 2\r\n",
 	}
 	mailbox := mocks.NewMailbox(suite.T())
-	mailbox.On("Stat").Return(2, 1024, nil).Once()
-	mailbox.On("Uidl").Return([]string{"uid1", "uid2"}, nil)
-	mailbox.On("Close").Return(nil).Once()
+	mailbox.On("Stat").Return(2, 1024, nil).Once()         // Called during auth
+	mailbox.On("List").Return([]int{500, 524}, nil).Once() // Called during auth
+	mailbox.On("Close").Return(nil).Once()                 // Called on disconnect, without Dele
 	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
 	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
 
@@ -326,29 +2685,31 @@ func (suite *ConnectionTestSuite) TestSessionUidl() {
 	err := suite.session.Serve()
 
 	// THEN
-	assert.NoError(suite.T(), err)
+	assert.ErrorIs(suite.T(), err, io.EOF)
+	mailbox.AssertNotCalled(suite.T(), "Dele", mock.Anything)
 	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Banner
 	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // USER response
 	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // PASS response
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // UIDL response
-	assert.Equal(suite.T(), "1 uid1\r\n", suite.conn.NextWrittenLine())
-	assert.Equal(suite.T(), "2 uid2\r\n", suite.conn.NextWrittenLine())
-	assert.Equal(suite.T(), ".\r\n", suite.conn.NextWrittenLine())
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // QUIT response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // DELE response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // DELE response
+	assert.Empty(suite.T(), suite.conn.NextWrittenLine())
 }
 
-func (suite *ConnectionTestSuite) TestSessionUidlSingleMessage() {
+func (suite *ConnectionTestSuite) TestSessionRset() {
 	// GIVEN
 	suite.conn.LinesToRead = []string{
 		"USER testuser\r\n",
 		"PASS testpass\r\n",
-		"UIDL 1\r\n",
+		"DELE 1\r\n",
+		"RSET\r\n",
+		"LIST 1\r\n",
 		"QUIT\r\n",
 	}
 	mailbox := mocks.NewMailbox(suite.T())
-	mailbox.On("Stat").Return(2, 1024, nil).Once() // Called during auth
-	mailbox.On("UidlOne", 0).Return("uid1", nil)   // Internal index is 0-based for message #1
-	mailbox.On("Close").Return(nil).Once()         // Called during QUIT
+	mailbox.On("Stat").Return(2, 1024, nil).Once()         // Called during auth
+	mailbox.On("List").Return([]int{500, 524}, nil).Once() // Called during auth
+	mailbox.On("List").Return([]int{500, 524}, nil).Once() // Called for LIST after RSET
+	mailbox.On("Close").Return(nil).Once()                 // Called during QUIT
 	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
 	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
 
@@ -360,21 +2721,29 @@ func (suite *ConnectionTestSuite) TestSessionUidlSingleMessage() {
 	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Banner
 	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // USER response
 	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // PASS response
-	assert.Equal(suite.T(), "+OK 1 uid1\r\n", suite.conn.NextWrittenLine())        // UIDL response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // DELE response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // RSET response
+	assert.Equal(suite.T(), "+OK 1 500\r\n", suite.conn.NextWrittenLine())         // LIST response
 	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // QUIT response
 }
 
-func (suite *ConnectionTestSuite) TestSessionUidlInvalidMessageNumber() {
+func (suite *ConnectionTestSuite) TestSessionRsetRestoresStat() {
 	// GIVEN
 	suite.conn.LinesToRead = []string{
 		"USER testuser\r\n",
 		"PASS testpass\r\n",
-		"UIDL 999\r\n", // Message number beyond mailbox size
+		"DELE 1\r\n",
+		"DELE 2\r\n",
+		"STAT\r\n",
+		"RSET\r\n",
+		"STAT\r\n",
 		"QUIT\r\n",
 	}
 	mailbox := mocks.NewMailbox(suite.T())
-	mailbox.On("Stat").Return(2, 1024, nil).Once() // Called during auth
-	mailbox.On("Close").Return(nil).Once()         // Called during QUIT
+	mailbox.On("Stat").Return(2, 1024, nil).Once()         // Called during auth
+	mailbox.On("List").Return([]int{500, 524}, nil).Once() // Called during auth
+	mailbox.On("List").Return([]int{500, 524}, nil).Once() // STAT after RSET
+	mailbox.On("Close").Return(nil).Once()                 // Called during QUIT
 	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
 	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
 
@@ -383,28 +2752,24 @@ func (suite *ConnectionTestSuite) TestSessionUidlInvalidMessageNumber() {
 
 	// THEN
 	assert.NoError(suite.T(), err)
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))  // Banner
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))  // USER response
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))  // PASS response
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "-ERR")) // UIDL response with error
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))  // QUIT response
+	mailbox.AssertNotCalled(suite.T(), "Dele", mock.Anything)
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Banner
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // USER response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // PASS response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // DELE #1 response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // DELE #2 response
+	assert.Equal(suite.T(), "+OK 0 0\r\n", suite.conn.NextWrittenLine())           // STAT after DELE
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // RSET response
+	assert.Equal(suite.T(), "+OK 2 1024\r\n", suite.conn.NextWrittenLine())        // STAT after RSET
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // QUIT response
 }
 
-func (suite *ConnectionTestSuite) TestSessionUidlDeletedMessage() {
+func (suite *ConnectionTestSuite) TestSessionRsetBeforeAuth() {
 	// GIVEN
 	suite.conn.LinesToRead = []string{
-		"USER testuser\r\n",
-		"PASS testpass\r\n",
-		"DELE 1\r\n",
-		"UIDL 1\r\n",
+		"RSET\r\n",
 		"QUIT\r\n",
 	}
-	mailbox := mocks.NewMailbox(suite.T())
-	mailbox.On("Stat").Return(2, 1024, nil).Once() // Called during auth
-	mailbox.On("Dele", 0).Return(nil).Once()       // Called during QUIT
-	mailbox.On("Close").Return(nil).Once()         // Called during QUIT
-	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
-	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
 
 	// WHEN
 	err := suite.session.Serve()
@@ -412,24 +2777,27 @@ func (suite *ConnectionTestSuite) TestSessionUidlDeletedMessage() {
 	// THEN
 	assert.NoError(suite.T(), err)
 	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))  // Banner
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))  // USER response
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))  // PASS response
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))  // DELE response
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "-ERR")) // UIDL response (message deleted)
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "-ERR")) // RSET response (not authenticated)
 	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))  // QUIT response
 }
 
-func (suite *ConnectionTestSuite) TestSessionNoop() {
+func (suite *ConnectionTestSuite) TestSessionRsetMultipleMessages() {
 	// GIVEN
 	suite.conn.LinesToRead = []string{
 		"USER testuser\r\n",
 		"PASS testpass\r\n",
-		"NOOP\r\n",
+		"DELE 1\r\n",
+		"DELE 2\r\n",
+		"LIST\r\n",
+		"RSET\r\n",
+		"LIST\r\n",
 		"QUIT\r\n",
 	}
 	mailbox := mocks.NewMailbox(suite.T())
-	mailbox.On("Stat").Return(2, 1024, nil).Once()
-	mailbox.On("Close").Return(nil).Once()
+	mailbox.On("Stat").Return(2, 1024, nil).Once()         // Called during auth
+	mailbox.On("List").Return([]int{500, 524}, nil).Once() // Called during auth
+	mailbox.On("List").Return([]int{500, 524}, nil).Once() // List after RSET
+	mailbox.On("Close").Return(nil).Once()                 // Called during QUIT
 	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
 	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
 
@@ -441,23 +2809,35 @@ func (suite *ConnectionTestSuite) TestSessionNoop() {
 	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Banner
 	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // USER response
 	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // PASS response
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // NOOP response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // DELE #1 response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // DELE #2 response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // First LIST response
+	assert.Equal(suite.T(), ".\r\n", suite.conn.NextWrittenLine())                 // Empty list termination
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // RSET response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Second LIST response
+	assert.Equal(suite.T(), "1 500\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "2 524\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), ".\r\n", suite.conn.NextWrittenLine())
 	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // QUIT response
 }
 
-func (suite *ConnectionTestSuite) TestSessionRetrMessage() {
+func (suite *ConnectionTestSuite) TestSessionDeletedMessagesKeepNumbers() {
 	// GIVEN
 	suite.conn.LinesToRead = []string{
 		"USER testuser\r\n",
 		"PASS testpass\r\n",
-		"RETR 1\r\n",
+		"DELE 2\r\n",
+		"LIST\r\n",
+		"UIDL\r\n",
+		"LIST 3\r\n",
 		"QUIT\r\n",
 	}
-	messageContent := "From: sender@example.com\r\nTo: recipient@example.com\r\n\r\nTest message body\r\n"
 	mailbox := mocks.NewMailbox(suite.T())
-	mailbox.On("Stat").Return(2, 1024, nil).Once()                                        // Called during auth
-	mailbox.On("Message", 0).Return(io.NopCloser(strings.NewReader(messageContent)), nil) // Internal index is 0-based
-	mailbox.On("Close").Return(nil).Once()                                                // Called during QUIT
+	mailbox.On("Stat").Return(3, 1524, nil).Once()              // Called during auth
+	mailbox.On("List").Return([]int{500, 524, 500}, nil).Once() // Called during auth
+	mailbox.On("Uidl").Return([]string{"uid1", "uid2", "uid3"}, nil).Once()
+	mailbox.On("Dele", 1).Return(nil).Once() // Called during QUIT
+	mailbox.On("Close").Return(nil).Once()   // Called during QUIT
 	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
 	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
 
@@ -469,114 +2849,126 @@ func (suite *ConnectionTestSuite) TestSessionRetrMessage() {
 	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Banner
 	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // USER response
 	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // PASS response
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // RETR response
-	assert.Equal(suite.T(), "From: sender@example.com\r\n", suite.conn.NextWrittenLine())
-	assert.Equal(suite.T(), "To: recipient@example.com\r\n", suite.conn.NextWrittenLine())
-	assert.Equal(suite.T(), "\r\n", suite.conn.NextWrittenLine())
-	assert.Equal(suite.T(), "Test message body\r\n", suite.conn.NextWrittenLine())
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // DELE response
+	assert.Equal(suite.T(), "+OK 2 messages in mailbox\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "1 500\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "3 500\r\n", suite.conn.NextWrittenLine()) // not renumbered
+	assert.Equal(suite.T(), ".\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "+OK 2 messages in mailbox\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "1 uid1\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "3 uid3\r\n", suite.conn.NextWrittenLine()) // not renumbered
 	assert.Equal(suite.T(), ".\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "+OK 3 500\r\n", suite.conn.NextWrittenLine())         // LIST 3 response
 	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // QUIT response
 }
 
-func (suite *ConnectionTestSuite) TestSessionRetrInvalidMessageNumber() {
+func (suite *ConnectionTestSuite) TestSessionPendingDeletions() {
 	// GIVEN
 	suite.conn.LinesToRead = []string{
 		"USER testuser\r\n",
 		"PASS testpass\r\n",
-		"RETR 999\r\n", // Message number beyond mailbox size
+		"DELE 3\r\n",
+		"DELE 1\r\n",
+		"XPENDING\r\n",
+		"RSET\r\n",
+		"XPENDING\r\n",
+		"DELE 2\r\n",
+		"XPENDING\r\n",
 		"QUIT\r\n",
 	}
 	mailbox := mocks.NewMailbox(suite.T())
-	mailbox.On("Stat").Return(2, 1024, nil).Once() // Called during auth
-	mailbox.On("Close").Return(nil).Once()         // Called during QUIT
+	mailbox.On("Stat").Return(3, 1524, nil).Once()              // Called during auth
+	mailbox.On("List").Return([]int{500, 524, 500}, nil).Once() // Called during auth
+	mailbox.On("Dele", 1).Return(nil).Once()                    // Called during QUIT
+	mailbox.On("Close").Return(nil).Once()                      // Called during QUIT
 	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
 	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
+	var pending [][]int
+	suite.session.HandleCommand(pop3srv.TransactionState, "XPENDING", func(s *pop3srv.Session, _ []string) error {
+		pending = append(pending, s.PendingDeletions())
+		return s.WriteResponse("", nil)
+	})
 
 	// WHEN
 	err := suite.session.Serve()
 
 	// THEN
 	assert.NoError(suite.T(), err)
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))  // Banner
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))  // USER response
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))  // PASS response
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "-ERR")) // RETR response with error
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))  // QUIT response
+	require.Len(suite.T(), pending, 3)
+	assert.Equal(suite.T(), []int{1, 3}, pending[0])
+	assert.Empty(suite.T(), pending[1]) // after RSET
+	assert.Equal(suite.T(), []int{2}, pending[2])
+	assert.Equal(suite.T(), []int{2}, suite.session.PendingDeletions())
 }
 
-func (suite *ConnectionTestSuite) TestSessionRetrDeletedMessage() {
+func (suite *ConnectionTestSuite) TestSessionCapaAllSupported() {
 	// GIVEN
 	suite.conn.LinesToRead = []string{
-		"USER testuser\r\n",
-		"PASS testpass\r\n",
-		"DELE 1\r\n",
-		"RETR 1\r\n",
+		"CAPA\r\n",
 		"QUIT\r\n",
 	}
-	mailbox := mocks.NewMailbox(suite.T())
-	mailbox.On("Stat").Return(2, 1024, nil).Once() // Called during auth
-	mailbox.On("Close").Return(nil).Once()         // Called during QUIT
-	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
-	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
-	mailbox.On("Dele", 0).Return(nil).Once() // Called during QUIT
+	suite.mockAuthorizer.ExpectedCalls = nil
+	suite.mockAuthorizer.On("UserPass", "", "").Return(nil) // USER/PASS supported
+	suite.mockAuthorizer.On("Apop", "", "", "").Return(nil) // APOP supported
 
 	// WHEN
 	err := suite.session.Serve()
 
 	// THEN
 	assert.NoError(suite.T(), err)
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))  // Banner
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))  // USER response
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))  // PASS response
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))  // DELE response
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "-ERR")) // RETR response (message deleted)
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))  // QUIT response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Banner
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // CAPA response
+	assert.Equal(suite.T(), "USER\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "TOP\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "UIDL\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "RESP-CODES\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "AUTH-RESP-CODE\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "IMPLEMENTATION pop3srv\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), ".\r\n", suite.conn.NextWrittenLine())
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // QUIT response
 }
 
-func (suite *ConnectionTestSuite) TestSessionRetrMessageError() {
+func (suite *ConnectionTestSuite) TestSessionCapaWithoutImplementation() {
 	// GIVEN
 	suite.conn.LinesToRead = []string{
-		"USER testuser\r\n",
-		"PASS testpass\r\n",
-		"RETR 1\r\n",
+		"CAPA\r\n",
 		"QUIT\r\n",
 	}
-	expectedErr := errors.New("message access error")
-	mailbox := mocks.NewMailbox(suite.T())
-	mailbox.On("Stat").Return(2, 1024, nil).Once()    // Called during auth
-	mailbox.On("Message", 0).Return(nil, expectedErr) // Message access fails
-	mailbox.On("Close").Return(nil).Once()            // Called during QUIT
-	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
-	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
+	suite.session.Implementation = ""
 
 	// WHEN
 	err := suite.session.Serve()
 
 	// THEN
 	assert.NoError(suite.T(), err)
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))  // Banner
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))  // USER response
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))  // PASS response
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "-ERR")) // RETR response with error
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))  // QUIT response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Banner
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // CAPA response
+	assert.Equal(suite.T(), "USER\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "TOP\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "UIDL\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "RESP-CODES\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "AUTH-RESP-CODE\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), ".\r\n", suite.conn.NextWrittenLine())
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // QUIT response
 }
 
-func (suite *ConnectionTestSuite) TestSessionRset() {
+func (suite *ConnectionTestSuite) TestSessionDisabledCommands() {
 	// GIVEN
 	suite.conn.LinesToRead = []string{
 		"USER testuser\r\n",
 		"PASS testpass\r\n",
-		"DELE 1\r\n",
-		"RSET\r\n",
-		"LIST 1\r\n",
+		"CAPA\r\n",
+		"TOP 1 0\r\n",
+		"STAT\r\n",
 		"QUIT\r\n",
 	}
 	mailbox := mocks.NewMailbox(suite.T())
-	mailbox.On("Stat").Return(2, 1024, nil).Once() // Called during auth
-	mailbox.On("ListOne", 0).Return(500, nil)      // Called after RSET
-	mailbox.On("Close").Return(nil).Once()         // Called during QUIT
+	mailbox.On("Stat").Return(2, 1024, nil).Once()         // Called during auth
+	mailbox.On("List").Return([]int{500, 524}, nil).Once() // Called during auth
+	mailbox.On("Close").Return(nil).Once()                 // Called during QUIT
 	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
 	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
+	suite.session.DisabledCommands = []string{"top"}
 
 	// WHEN
 	err := suite.session.Serve()
@@ -586,91 +2978,120 @@ func (suite *ConnectionTestSuite) TestSessionRset() {
 	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Banner
 	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // USER response
 	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // PASS response
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // DELE response
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // RSET response
-	assert.Equal(suite.T(), "+OK 1 500\r\n", suite.conn.NextWrittenLine())         // LIST response
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // QUIT response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // CAPA response
+	assert.Equal(suite.T(), "USER\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "UIDL\r\n", suite.conn.NextWrittenLine()) // no TOP
+	assert.Equal(suite.T(), "RESP-CODES\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "AUTH-RESP-CODE\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "IMPLEMENTATION pop3srv\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), ".\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "-ERR command disabled\r\n", suite.conn.NextWrittenLine()) // TOP response
+	assert.Equal(suite.T(), "+OK 2 1024\r\n", suite.conn.NextWrittenLine())            // STAT response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))     // QUIT response
 }
 
-func (suite *ConnectionTestSuite) TestSessionRsetBeforeAuth() {
+func (suite *ConnectionTestSuite) TestSessionAnnounce() {
 	// GIVEN
 	suite.conn.LinesToRead = []string{
-		"RSET\r\n",
+		"CAPA\r\n",
 		"QUIT\r\n",
 	}
+	suite.session.Announce("server going down\r\nin 5 minutes")
 
 	// WHEN
 	err := suite.session.Serve()
 
 	// THEN
 	assert.NoError(suite.T(), err)
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))  // Banner
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "-ERR")) // RSET response (not authenticated)
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK"))  // QUIT response
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Banner
+	assert.Equal(suite.T(), "+OK server going down  in 5 minutes\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "+OK Capability list follows\r\n", suite.conn.NextWrittenLine())
+	for line := suite.conn.NextWrittenLine(); line != ".\r\n"; line = suite.conn.NextWrittenLine() {
+		require.NotEmpty(suite.T(), line)
+	}
+	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // QUIT response, announced once
 }
 
-func (suite *ConnectionTestSuite) TestSessionRsetMultipleMessages() {
+// failingWriteConn fails n-th write (1-based) and counts writes.
+type failingWriteConn struct {
+	*mocks.ConnMock
+	failOnWrite int
+	writes      int
+}
+
+func (c *failingWriteConn) Write(p []byte) (int, error) {
+	c.writes++
+	if c.writes == c.failOnWrite {
+		return 0, errors.New("write failed")
+	}
+	return c.ConnMock.Write(p)
+}
+
+func (suite *ConnectionTestSuite) TestSessionListWriteError() {
 	// GIVEN
-	suite.conn.LinesToRead = []string{
+	sizes := make([]int, 5000) // LIST response doesn't fit in the write buffer
+	for i := range sizes {
+		sizes[i] = 100
+	}
+	conn := &failingWriteConn{ConnMock: mocks.NewConnMock(), failOnWrite: 6} // banner, USER, PASS and 3rd write of LIST
+	conn.LinesToRead = []string{
 		"USER testuser\r\n",
 		"PASS testpass\r\n",
-		"DELE 1\r\n",
-		"DELE 2\r\n",
-		"LIST\r\n",
-		"RSET\r\n",
 		"LIST\r\n",
 		"QUIT\r\n",
 	}
 	mailbox := mocks.NewMailbox(suite.T())
-	mailbox.On("Stat").Return(2, 1024, nil).Once()         // Called during auth
-	mailbox.On("List").Return(nil, nil).Once()             // Empty list when messages are deleted
-	mailbox.On("List").Return([]int{500, 524}, nil).Once() // List after RSET
-	mailbox.On("Close").Return(nil).Once()                 // Called during QUIT
+	mailbox.On("Stat").Return(len(sizes), 100*len(sizes), nil).Once() // Called during auth
+	mailbox.On("List").Return(sizes, nil).Once()                      // Called during auth
+	mailbox.On("Close").Return(nil).Once()                            // Called without Dele
 	suite.mockAuthorizer.On("UserPass", "testuser", "testpass").Return(nil)
 	suite.provider.On("Provide", "testuser").Return(mailbox, nil)
+	session := pop3srv.NewSession(conn, suite.provider, suite.authorizer)
 
 	// WHEN
-	err := suite.session.Serve()
+	err := session.Serve()
 
 	// THEN
-	assert.NoError(suite.T(), err)
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Banner
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // USER response
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // PASS response
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // DELE #1 response
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // DELE #2 response
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // First LIST response
-	assert.Equal(suite.T(), ".\r\n", suite.conn.NextWrittenLine())                 // Empty list termination
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // RSET response
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Second LIST response
-	assert.Equal(suite.T(), "1 500\r\n", suite.conn.NextWrittenLine())
-	assert.Equal(suite.T(), "2 524\r\n", suite.conn.NextWrittenLine())
-	assert.Equal(suite.T(), ".\r\n", suite.conn.NextWrittenLine())
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // QUIT response
+	assert.ErrorIs(suite.T(), err, pop3srv.ErrConnectionLost) // not a protocol error
+	assert.Equal(suite.T(), 6, conn.writes)                   // nothing written after the failure
+	assert.Equal(suite.T(), []string{"QUIT\r\n"}, conn.LinesToRead)
+	lines := 0
+	for line := conn.NextWrittenLine(); line != ""; line = conn.NextWrittenLine() {
+		assert.NotEqual(suite.T(), ".\r\n", line)
+		lines++
+	}
+	assert.Less(suite.T(), lines, len(sizes))
 }
 
-func (suite *ConnectionTestSuite) TestSessionCapaAllSupported() {
-	// GIVEN
-	suite.conn.LinesToRead = []string{
-		"CAPA\r\n",
-		"QUIT\r\n",
+func (suite *ConnectionTestSuite) TestSessionCapaSingleWrite() {
+	for _, c := range []struct {
+		name        string
+		failOnWrite int
+	}{
+		{name: "success"},
+		{name: "write failure", failOnWrite: 2}, // banner is the first write
+	} {
+		suite.Run(c.name, func() {
+			// GIVEN
+			conn := &failingWriteConn{ConnMock: mocks.NewConnMock(), failOnWrite: c.failOnWrite}
+			conn.LinesToRead = []string{"CAPA\r\n"}
+			session := pop3srv.NewSession(conn, suite.provider, suite.authorizer)
+
+			// WHEN
+			err := session.Serve()
+
+			// THEN
+			assert.True(suite.T(), strings.HasPrefix(conn.NextWrittenLine(), "+OK")) // Banner
+			if c.failOnWrite > 0 {
+				assert.ErrorIs(suite.T(), err, pop3srv.ErrConnectionLost)
+				assert.Empty(suite.T(), conn.NextWrittenLine()) // nothing of CAPA response sent
+			} else {
+				assert.ErrorIs(suite.T(), err, io.EOF)
+				assert.True(suite.T(), strings.HasPrefix(conn.NextWrittenLine(), "+OK")) // CAPA response
+			}
+			assert.Equal(suite.T(), 2, conn.writes) // whole CAPA response in single write
+		})
 	}
-	suite.mockAuthorizer.ExpectedCalls = nil
-	suite.mockAuthorizer.On("UserPass", "", "").Return(nil) // USER/PASS supported
-	suite.mockAuthorizer.On("Apop", "", "", "").Return(nil) // APOP supported
-
-	// WHEN
-	err := suite.session.Serve()
-
-	// THEN
-	assert.NoError(suite.T(), err)
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // Banner
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // CAPA response
-	assert.Equal(suite.T(), "USER\r\n", suite.conn.NextWrittenLine())
-	assert.Equal(suite.T(), "TOP\r\n", suite.conn.NextWrittenLine())
-	assert.Equal(suite.T(), "UIDL\r\n", suite.conn.NextWrittenLine())
-	assert.Equal(suite.T(), ".\r\n", suite.conn.NextWrittenLine())
-	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // QUIT response
 }
 
 func (suite *ConnectionTestSuite) TestSessionCapaUserPassDisabled() {
@@ -695,6 +3116,9 @@ func (suite *ConnectionTestSuite) TestSessionCapaUserPassDisabled() {
 	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // CAPA response
 	assert.Equal(suite.T(), "TOP\r\n", suite.conn.NextWrittenLine())
 	assert.Equal(suite.T(), "UIDL\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "RESP-CODES\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "AUTH-RESP-CODE\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "IMPLEMENTATION pop3srv\r\n", suite.conn.NextWrittenLine())
 	assert.Equal(suite.T(), ".\r\n", suite.conn.NextWrittenLine())
 	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // QUIT response
 }
@@ -709,6 +3133,7 @@ func (suite *ConnectionTestSuite) TestSessionCapaAfterAuth() {
 	}
 	mailbox := mocks.NewMailbox(suite.T())
 	mailbox.On("Stat").Return(2, 1024, nil).Once()          // Called during auth
+	mailbox.On("List").Return([]int{500, 524}, nil).Once()  // Called during auth
 	mailbox.On("Close").Return(nil).Once()                  // Called during QUIT
 	suite.mockAuthorizer.On("UserPass", "", "").Return(nil) // USER/PASS supported
 	suite.mockAuthorizer.On("Apop", "", "", "").Return(nil) // APOP supported
@@ -727,6 +3152,9 @@ func (suite *ConnectionTestSuite) TestSessionCapaAfterAuth() {
 	assert.Equal(suite.T(), "USER\r\n", suite.conn.NextWrittenLine())
 	assert.Equal(suite.T(), "TOP\r\n", suite.conn.NextWrittenLine())
 	assert.Equal(suite.T(), "UIDL\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "RESP-CODES\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "AUTH-RESP-CODE\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "IMPLEMENTATION pop3srv\r\n", suite.conn.NextWrittenLine())
 	assert.Equal(suite.T(), ".\r\n", suite.conn.NextWrittenLine())
 	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // QUIT response
 }
@@ -754,6 +3182,327 @@ func (suite *ConnectionTestSuite) TestSessionCapaDisabledApop() {
 	assert.Equal(suite.T(), "USER\r\n", suite.conn.NextWrittenLine())
 	assert.Equal(suite.T(), "TOP\r\n", suite.conn.NextWrittenLine())
 	assert.Equal(suite.T(), "UIDL\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "RESP-CODES\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "AUTH-RESP-CODE\r\n", suite.conn.NextWrittenLine())
+	assert.Equal(suite.T(), "IMPLEMENTATION pop3srv\r\n", suite.conn.NextWrittenLine())
 	assert.Equal(suite.T(), ".\r\n", suite.conn.NextWrittenLine())
 	assert.True(suite.T(), strings.HasPrefix(suite.conn.NextWrittenLine(), "+OK")) // QUIT response
 }
+
+type benchmarkMailbox struct {
+	pop3srv.EmptyMailbox
+	message string
+	count   int
+}
+
+func (m benchmarkMailbox) Stat() (int, int, error) {
+	return m.count, m.count * len(m.message), nil
+}
+
+func (m benchmarkMailbox) List() ([]int, error) {
+	sizes := make([]int, m.count)
+	for i := range sizes {
+		sizes[i] = len(m.message)
+	}
+	return sizes, nil
+}
+
+func (m benchmarkMailbox) Message(_ int) (io.ReadCloser, error) {
+	return io.NopCloser(strings.NewReader(m.message)), nil
+}
+
+type benchmarkProvider struct {
+	mailbox pop3srv.Mailbox
+}
+
+func (p benchmarkProvider) Provide(_ string) (pop3srv.Mailbox, error) {
+	return p.mailbox, nil
+}
+
+func BenchmarkSessionManySmallRetr(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	const messages = 100
+	provider := benchmarkProvider{mailbox: benchmarkMailbox{
+		message: "Subject: Test\r\n\r\nLine1\r\nLine2\r\n",
+		count:   messages,
+	}}
+	lines := []string{"USER testuser\r\n", "PASS testpass\r\n"}
+	for i := range messages {
+		lines = append(lines, fmt.Sprintf("RETR %d\r\n", i+1))
+	}
+	lines = append(lines, "QUIT\r\n")
+
+	b.ReportAllocs()
+	for range b.N {
+		conn := mocks.NewConnMock()
+		conn.LinesToRead = slices.Clone(lines)
+		session := pop3srv.NewSession(conn, provider, pop3srv.AllowAllAuthorizer{})
+		if err := session.Serve(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestSessionEmptyMailboxNoSuchMessage(t *testing.T) {
+	// GIVEN
+	commands := []string{"USER testuser", "PASS testpass", "RETR 1", "LIST 1", "UIDL 1", "TOP 1 0", "DELE 1", "QUIT"}
+
+	// WHEN
+	responses, err := pop3srv.ServeStrings(pop3srv.EmptyMailboxProvider{}, pop3srv.AllowAllAuthorizer{}, commands)
+
+	// THEN
+	assert.NoError(t, err)
+	assert.Len(t, responses, 9) // including banner
+	for _, response := range responses[3:8] {
+		assert.Equal(t, "-ERR no such message", response)
+	}
+}
+
+// halfCloseConn adds half-close to [net.Pipe] connection
+// and records CloseWrite and Close calls.
+type halfCloseConn struct {
+	net.Conn
+	calls []string
+}
+
+func (c *halfCloseConn) CloseWrite() error {
+	c.calls = append(c.calls, "CloseWrite")
+	return nil
+}
+
+func (c *halfCloseConn) Close() error {
+	c.calls = append(c.calls, "Close")
+	return c.Conn.Close()
+}
+
+func TestSessionCloseLinger(t *testing.T) {
+	// GIVEN
+	serverConn, clientConn := net.Pipe()
+	conn := &halfCloseConn{Conn: serverConn}
+	session := pop3srv.NewSession(conn, pop3srv.EmptyMailboxProvider{}, pop3srv.AllowAllAuthorizer{})
+	session.CloseLinger = time.Minute
+	errCh := make(chan error)
+	go func() { errCh <- session.Serve() }()
+	client := textproto.NewConn(clientConn)
+
+	// WHEN
+	_, err := client.ReadLine() // Banner
+	require.NoError(t, err)
+	require.NoError(t, client.PrintfLine("QUIT"))
+	farewell, err := client.ReadLine()
+	require.NoError(t, err)
+	// data sent after QUIT is read by the server until client closes
+	require.NoError(t, client.PrintfLine("NOOP"))
+	clientConn.Close()
+
+	// THEN
+	assert.NoError(t, <-errCh)
+	assert.Equal(t, "+OK server signing off", farewell)
+	assert.Equal(t, []string{"CloseWrite", "Close"}, conn.calls)
+}
+
+func TestSessionStatusLineFormat(t *testing.T) {
+	// GIVEN
+	statusLine := regexp.MustCompile(`^(\+OK|-ERR)( \S.*\S| \S)?$`) // no trailing or double space
+	commands := []string{
+		"NOOP", "FOO", "USER", "PASS test", "USER test", "STAT", "PASS test",
+		"STAT", "LIST 1", "UIDL 1", "RETR 1", "DELE 1", "NOOP", "RSET", "QUIT",
+	}
+
+	// WHEN
+	responses, err := pop3srv.ServeStrings(pop3srv.EmptyMailboxProvider{}, pop3srv.DisableApop(pop3srv.AllowAllAuthorizer{}), commands)
+
+	// THEN
+	require.NoError(t, err)
+	require.Len(t, responses, len(commands)+1) // greeting and single-line responses
+	for _, response := range responses {
+		assert.Regexp(t, statusLine, response)
+	}
+	assert.Equal(t, "+OK POP3 server ready", responses[0])
+}
+
+func TestSessionConnectionTimeout(t *testing.T) {
+	// GIVEN
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	session := pop3srv.NewSession(serverConn, pop3srv.EmptyMailboxProvider{}, pop3srv.AllowAllAuthorizer{})
+	session.ConnectionTimeout = 50 * time.Millisecond
+	session.Logger = log.New(io.Discard, "", 0)
+	errCh := make(chan error)
+	go func() { errCh <- session.Serve() }()
+	client := textproto.NewConn(clientConn)
+
+	// WHEN
+	_, err := client.ReadLine() // Banner
+	require.NoError(t, err)
+	require.NoError(t, client.PrintfLine("NOOP")) // resets the timeout
+	_, err = client.ReadLine()
+	require.NoError(t, err)
+	// client is idle now
+
+	// THEN
+	select {
+	case err := <-errCh:
+		assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	case <-time.After(5 * time.Second):
+		t.Fatal("session didn't time out")
+	}
+}
+
+// noDeadlineConn is a [pop3srv.Conn] without read deadlines, Close
+// doesn't interrupt pending Read (like some non-network connections).
+type noDeadlineConn struct {
+	io.Reader
+	io.Writer
+}
+
+func (noDeadlineConn) Close() error { return nil }
+
+func TestSessionConnectionTimeoutWithoutDeadline(t *testing.T) {
+	// GIVEN
+	clientR, clientW := io.Pipe()
+	defer clientW.Close()
+	session := pop3srv.NewSession(noDeadlineConn{clientR, io.Discard}, pop3srv.EmptyMailboxProvider{}, pop3srv.AllowAllAuthorizer{})
+	session.ConnectionTimeout = 50 * time.Millisecond
+	session.Logger = log.New(io.Discard, "", 0)
+
+	// WHEN
+	err := session.Serve()
+	// abandoned read completes while the next session is served
+	go clientW.Write([]byte("USER abandoned\r\n"))
+	conn := mocks.NewConnMock()
+	conn.LinesToRead = []string{"NOOP\r\n", "QUIT\r\n"}
+	next := pop3srv.NewSession(conn, pop3srv.EmptyMailboxProvider{}, pop3srv.AllowAllAuthorizer{})
+	next.Logger = log.New(io.Discard, "", 0)
+	errNext := next.Serve()
+
+	// THEN
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.NoError(t, errNext)
+	assert.True(t, strings.HasPrefix(conn.NextWrittenLine(), "+OK ")) // Banner
+	assert.Equal(t, "-ERR command not permitted in this state\r\n", conn.NextWrittenLine())
+	assert.Equal(t, "+OK server signing off\r\n", conn.NextWrittenLine())
+}
+
+func TestSessionNoopKeepalive(t *testing.T) {
+	// GIVEN
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	session := pop3srv.NewSession(serverConn, pop3srv.EmptyMailboxProvider{}, pop3srv.AllowAllAuthorizer{})
+	session.ConnectionTimeout = 200 * time.Millisecond
+	session.NoopResponse = "alive"
+	session.Logger = log.New(io.Discard, "", 0)
+	errCh := make(chan error, 1)
+	go func() { errCh <- session.Serve() }()
+	client := textproto.NewConn(clientConn)
+	_, err := client.ReadLine() // Banner
+	require.NoError(t, err)
+	sendCommand(t, client, "USER testuser")
+	sendCommand(t, client, "PASS testpass")
+
+	// WHEN
+	var responses []string
+	for range 4 { // 400ms in total, longer than ConnectionTimeout
+		time.Sleep(session.ConnectionTimeout / 2)
+		responses = append(responses, sendCommand(t, client, "NOOP"))
+	}
+	quitResponse := sendCommand(t, client, "QUIT")
+
+	// THEN
+	assert.Equal(t, []string{"+OK alive", "+OK alive", "+OK alive", "+OK alive"}, responses)
+	assert.True(t, strings.HasPrefix(quitResponse, "+OK"), quitResponse)
+	assert.NoError(t, <-errCh)
+}
+
+func TestSessionAuthTimeout(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		login bool
+	}{
+		{name: "not authenticated"},
+		{name: "authenticated", login: true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			// GIVEN
+			serverConn, clientConn := net.Pipe()
+			defer clientConn.Close()
+			session := pop3srv.NewSession(serverConn, pop3srv.EmptyMailboxProvider{}, pop3srv.AllowAllAuthorizer{})
+			session.AuthTimeout = 100 * time.Millisecond
+			session.Logger = log.New(io.Discard, "", 0)
+			errCh := make(chan error, 1)
+			go func() { errCh <- session.Serve() }()
+			client := textproto.NewConn(clientConn)
+			_, err := client.ReadLine() // Banner
+			require.NoError(t, err)
+			start := time.Now()
+
+			// WHEN
+			if c.login {
+				sendCommand(t, client, "USER testuser")
+				sendCommand(t, client, "PASS testpass")
+				time.Sleep(2 * session.AuthTimeout)
+				response := sendCommand(t, client, "NOOP")
+
+				// THEN
+				assert.True(t, strings.HasPrefix(response, "+OK"), response) // authenticated session isn't limited
+				return
+			}
+			response, err := client.ReadLine()
+
+			// THEN
+			require.NoError(t, err)
+			assert.Equal(t, "-ERR authentication timeout", response)
+			assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+			select {
+			case err := <-errCh:
+				assert.ErrorIs(t, err, pop3srv.ErrAuthTimeout)
+			case <-time.After(5 * time.Second):
+				t.Fatal("session didn't time out")
+			}
+		})
+	}
+}
+
+func TestSessionHandlerTimeout(t *testing.T) {
+	// GIVEN
+	release := make(chan struct{})
+	mailbox := mocks.NewMailbox(t)
+	mailbox.On("Stat").Return(1, 500, nil).Once()     // Called during auth
+	mailbox.On("List").Return([]int{500}, nil).Once() // Called during auth
+	mailbox.On("Message", 0).Run(func(mock.Arguments) { <-release }).
+		Return(io.NopCloser(strings.NewReader("Subject: slow\r\n\r\nbody\r\n")), nil).Once()
+	mailbox.On("Close").Return(nil).Once() // Called at the end of session, no Dele
+	provider := mocks.NewMailboxProvider(t)
+	provider.On("Provide", "testuser").Return(mailbox, nil)
+
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	session := pop3srv.NewSession(serverConn, provider, pop3srv.AllowAllAuthorizer{})
+	session.ConnectionTimeout = time.Minute
+	session.HandlerTimeout = 50 * time.Millisecond
+	session.Logger = log.New(io.Discard, "", 0)
+	errCh := make(chan error)
+	go func() { errCh <- session.Serve() }()
+	client := textproto.NewConn(clientConn)
+	cmd := func(line string) string {
+		require.NoError(t, client.PrintfLine("%s", line))
+		response, err := client.ReadLine()
+		require.NoError(t, err)
+		return response
+	}
+
+	// WHEN
+	_, err := client.ReadLine() // Banner
+	require.NoError(t, err)
+	cmd("USER testuser")
+	cmd("PASS testpass")
+	require.NoError(t, client.PrintfLine("RETR 1"))
+	_, errRetr := client.ReadLine() // blocked until the connection is closed
+	close(release)
+
+	// THEN
+	assert.ErrorIs(t, errRetr, io.EOF)
+	assert.ErrorIs(t, <-errCh, pop3srv.ErrHandlerTimeout)
+}
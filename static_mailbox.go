@@ -0,0 +1,117 @@
+package pop3srv
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+var _ Mailbox = (*staticMailbox)(nil)
+
+// staticMailbox is an in-memory [Mailbox] with preloaded messages.
+type staticMailbox struct {
+	mu       sync.Mutex
+	messages [][]byte
+	toDelete map[int]struct{}
+}
+
+// NewStaticMailbox creates [Mailbox] serving messages from memory.
+//
+// Sizes are lengths of the messages and unique identifiers (UIDL)
+// are hex encoded SHA-1 of messages' content. Messages marked
+// with Dele are removed on Close, so the same mailbox can be provided
+// again for subsequent sessions of the user.
+func NewStaticMailbox(messages [][]byte) Mailbox {
+	return &staticMailbox{
+		messages: messages,
+		toDelete: make(map[int]struct{}),
+	}
+}
+
+func (m *staticMailbox) Stat() (int, int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	size := 0
+	for _, msg := range m.messages {
+		size += len(msg)
+	}
+	return len(m.messages), size, nil
+}
+
+func (m *staticMailbox) List() ([]int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sizes := make([]int, len(m.messages))
+	for i, msg := range m.messages {
+		sizes[i] = len(msg)
+	}
+	return sizes, nil
+}
+
+func (m *staticMailbox) ListOne(msgNumber int) (int, error) {
+	msg, err := m.message(msgNumber)
+	return len(msg), err
+}
+
+func (m *staticMailbox) Message(msgNumber int) (io.ReadCloser, error) {
+	msg, err := m.message(msgNumber)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(msg)), nil
+}
+
+func (m *staticMailbox) Dele(msgNumber int) error {
+	if _, err := m.message(msgNumber); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.toDelete[msgNumber] = struct{}{}
+	return nil
+}
+
+func (m *staticMailbox) Uidl() ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	uidls := make([]string, len(m.messages))
+	for i, msg := range m.messages {
+		uidls[i] = contentUidl(msg)
+	}
+	return uidls, nil
+}
+
+func (m *staticMailbox) UidlOne(msgNumber int) (string, error) {
+	msg, err := m.message(msgNumber)
+	if err != nil {
+		return "", err
+	}
+	return contentUidl(msg), nil
+}
+
+// Close removes messages marked with Dele.
+func (m *staticMailbox) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.toDelete) == 0 {
+		return nil
+	}
+	messages := make([][]byte, 0, len(m.messages))
+	for i, msg := range m.messages {
+		if _, deleted := m.toDelete[i]; !deleted {
+			messages = append(messages, msg)
+		}
+	}
+	m.messages = messages
+	clear(m.toDelete)
+	return nil
+}
+
+func (m *staticMailbox) message(msgNumber int) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if msgNumber < 0 || msgNumber >= len(m.messages) {
+		return nil, ErrNoSuchMessage
+	}
+	return m.messages[msgNumber], nil
+}
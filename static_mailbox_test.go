@@ -0,0 +1,70 @@
+package pop3srv_test
+
+import (
+	"io"
+	"testing"
+
+	"github.com/pkierski/pop3srv"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStaticMailbox(t *testing.T) {
+	// GIVEN
+	mailbox := pop3srv.NewStaticMailbox([][]byte{
+		[]byte("Subject: first\r\n\r\nabc\r\n"),
+		[]byte("Subject: second\r\n\r\nabcdef\r\n"),
+	})
+
+	// WHEN
+	n, size, errStat := mailbox.Stat()
+	sizes, errList := mailbox.List()
+	size2, errListOne := mailbox.ListOne(1)
+	uidls, errUidl := mailbox.Uidl()
+	uidl2, errUidlOne := mailbox.UidlOne(1)
+	r, errMessage := mailbox.Message(0)
+	require.NoError(t, errMessage)
+	content, _ := io.ReadAll(r)
+	_, errInvalid := mailbox.Message(2)
+
+	// THEN
+	assert.NoError(t, errStat)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, 23+27, size)
+	assert.NoError(t, errList)
+	assert.Equal(t, []int{23, 27}, sizes)
+	assert.NoError(t, errListOne)
+	assert.Equal(t, 27, size2)
+	assert.NoError(t, errUidl)
+	assert.Len(t, uidls, 2)
+	assert.Regexp(t, `^[0-9a-f]{40}$`, uidls[0])
+	assert.NotEqual(t, uidls[0], uidls[1])
+	assert.NoError(t, errUidlOne)
+	assert.Equal(t, uidls[1], uidl2)
+	assert.Equal(t, "Subject: first\r\n\r\nabc\r\n", string(content))
+	assert.Error(t, errInvalid)
+}
+
+func TestStaticMailboxDeleAppliedOnClose(t *testing.T) {
+	// GIVEN
+	mailbox := pop3srv.NewStaticMailbox([][]byte{
+		[]byte("first"),
+		[]byte("second"),
+		[]byte("third"),
+	})
+	uidls, _ := mailbox.Uidl()
+
+	// WHEN
+	require.NoError(t, mailbox.Dele(0))
+	require.NoError(t, mailbox.Dele(2))
+	nBeforeClose, _, _ := mailbox.Stat()
+	require.NoError(t, mailbox.Close())
+
+	// THEN
+	assert.Equal(t, 3, nBeforeClose)
+	n, size, _ := mailbox.Stat()
+	assert.Equal(t, 1, n)
+	assert.Equal(t, len("second"), size)
+	uidlsAfterClose, _ := mailbox.Uidl()
+	assert.Equal(t, []string{uidls[1]}, uidlsAfterClose)
+}
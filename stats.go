@@ -0,0 +1,55 @@
+package pop3srv
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// sessionStats accumulates statistics of a session
+// reported in the access log when the session ends.
+type sessionStats struct {
+	start     time.Time
+	retrieved int
+	bytesIn   countingReader
+	bytesOut  countingWriter
+}
+
+// countingReader counts bytes read from underlying reader.
+type countingReader struct {
+	r io.Reader
+	n atomic.Int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n.Add(int64(n))
+	return n, err
+}
+
+// countingWriter counts bytes written to underlying writer.
+// Write errors are wrapped with [ErrConnectionLost].
+type countingWriter struct {
+	w io.Writer
+	n atomic.Int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n.Add(int64(n))
+	if err != nil {
+		err = fmt.Errorf("%w: %w", ErrConnectionLost, err)
+	}
+	return n, err
+}
+
+// remoteAddr returns remote address of the connection (with canonical
+// IP address) if it's available, "unknown" otherwise.
+func remoteAddr(c Conn) string {
+	if nc, ok := c.(interface{ RemoteAddr() net.Addr }); ok && nc.RemoteAddr() != nil {
+		return canonicalAddr(nc.RemoteAddr().String())
+	}
+	return "unknown"
+}
@@ -0,0 +1,27 @@
+package pop3srv
+
+import "crypto/tls"
+
+// DefaultTLSConfig returns TLS configuration for STLS and implicit TLS
+// with cert as server certificate, TLS 1.2 as minimum version and
+// only ECDHE cipher suites with AEAD for TLS 1.2 (TLS 1.3 suites
+// aren't configurable). It can be adjusted before use.
+func DefaultTLSConfig(cert tls.Certificate) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		},
+	}
+}
+
+// hasCertificates checks if cfg can provide server certificate.
+func hasCertificates(cfg *tls.Config) bool {
+	return len(cfg.Certificates) > 0 || cfg.GetCertificate != nil || cfg.GetConfigForClient != nil
+}
@@ -0,0 +1,471 @@
+package pop3srv_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkierski/pop3srv"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestCertificate generates self-signed certificate usable
+// both for server and client authentication.
+func newTestCertificate(t *testing.T, commonName string) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: commonName},
+		DNSNames:              []string{commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, pool
+}
+
+type externalAuthorizer struct {
+	pop3srv.AllowAllAuthorizer
+	commonName string
+}
+
+func (a externalAuthorizer) External(ctx context.Context, user string) error {
+	state, ok := pop3srv.TLSConnectionStateFromContext(ctx)
+	if !ok || state.PeerCertificates[0].Subject.CommonName != a.commonName || user != a.commonName {
+		return errors.New("certificate doesn't match user")
+	}
+	return nil
+}
+
+func TestSessionAuthExternal(t *testing.T) {
+	// GIVEN
+	serverCert, serverPool := newTestCertificate(t, "pop3.example.org")
+	clientCert, clientPool := newTestCertificate(t, "testuser")
+
+	serverConn, clientConn := net.Pipe()
+	session := pop3srv.NewSession(
+		tls.Server(serverConn, &tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    clientPool,
+		}),
+		pop3srv.EmptyMailboxProvider{},
+		externalAuthorizer{commonName: "testuser"},
+	)
+	errCh := make(chan error)
+	go func() { errCh <- session.Serve() }()
+
+	client := textproto.NewConn(tls.Client(clientConn, &tls.Config{
+		Certificates: []tls.Certificate{clientCert},
+		RootCAs:      serverPool,
+		ServerName:   "pop3.example.org",
+	}))
+
+	// WHEN
+	banner, err := client.ReadLine()
+	require.NoError(t, err)
+	require.NoError(t, client.PrintfLine("CAPA"))
+	capa, err := client.ReadDotLines()
+	require.NoError(t, err)
+	require.NoError(t, client.PrintfLine("AUTH EXTERNAL"))
+	continuation, err := client.ReadLine()
+	require.NoError(t, err)
+	require.NoError(t, client.PrintfLine("*"))
+	abortResponse, err := client.ReadLine()
+	require.NoError(t, err)
+	require.NoError(t, client.PrintfLine("AUTH EXTERNAL ="))
+	authResponse, err := client.ReadLine()
+	require.NoError(t, err)
+	require.NoError(t, client.PrintfLine("QUIT"))
+	quitResponse, err := client.ReadLine()
+	require.NoError(t, err)
+	clientConn.Close()
+
+	// THEN
+	assert.NoError(t, <-errCh)
+	assert.True(t, strings.HasPrefix(banner, "+OK"))
+	assert.Contains(t, capa, "SASL EXTERNAL")
+	assert.Equal(t, "+ ", continuation)
+	assert.Equal(t, "-ERR authentication aborted", abortResponse)
+	assert.Equal(t, "+OK logged in", authResponse)
+	assert.True(t, strings.HasPrefix(quitResponse, "+OK"))
+}
+
+func TestSessionRequireTLS(t *testing.T) {
+	// GIVEN
+	serverCert, serverPool := newTestCertificate(t, "pop3.example.org")
+
+	serverConn, clientConn := net.Pipe()
+	session := pop3srv.NewSession(serverConn, pop3srv.EmptyMailboxProvider{}, pop3srv.AllowAllAuthorizer{})
+	session.TLSConfig = &tls.Config{Certificates: []tls.Certificate{serverCert}}
+	session.RequireTLS = true
+	errCh := make(chan error)
+	go func() { errCh <- session.Serve() }()
+
+	client := textproto.NewConn(clientConn)
+	cmd := func(line string) string {
+		require.NoError(t, client.PrintfLine("%s", line))
+		response, err := client.ReadLine()
+		require.NoError(t, err)
+		return response
+	}
+
+	// WHEN
+	_, err := client.ReadLine() // Banner
+	require.NoError(t, err)
+	userBeforeTLS := cmd("USER testuser")
+	require.NoError(t, client.PrintfLine("CAPA"))
+	capaBeforeTLS, err := client.ReadDotLines()
+	require.NoError(t, err)
+	stlsResponse := cmd("STLS")
+
+	client = textproto.NewConn(tls.Client(clientConn, &tls.Config{
+		RootCAs:    serverPool,
+		ServerName: "pop3.example.org",
+	}))
+	userAfterTLS := cmd("USER testuser")
+	passAfterTLS := cmd("PASS testpass")
+	quitResponse := cmd("QUIT")
+	clientConn.Close()
+
+	// THEN
+	assert.NoError(t, <-errCh)
+	assert.Equal(t, "-ERR [AUTH] command available only after STARTTLS", userBeforeTLS)
+	assert.Contains(t, capaBeforeTLS, "STLS")
+	assert.NotContains(t, capaBeforeTLS, "USER")
+	assert.True(t, strings.HasPrefix(stlsResponse, "+OK"))
+	assert.True(t, strings.HasPrefix(userAfterTLS, "+OK"))
+	assert.Equal(t, "+OK logged in", passAfterTLS)
+	assert.True(t, strings.HasPrefix(quitResponse, "+OK"))
+}
+
+func TestSessionStlsDiscardsBufferedInput(t *testing.T) {
+	// GIVEN
+	serverCert, serverPool := newTestCertificate(t, "pop3.example.org")
+
+	serverConn, clientConn := net.Pipe()
+	session := pop3srv.NewSession(serverConn, pop3srv.EmptyMailboxProvider{}, pop3srv.AllowAllAuthorizer{})
+	session.TLSConfig = &tls.Config{Certificates: []tls.Certificate{serverCert}}
+	errCh := make(chan error)
+	go func() { errCh <- session.Serve() }()
+
+	client := textproto.NewConn(clientConn)
+	cmd := func(line string) string {
+		require.NoError(t, client.PrintfLine("%s", line))
+		response, err := client.ReadLine()
+		require.NoError(t, err)
+		return response
+	}
+
+	// WHEN
+	_, err := client.ReadLine() // Banner
+	require.NoError(t, err)
+	require.NoError(t, clientConn.SetDeadline(time.Now().Add(5*time.Second)))
+	// plaintext injected after STLS in the same packet
+	_, err = clientConn.Write([]byte("STLS\r\nUSER injected\r\n"))
+	require.NoError(t, err)
+	stlsResponse, err := client.ReadLine()
+	require.NoError(t, err)
+
+	client = textproto.NewConn(tls.Client(clientConn, &tls.Config{
+		RootCAs:    serverPool,
+		ServerName: "pop3.example.org",
+	}))
+	passResponse := cmd("PASS testpass")
+	quitResponse := cmd("QUIT")
+	clientConn.Close()
+
+	// THEN
+	assert.NoError(t, <-errCh)
+	assert.True(t, strings.HasPrefix(stlsResponse, "+OK"))
+	assert.Equal(t, "-ERR "+pop3srv.ErrUserNotSpecified.Error(), passResponse) // injected USER is discarded
+	assert.True(t, strings.HasPrefix(quitResponse, "+OK"))
+}
+
+func TestSessionApopAfterStls(t *testing.T) {
+	// GIVEN
+	serverCert, serverPool := newTestCertificate(t, "pop3.example.org")
+
+	serverConn, clientConn := net.Pipe()
+	session := pop3srv.NewSession(serverConn, pop3srv.EmptyMailboxProvider{}, pop3srv.AllowAllAuthorizer{})
+	session.TLSConfig = &tls.Config{Certificates: []tls.Certificate{serverCert}}
+	errCh := make(chan error)
+	go func() { errCh <- session.Serve() }()
+
+	client := textproto.NewConn(clientConn)
+	cmd := func(line string) string {
+		require.NoError(t, client.PrintfLine("%s", line))
+		response, err := client.ReadLine()
+		require.NoError(t, err)
+		return response
+	}
+
+	// WHEN
+	banner, err := client.ReadLine()
+	require.NoError(t, err)
+	stlsResponse := cmd("STLS")
+
+	client = textproto.NewConn(tls.Client(clientConn, &tls.Config{
+		RootCAs:    serverPool,
+		ServerName: "pop3.example.org",
+	}))
+	apopResponse := cmd("APOP testuser c4c9334bac560ecc979e58001b3e22fb")
+	userResponse := cmd("USER testuser")
+	passResponse := cmd("PASS testpass")
+	quitResponse := cmd("QUIT")
+	clientConn.Close()
+
+	// THEN
+	assert.NoError(t, <-errCh)
+	assert.Contains(t, banner, "<") // APOP timestamp banner sent in plaintext
+	assert.True(t, strings.HasPrefix(stlsResponse, "+OK"))
+	assert.Equal(t, "-ERR APOP not available after STLS", apopResponse)
+	assert.True(t, strings.HasPrefix(userResponse, "+OK"))
+	assert.Equal(t, "+OK logged in", passResponse)
+	assert.True(t, strings.HasPrefix(quitResponse, "+OK"))
+}
+
+func TestServerServeWithConfig(t *testing.T) {
+	// GIVEN
+	serverCert, serverPool := newTestCertificate(t, "pop3.example.org")
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{serverCert}}
+	server := pop3srv.NewServer(pop3srv.AllowAllAuthorizer{}, pop3srv.EmptyMailboxProvider{})
+	server.TLSConfig = tlsConfig
+
+	plainListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	implicitListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	errCh := make(chan error, 2)
+	go func() { errCh <- server.Serve(plainListener) }()
+	go func() {
+		errCh <- server.ServeWithConfig(implicitListener, pop3srv.ServeConfig{ImplicitTLS: true})
+	}()
+
+	capa := func(conn net.Conn) []string {
+		defer conn.Close()
+		client := textproto.NewConn(conn)
+		_, err := client.ReadLine() // Banner
+		require.NoError(t, err)
+		require.NoError(t, client.PrintfLine("CAPA"))
+		_, err = client.ReadLine()
+		require.NoError(t, err)
+		lines, err := client.ReadDotLines()
+		require.NoError(t, err)
+		require.NoError(t, client.PrintfLine("QUIT"))
+		_, err = client.ReadLine()
+		require.NoError(t, err)
+		return lines
+	}
+
+	// WHEN
+	plainConn, err := net.Dial("tcp", plainListener.Addr().String())
+	require.NoError(t, err)
+	plainCapa := capa(plainConn)
+
+	implicitConn, err := tls.Dial("tcp", implicitListener.Addr().String(), &tls.Config{
+		RootCAs:    serverPool,
+		ServerName: "pop3.example.org",
+	})
+	require.NoError(t, err)
+	implicitCapa := capa(implicitConn)
+
+	// THEN
+	assert.Contains(t, plainCapa, "STLS")
+	assert.NotContains(t, implicitCapa, "STLS")
+
+	require.NoError(t, server.Close())
+	assert.ErrorIs(t, <-errCh, pop3srv.ErrServerClosed)
+	assert.ErrorIs(t, <-errCh, pop3srv.ErrServerClosed)
+}
+
+func TestServerConnectionsLimitImplicitTLS(t *testing.T) {
+	// GIVEN
+	serverCert, serverPool := newTestCertificate(t, "pop3.example.org")
+	server := pop3srv.NewServer(pop3srv.AllowAllAuthorizer{}, pop3srv.EmptyMailboxProvider{})
+	server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{serverCert}}
+	server.ConnectionsLimit = 1
+	server.CloseLinger = 5 * time.Second
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.ServeWithConfig(listener, pop3srv.ServeConfig{ImplicitTLS: true})
+	t.Cleanup(func() { server.Close() })
+
+	dial := func() *textproto.Conn {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{
+			RootCAs:    serverPool,
+			ServerName: "pop3.example.org",
+		})
+		require.NoError(t, err)
+		conn.SetDeadline(time.Now().Add(time.Second))
+		client := textproto.NewConn(conn)
+		t.Cleanup(func() { client.Close() })
+		_, err = client.ReadLine() // Banner
+		require.NoError(t, err)
+		return client
+	}
+	first := dial()
+
+	// WHEN
+	// rejected client never starts TLS handshake
+	silent, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer silent.Close()
+	silent.SetReadDeadline(time.Now().Add(time.Second))
+	n, errSilent := silent.Read(make([]byte, 1))
+	require.NoError(t, first.PrintfLine("QUIT"))
+	_, err = first.ReadLine()
+	require.NoError(t, err)
+	first.Close() // ends CloseLinger
+	require.Eventually(t, func() bool { return len(server.Sessions()) == 0 }, time.Second, 10*time.Millisecond)
+	second := dial()
+
+	// THEN
+	assert.Zero(t, n)
+	assert.ErrorIs(t, errSilent, io.EOF) // closed without response
+	require.NoError(t, second.PrintfLine("QUIT"))
+	response, err := second.ReadLine()
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(response, "+OK"), response)
+}
+
+func TestServerServeWithConfigImplicitTLSWithoutConfig(t *testing.T) {
+	// GIVEN
+	server := pop3srv.NewServer(pop3srv.AllowAllAuthorizer{}, pop3srv.EmptyMailboxProvider{})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	// WHEN
+	err = server.ServeWithConfig(listener, pop3srv.ServeConfig{ImplicitTLS: true})
+
+	// THEN
+	assert.ErrorIs(t, err, pop3srv.ErrTLSNotAvailable)
+}
+
+func TestServerServeWithConfigNoCertificates(t *testing.T) {
+	// GIVEN
+	server := pop3srv.NewServer(pop3srv.AllowAllAuthorizer{}, pop3srv.EmptyMailboxProvider{})
+	server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	// WHEN
+	err = server.Serve(listener)
+
+	// THEN
+	assert.ErrorIs(t, err, pop3srv.ErrTLSNoCertificates)
+}
+
+func TestDefaultTLSConfigMinVersion(t *testing.T) {
+	// GIVEN
+	serverCert, serverPool := newTestCertificate(t, "pop3.example.org")
+	server := pop3srv.NewServer(pop3srv.AllowAllAuthorizer{}, pop3srv.EmptyMailboxProvider{})
+	server.TLSConfig = pop3srv.DefaultTLSConfig(serverCert)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.ServeWithConfig(listener, pop3srv.ServeConfig{ImplicitTLS: true})
+	t.Cleanup(func() { server.Close() })
+
+	dial := func(version uint16) (*tls.Conn, error) {
+		return tls.Dial("tcp", listener.Addr().String(), &tls.Config{
+			RootCAs:    serverPool,
+			ServerName: "pop3.example.org",
+			MinVersion: tls.VersionTLS10,
+			MaxVersion: version,
+		})
+	}
+
+	// WHEN
+	_, errTLS11 := dial(tls.VersionTLS11)
+	conn, errTLS12 := dial(tls.VersionTLS12)
+
+	// THEN
+	assert.Error(t, errTLS11)
+	require.NoError(t, errTLS12)
+	defer conn.Close()
+	assert.Equal(t, uint16(tls.VersionTLS12), conn.ConnectionState().Version)
+}
+
+// domainProvider provides empty mailboxes and records
+// server names requested by clients with SNI.
+type domainProvider struct {
+	pop3srv.EmptyMailboxProvider
+	serverNames chan string
+}
+
+func (p domainProvider) ProvideContext(ctx context.Context, user string) (pop3srv.Mailbox, error) {
+	p.serverNames <- pop3srv.ServerNameFromContext(ctx)
+	return p.Provide(user)
+}
+
+func TestServerSNI(t *testing.T) {
+	// GIVEN
+	orgCert, orgPool := newTestCertificate(t, "pop3.example.org")
+	comCert, comPool := newTestCertificate(t, "pop3.example.com")
+	certs := map[string]*tls.Certificate{"pop3.example.org": &orgCert, "pop3.example.com": &comCert}
+	provider := domainProvider{serverNames: make(chan string, 2)}
+	server := pop3srv.NewServer(pop3srv.AllowAllAuthorizer{}, provider)
+	server.TLSConfig = &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if cert, ok := certs[hello.ServerName]; ok {
+				return cert, nil
+			}
+			return nil, errors.New("unknown server name")
+		},
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.ServeWithConfig(listener, pop3srv.ServeConfig{ImplicitTLS: true})
+	t.Cleanup(func() { server.Close() })
+
+	login := func(serverName string, pool *x509.CertPool) {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{RootCAs: pool, ServerName: serverName})
+		require.NoError(t, err)
+		defer conn.Close()
+		client := textproto.NewConn(conn)
+		for _, line := range []string{"", "USER testuser", "PASS testpass", "QUIT"} {
+			if line != "" {
+				require.NoError(t, client.PrintfLine("%s", line))
+			}
+			response, err := client.ReadLine()
+			require.NoError(t, err)
+			require.True(t, strings.HasPrefix(response, "+OK"), response)
+		}
+	}
+
+	// WHEN
+	login("pop3.example.org", orgPool)
+	login("pop3.example.com", comPool)
+
+	// THEN
+	assert.Equal(t, "pop3.example.org", <-provider.serverNames)
+	assert.Equal(t, "pop3.example.com", <-provider.serverNames)
+}
@@ -0,0 +1,71 @@
+package pop3srv
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// TranscriptConn is a [net.Conn] which records exact bytes read from
+// and written to the wrapped connection, including message contents,
+// for debugging interoperability issues with clients. It can be passed
+// to [NewSession] in place of the wrapped connection.
+//
+// Every chunk of data is recorded as a marker line with direction
+// ("C->S" for data sent by the client, "S->C" for data sent by the server)
+// and length in bytes (e.g. "C->S (6 bytes)"), followed by raw data
+// and a newline.
+//
+// After STLS command the session wraps TranscriptConn with TLS,
+// so encrypted data is recorded.
+type TranscriptConn struct {
+	net.Conn
+
+	mu         sync.Mutex
+	transcript io.Writer
+}
+
+// NewTranscriptConn creates [TranscriptConn] recording data
+// of conn to transcript. Errors of writing to transcript are ignored.
+func NewTranscriptConn(conn net.Conn, transcript io.Writer) *TranscriptConn {
+	return &TranscriptConn{
+		Conn:       conn,
+		transcript: transcript,
+	}
+}
+
+func (c *TranscriptConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.record("C->S", p[:n])
+	return n, err
+}
+
+func (c *TranscriptConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.record("S->C", p[:n])
+	return n, err
+}
+
+// CloseWrite shuts down the writing side of the wrapped connection
+// if it supports half-close (e.g. [net.TCPConn]), so [Session.CloseLinger]
+// works with transcribed connections. Otherwise it returns
+// [errors.ErrUnsupported].
+func (c *TranscriptConn) CloseWrite() error {
+	if conn, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return conn.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+// record writes chunk of data to the transcript,
+// Read and Write can be called concurrently.
+func (c *TranscriptConn) record(direction string, p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(c.transcript, "%s (%d bytes)\n%s\n", direction, len(p), p)
+}
@@ -0,0 +1,67 @@
+package pop3srv_test
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkierski/pop3srv"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTranscriptConn(t *testing.T) {
+	// GIVEN
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	transcript := &strings.Builder{}
+	conn := pop3srv.NewTranscriptConn(serverConn, transcript)
+	session := pop3srv.NewSession(conn, pop3srv.EmptyMailboxProvider{}, pop3srv.DisableApop(pop3srv.AllowAllAuthorizer{}))
+	done := make(chan error)
+	go func() { done <- session.Serve() }()
+
+	// WHEN
+	client := bufio.NewReader(clientConn)
+	_, err := client.ReadString('\n') // Banner
+	require.NoError(t, err)
+	_, err = clientConn.Write([]byte("QUIT\r\n"))
+	require.NoError(t, err)
+	_, err = client.ReadString('\n') // QUIT response
+	require.NoError(t, err)
+	require.NoError(t, <-done)
+
+	// THEN
+	assert.Equal(t, "S->C (23 bytes)\n+OK POP3 server ready\r\n\n"+
+		"C->S (6 bytes)\nQUIT\r\n\n"+
+		"S->C (24 bytes)\n+OK server signing off\r\n\n",
+		transcript.String())
+}
+
+func TestTranscriptConnCloseWrite(t *testing.T) {
+	// GIVEN
+	serverConn, clientConn := net.Pipe()
+	halfClose := &halfCloseConn{Conn: serverConn}
+	conn := pop3srv.NewTranscriptConn(halfClose, &strings.Builder{})
+	session := pop3srv.NewSession(conn, pop3srv.EmptyMailboxProvider{}, pop3srv.AllowAllAuthorizer{})
+	session.CloseLinger = time.Minute
+	done := make(chan error)
+	go func() { done <- session.Serve() }()
+
+	// WHEN
+	client := bufio.NewReader(clientConn)
+	_, err := client.ReadString('\n') // Banner
+	require.NoError(t, err)
+	_, err = clientConn.Write([]byte("QUIT\r\n"))
+	require.NoError(t, err)
+	_, err = client.ReadString('\n') // QUIT response
+	require.NoError(t, err)
+	clientConn.Close()
+
+	// THEN
+	assert.NoError(t, <-done)
+	assert.Equal(t, []string{"CloseWrite", "Close"}, halfClose.calls)
+	assert.ErrorIs(t, pop3srv.NewTranscriptConn(serverConn, &strings.Builder{}).CloseWrite(), errors.ErrUnsupported)
+}
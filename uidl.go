@@ -0,0 +1,30 @@
+package pop3srv
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+)
+
+// ContentUIDL computes unique-id of the message from its content read from r.
+// It's hex encoded SHA-1 of the content, which fits in the 70 characters
+// limit of RFC 1939 and is stable as long as the content isn't changed.
+//
+// Backends without persistent identifiers can use it in [Mailbox.Uidl]
+// and [Mailbox.UidlOne] instead of deriving unique-ids from mutable
+// fields. Note that identical messages get identical unique-ids, backends
+// which can store duplicates have to disambiguate them.
+func ContentUIDL(r io.Reader) (string, error) {
+	hash := sha1.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// contentUidl is [ContentUIDL] for message content in memory.
+func contentUidl(msg []byte) string {
+	uidl, _ := ContentUIDL(bytes.NewReader(msg))
+	return uidl
+}
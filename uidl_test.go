@@ -0,0 +1,57 @@
+package pop3srv_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/pkierski/pop3srv"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContentUIDL(t *testing.T) {
+	// GIVEN
+	msg := "Subject: test\r\n\r\nbody\r\n"
+
+	// WHEN
+	first, err := pop3srv.ContentUIDL(strings.NewReader(msg))
+	require.NoError(t, err)
+	second, err := pop3srv.ContentUIDL(iotest.OneByteReader(strings.NewReader(msg)))
+	require.NoError(t, err)
+	other, err := pop3srv.ContentUIDL(strings.NewReader(msg + "more\r\n"))
+	require.NoError(t, err)
+
+	// THEN
+	assert.Equal(t, "1d1fdc9f95d6baec029a5b1dbf2392aed2f0838f", first)
+	assert.Equal(t, first, second)
+	assert.NotEqual(t, first, other)
+}
+
+func TestContentUIDLMatchesStaticMailbox(t *testing.T) {
+	// GIVEN
+	msg := []byte("Subject: test\r\n\r\nbody\r\n")
+	mailbox := pop3srv.NewStaticMailbox([][]byte{msg})
+
+	// WHEN
+	expected, err := pop3srv.ContentUIDL(strings.NewReader(string(msg)))
+	require.NoError(t, err)
+	uidl, err := mailbox.UidlOne(0)
+	require.NoError(t, err)
+
+	// THEN
+	assert.Equal(t, expected, uidl)
+}
+
+func TestContentUIDLReadError(t *testing.T) {
+	// GIVEN
+	readErr := errors.New("read error")
+
+	// WHEN
+	uidl, err := pop3srv.ContentUIDL(iotest.ErrReader(readErr))
+
+	// THEN
+	assert.ErrorIs(t, err, readErr)
+	assert.Empty(t, uidl)
+}
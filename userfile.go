@@ -0,0 +1,107 @@
+package pop3srv
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// userFile holds "user:value" entries loaded from a file.
+//
+// Empty lines and lines starting with '#' are ignored.
+// The file is reloaded on lookup if its modification time
+// or size has changed.
+type userFile struct {
+	path     string
+	validate func(value string) error
+
+	mu      sync.RWMutex
+	entries map[string]string
+	modTime time.Time
+	size    int64
+}
+
+func newUserFile(path string, validate func(value string) error) (*userFile, error) {
+	f := &userFile{
+		path:     path,
+		validate: validate,
+	}
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// reload reads and parses the file unconditionally.
+// On error previously loaded entries are kept.
+func (f *userFile) reload() error {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	entries := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, value, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return fmt.Errorf("%s:%d: malformed entry", f.path, lineNo)
+		}
+		if f.validate != nil {
+			if err := f.validate(value); err != nil {
+				return fmt.Errorf("%s:%d: %w", f.path, lineNo, err)
+			}
+		}
+		entries[user] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.entries = entries
+	f.modTime = info.ModTime()
+	f.size = info.Size()
+	return nil
+}
+
+// lookup returns value for the user, reloading the file first
+// if it has changed since last load. Reload error is logged to logger
+// (the standard logger if it's nil).
+func (f *userFile) lookup(user string, logger *log.Logger) (string, bool) {
+	if f.changed() {
+		if err := f.reload(); err != nil {
+			loggerOrDefault(logger).Printf("Reloading %s failed, using previous entries: %v", f.path, err)
+		}
+	}
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	value, ok := f.entries[user]
+	return value, ok
+}
+
+func (f *userFile) changed() bool {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return false
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return !info.ModTime().Equal(f.modTime) || info.Size() != f.size
+}